@@ -22,20 +22,25 @@ THE SOFTWARE.
 
 import (
 	"bytes"
+	"errors"
 	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/McFlip/enigma/cmd/decipher"
+	"github.com/McFlip/enigma/cmd/filter"
+	"github.com/McFlip/enigma/cmd/mbox"
+	"github.com/McFlip/enigma/cmd/outlook"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
-	ct, pt        *string
-	eml, parallel *bool
+	ct, pt, sidecar, mboxVariant, output                     *string
+	eml, parallel, provenance, metadata, dedup, suppressDups *bool
 )
 
 // decipherCmd represents the decipher command
@@ -45,7 +50,44 @@ var decipherCmd = &cobra.Command{
 	Long: `Decipher encrypted emails in a batch of PST archives.
 
   Ensure you have configured the case and extracted all of your keys 1st.
-  Successfully deciphered emails will output RFC822 format emails as '.eml' files`,
+  Successfully deciphered emails will output RFC822 format emails as '.eml' files
+  Set 'output' to mbox to instead append each custodian's plaintext to <custodian>.mbox (mboxrd).
+  success.tsv then records the message Index and byte Offset of its From line rather than a file name.
+  mbox files (.mbox, .mbx, or no extension starting with a From line) are split into messages
+  and logged as path#offset, where offset is the byte offset of the message's From line.
+  Set 'mboxVariant' to mboxrd (default) or mboxo to match how the mbox escaped From lines.
+  Outlook .msg files are read directly, without readpst.
+  Set 'sidecar' to keep the original ciphertext next to each output:
+    p7m    - the smime.p7m envelope as DER, ex. 1.eml & 1.p7m
+    source - the whole source message, ex. 1.eml & 1.source.eml
+  The sidecar file name is logged in the Ciphertext column of success.tsv
+  Rows are appended to existing logs only when success.tsv has the same columns.
+  A log from another version or output mode stops the run, move it aside first.
+  Set 'provenance' to prepend these headers to each output, above the original headers:
+    X-Enigma-Source         - input file, or path inside the PST it was unpacked from
+    X-Enigma-Source-SHA256  - hash of the input message
+    X-Enigma-Key-Serial     - serial of each cert used to decipher
+    X-Enigma-Decrypted-At   - UTC time of decryption
+    X-Enigma-Layers         - number of encryption layers deciphered
+    X-Enigma-Signed-Layers  - number of opaque-signed layers unwrapped, which need no key
+  Set 'metadata' to write a JSON sidecar per output, ex. 1.eml & 1.json, holding
+  headers, decryption layers, attachment inventory, hashes, source and custodian
+  The shared filters (from-date, to-date, folder, sender, recipient) scope the run.
+  Messages out of scope are not deciphered or logged, only counted in each
+  custodian's logs/filterSummary.tsv. The folder of a PST message is its path
+  below the top of the mailbox, where readpst unpacked it. mbox and .msg input
+  has no folders, so the folder filter keeps it and counts it as no-folder.
+  After unpacking each PST, the items in every folder, less contacts, calendar
+  and other items readpst doesn't extract as email, are compared with the .eml
+  files readpst wrote. Folders that differ are logged in logs/extractionAudit.tsv
+  so items readpst skipped show up before production.
+  Set 'dedup' to find messages deciphered more than once across custodians,
+  by Message-ID and a hash of the normalized content of each part, which leaves
+  out MIME boundaries and header order. Every copy is listed in
+  duplicates.tsv in the pt dir, with all the custodians it was found for.
+  Set 'suppressDuplicates' as well to write only the first copy. Later copies
+  are logged in success.tsv with Status duplicate, no output, and the first
+  copy in the Duplicate Of column.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		viper.SetDefault("decipher.ct", "ct")
 		*ct = viper.GetString("decipher.ct")
@@ -67,6 +109,39 @@ var decipherCmd = &cobra.Command{
 		// flag to allow parallel jobs for readpst if using built-from-source version
 		viper.SetDefault("decipher.parallel", true)
 		*parallel = viper.GetBool("decipher.parallel")
+		*sidecar = viper.GetString("decipher.sidecar")
+		if *sidecar != "" && *sidecar != decipher.SidecarP7m && *sidecar != decipher.SidecarSource {
+			log.Fatal("sidecar must be one of: p7m, source")
+		}
+		viper.SetDefault("decipher.provenance", false)
+		*provenance = viper.GetBool("decipher.provenance")
+		viper.SetDefault("decipher.metadata", false)
+		*metadata = viper.GetBool("decipher.metadata")
+		viper.SetDefault("decipher.mboxVariant", string(mbox.MboxRD))
+		*mboxVariant = viper.GetString("decipher.mboxVariant")
+		if *mboxVariant != string(mbox.MboxRD) && *mboxVariant != string(mbox.MboxO) {
+			log.Fatal("mboxVariant must be one of: mboxrd, mboxo")
+		}
+		viper.SetDefault("decipher.output", decipher.OutputEml)
+		*output = viper.GetString("decipher.output")
+		if *output != decipher.OutputEml && *output != decipher.OutputMbox {
+			log.Fatal("output must be one of: eml, mbox")
+		}
+		viper.SetDefault("decipher.dedup", false)
+		*dedup = viper.GetBool("decipher.dedup")
+		viper.SetDefault("decipher.suppressDuplicates", false)
+		*suppressDups = viper.GetBool("decipher.suppressDuplicates")
+		criteria := scopeFilter(cmd)
+		opts := decipher.Options{
+			Sidecar:     *sidecar,
+			Provenance:  *provenance,
+			Metadata:    *metadata,
+			MboxVariant: mbox.Variant(*mboxVariant),
+			Output:      *output,
+		}
+		if *dedup || *suppressDups {
+			opts.Dedup = decipher.NewDedup(*suppressDups)
+		}
 
 		// for each custodian, unpack each pst and decipher
 		const unpack = "/mnt/ramdisk/unpack"
@@ -85,6 +160,17 @@ var decipherCmd = &cobra.Command{
 			numProcs = out.String()
 		}
 
+		// each custodian's filter counts what was left out of their output
+		writeSummary := func() {
+			if outDir == "" {
+				return
+			}
+			summaryPath := filepath.Join(outDir, "logs", "filterSummary.tsv")
+			if err := opts.Filter.WriteSummary(summaryPath); err != nil {
+				log.Fatal("Error writing ", summaryPath, " err: ", err)
+			}
+		}
+
 		filepath.Walk(*ct, func(path string, info fs.FileInfo, err error) error {
 			if err != nil {
 				log.Fatal(err)
@@ -97,6 +183,7 @@ var decipherCmd = &cobra.Command{
 				if base == *ct {
 					return nil
 				}
+				writeSummary()
 				outDir = filepath.Join(*pt, base)
 				err := os.Mkdir(outDir, 0755)
 				if err != nil {
@@ -116,14 +203,26 @@ var decipherCmd = &cobra.Command{
 						err,
 					)
 				}
+				opts.Filter = nil
+				if !criteria.Empty() {
+					opts.Filter = filter.New(criteria)
+				}
 			} else {
 				if *eml {
 					log.Println("Processing .eml files")
-					decipher.Decipher(*ct, *certDir, *keysDir, *casePW, outDir)
+					decipher.Decipher(*ct, *certDir, *keysDir, *casePW, outDir, opts)
 					return filepath.SkipDir
 				}
-				if filepath.Ext(info.Name()) != ".pst" {
-					log.Fatal("ciphertext input must be pst files")
+				if mbox.IsMbox(path) || strings.EqualFold(filepath.Ext(path), ".msg") {
+					// mbox and msg need no unpacking, messages are read straight out of the file
+					log.Println("Processing ", info.Name(), " ...stand by...")
+					decipher.Decipher(path, *certDir, *keysDir, *casePW, outDir, opts)
+					return nil
+				}
+				if _, err := outlook.OpenStore(path); errors.Is(err, outlook.ErrNotStore) {
+					log.Fatal("ciphertext input must be pst, ost, msg or mbox files")
+				} else if err != nil {
+					log.Fatalf("Can't unpack %s: %v", path, err)
 				}
 				err := removeContents(unpack)
 				if err != nil {
@@ -137,8 +236,22 @@ var decipherCmd = &cobra.Command{
 					log.Fatal("Error in readpst: ", err)
 				}
 				log.Println("finished unpacking")
+				// readpst skips items it can't read without saying so, compare what it wrote with the folder counts
+				audits, err := decipher.AuditExtraction(path, unpack)
+				if err != nil {
+					log.Println("Can't audit extraction of ", path, " err: ", err)
+				} else if len(audits) > 0 {
+					log.Println("readpst extraction counts differ in ", len(audits), " folders of ", path)
+				}
+				auditPath := filepath.Join(outDir, "logs", "extractionAudit.tsv")
+				if err := decipher.WriteAudit(auditPath, path, audits); err != nil {
+					log.Fatal("Error writing ", auditPath, " err: ", err)
+				}
 				log.Println("Processing ", info.Name(), " ...stand by...")
-				decipher.Decipher(unpack, *certDir, *keysDir, *casePW, outDir)
+				// report messages by their location inside the PST rather than the unpack dir
+				pstOpts := opts
+				pstOpts.Archive = path
+				decipher.Decipher(unpack, *certDir, *keysDir, *casePW, outDir, pstOpts)
 				err = removeContents(unpack)
 				if err != nil {
 					log.Fatal("Error cleaning out unpack dir ", err)
@@ -146,6 +259,13 @@ var decipherCmd = &cobra.Command{
 			}
 			return nil
 		})
+		writeSummary()
+		if opts.Dedup != nil {
+			duplicatesPath := filepath.Join(*pt, "duplicates.tsv")
+			if err := opts.Dedup.WriteTSV(duplicatesPath); err != nil {
+				log.Fatal("Error writing ", duplicatesPath, " err: ", err)
+			}
+		}
 		log.Println("DONE!")
 	},
 }
@@ -167,6 +287,28 @@ func init() {
 	parallel = decipherCmd.PersistentFlags().
 		Bool("parallel", true, "enable parallel processing for readpst")
 	viper.BindPFlag("decipher.parallel", decipherCmd.PersistentFlags().Lookup("parallel"))
+	sidecar = decipherCmd.PersistentFlags().
+		String("sidecar", "", "keep the original ciphertext next to each output: 'p7m' or 'source'")
+	viper.BindPFlag("decipher.sidecar", decipherCmd.PersistentFlags().Lookup("sidecar"))
+	provenance = decipherCmd.PersistentFlags().
+		Bool("provenance", false, "add X-Enigma-* provenance headers to deciphered output")
+	viper.BindPFlag("decipher.provenance", decipherCmd.PersistentFlags().Lookup("provenance"))
+	metadata = decipherCmd.PersistentFlags().
+		Bool("metadata", false, "write a JSON metadata sidecar for each deciphered output")
+	viper.BindPFlag("decipher.metadata", decipherCmd.PersistentFlags().Lookup("metadata"))
+	mboxVariant = decipherCmd.PersistentFlags().
+		String("mboxVariant", "", "how From lines are escaped in mbox input: 'mboxrd' or 'mboxo'")
+	viper.BindPFlag("decipher.mboxVariant", decipherCmd.PersistentFlags().Lookup("mboxVariant"))
+	output = decipherCmd.PersistentFlags().
+		String("output", "", "write deciphered messages as numbered 'eml' files or 1 'mbox' per custodian")
+	viper.BindPFlag("decipher.output", decipherCmd.PersistentFlags().Lookup("output"))
+	dedup = decipherCmd.PersistentFlags().
+		Bool("dedup", false, "list messages deciphered more than once across custodians in duplicates.tsv")
+	viper.BindPFlag("decipher.dedup", decipherCmd.PersistentFlags().Lookup("dedup"))
+	suppressDups = decipherCmd.PersistentFlags().
+		Bool("suppressDuplicates", false, "write only the first copy of a message deciphered more than once")
+	viper.BindPFlag("decipher.suppressDuplicates", decipherCmd.PersistentFlags().Lookup("suppressDuplicates"))
+	addFilterFlags(decipherCmd)
 }
 
 func removeContents(dir string) error {
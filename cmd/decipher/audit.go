@@ -0,0 +1,167 @@
+package decipher
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/McFlip/enigma/cmd/outlook"
+	pst "github.com/mooijtech/go-pst/v6/pkg"
+	"github.com/rotisserie/eris"
+)
+
+const propMessageClass = 0x001a
+
+// FolderAudit compares what a PST folder holds with what readpst extracted from it
+type FolderAudit struct {
+	// Folder is the path below the top of the mailbox, ex. Inbox/Project. Empty for the top folder itself.
+	Folder string
+	// Items is the folder's item count from its metadata
+	Items int
+	// NotMail counts the contacts, appointments, tasks and other items that readpst -t e leaves out
+	NotMail int
+	// Extracted is how many .eml files readpst wrote for the folder
+	Extracted int
+}
+
+// Missing is how many mail items readpst did not extract. Negative when it wrote more than the folder holds,
+// ex. recovered deleted items.
+func (a FolderAudit) Missing() int {
+	return a.Items - a.NotMail - a.Extracted
+}
+
+// AuditExtraction counts the items in every folder of the PST at archive and the .eml files readpst unpacked
+// from it into unpackDir. Only folders whose counts disagree are returned. A folder readpst wrote that isn't in
+// the PST is returned with no items.
+func AuditExtraction(archive, unpackDir string) ([]FolderAudit, error) {
+	folders, err := countFolders(archive)
+	if err != nil {
+		return nil, err
+	}
+	extracted, err := countExtracted(storeDir(unpackDir, folders))
+	if err != nil {
+		return nil, err
+	}
+	for dir, n := range extracted {
+		if folders[dir] == nil {
+			folders[dir] = &FolderAudit{Folder: dir}
+		}
+		folders[dir].Extracted += n
+	}
+	audits := []FolderAudit{}
+	for _, a := range folders {
+		if a.Missing() != 0 {
+			audits = append(audits, *a)
+		}
+	}
+	sort.Slice(audits, func(i, j int) bool { return audits[i].Folder < audits[j].Folder })
+	return audits, nil
+}
+
+// storeDir is where readpst unpacked the top of the mailbox. readpst may put the whole mailbox under a dir named
+// for the store, seen as a lone dir that isn't one of the PST's folders.
+func storeDir(unpackDir string, folders map[string]*FolderAudit) string {
+	entries, err := os.ReadDir(unpackDir)
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() || folders[entries[0].Name()] != nil {
+		return unpackDir
+	}
+	return filepath.Join(unpackDir, entries[0].Name())
+}
+
+// countFolders reads the item count of each folder below the top of the mailbox, the folders readpst unpacks,
+// and how many of those items aren't mail
+func countFolders(archive string) (map[string]*FolderAudit, error) {
+	reader, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	pstFile, err := pst.New(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer pstFile.Cleanup()
+
+	folders := map[string]*FolderAudit{}
+	err = outlook.WalkMailbox(pstFile, func(folder *pst.Folder, folderPath string) error {
+		a := &FolderAudit{Folder: folderPath, Items: int(folder.MessageCount)}
+		var err error
+		if a.NotMail, err = countNotMail(folder); err != nil {
+			return fmt.Errorf("%s: %w", folderPath, err)
+		}
+		folders[folderPath] = a
+		return nil
+	})
+	return folders, err
+}
+
+// countNotMail counts the items in folder that readpst doesn't extract as email
+func countNotMail(folder *pst.Folder) (int, error) {
+	messageIterator, err := folder.GetMessageIterator()
+	if eris.Is(err, pst.ErrMessagesNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	notMail := 0
+	for messageIterator.Next() {
+		message := messageIterator.Value()
+		classReader, err := message.PropertyContext.GetPropertyReader(propMessageClass, message.LocalDescriptors)
+		if err != nil {
+			continue
+		}
+		if class, err := classReader.GetString(); err == nil && !readpstMail(class) {
+			notMail++
+		}
+	}
+	return notMail, messageIterator.Err()
+}
+
+// readpstMail reports whether readpst -t e extracts an item of this message class.
+// libpst types items by class and writes notes, meeting requests and reports as email.
+func readpstMail(class string) bool {
+	class = strings.ToLower(class)
+	for _, prefix := range []string{"ipm.note", "ipm.schedule.meeting", "report.ipm.note"} {
+		if strings.HasPrefix(class, prefix) {
+			return true
+		}
+	}
+	return class == "ipm"
+}
+
+// countExtracted counts the .eml files in each dir under unpackDir, keyed by / separated path
+func countExtracted(unpackDir string) (map[string]int, error) {
+	counts := map[string]int{}
+	err := filepath.WalkDir(unpackDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(file), ".eml") {
+			return nil
+		}
+		counts[folderOf(file, unpackDir)]++
+		return nil
+	})
+	return counts, err
+}
+
+// WriteAudit appends the audits of archive to the extractionAudit.tsv at path, creating it with a header
+func WriteAudit(path, archive string, audits []FolderAudit) error {
+	_, err := os.Stat(path)
+	newLog := errors.Is(err, os.ErrNotExist)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if newLog {
+		f.WriteString("PST\tFolder\tItems\tNot Mail\tExtracted\tMissing\n")
+	}
+	for _, a := range audits {
+		f.WriteString(fmt.Sprintf("%s\t%s\t%d\t%d\t%d\t%d\n", archive, a.Folder, a.Items, a.NotMail, a.Extracted, a.Missing()))
+	}
+	return f.Close()
+}
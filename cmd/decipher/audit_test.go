@@ -0,0 +1,71 @@
+package decipher
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAuditExtraction(t *testing.T) {
+	unpack := t.TempDir()
+	// readpst lost the Inbox message and wrote a folder that isn't in the PST
+	for _, file := range []string{
+		"Top of Outlook data file/Sent Items/1.eml",
+		"Top of Outlook data file/Inbox/buried/deep/down/1.eml",
+		"Top of Outlook data file/Inbox/buried/deep/down/attachment.txt",
+		"Top of Outlook data file/Recovered/1.eml",
+	} {
+		path := filepath.Join(unpack, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("Subject: test\n\nbody\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audits, err := AuditExtraction("../../testdata/pstIn/TEST.pst", unpack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FolderAudit{
+		{Folder: "Inbox", Items: 1},
+		{Folder: "Recovered", Extracted: 1},
+	}
+	if !reflect.DeepEqual(audits, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, audits)
+	}
+
+	auditPath := filepath.Join(t.TempDir(), "extractionAudit.tsv")
+	for i := 0; i < 2; i++ {
+		if err := WriteAudit(auditPath, "ct/alice/TEST.pst", audits[:1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTSV := "PST\tFolder\tItems\tNot Mail\tExtracted\tMissing\n" +
+		"ct/alice/TEST.pst\tInbox\t1\t0\t0\t1\n" +
+		"ct/alice/TEST.pst\tInbox\t1\t0\t0\t1\n"
+	if string(got) != expectedTSV {
+		t.Errorf("Expected\n%s\n but got\n%s", expectedTSV, got)
+	}
+}
+
+func TestReadpstMail(t *testing.T) {
+	for class, expected := range map[string]bool{
+		"IPM.Note":                     true,
+		"IPM.Note.SMIME":               true,
+		"IPM.Schedule.Meeting.Request": true,
+		"REPORT.IPM.Note.NDR":          true,
+		"IPM.Contact":                  false,
+		"IPM.Appointment":              false,
+		"IPM.StickyNote":               false,
+	} {
+		if got := readpstMail(class); got != expected {
+			t.Errorf("%s: expected %t, but got %t", class, expected, got)
+		}
+	}
+}
@@ -3,26 +3,28 @@ package decipher
 
 import (
 	"errors"
+	"fmt"
 
 	// "go.mozilla.org/pkcs7"
 	"github.com/smallstep/pkcs7"
 )
 
-func decipher(attachBytes []byte, certKeyPairs []certKeyPair) ([]byte, error) {
+// also returns the serial of the cert that opened the envelope, which is empty for opaque-signed content
+func decipher(attachBytes []byte, certKeyPairs []certKeyPair) ([]byte, string, error) {
 	p7m, err := pkcs7.Parse(attachBytes)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	var pt []byte
 	for _, certKeyPair := range certKeyPairs {
 		pt, err = p7m.Decrypt(certKeyPair.cert, certKeyPair.privKey)
 		// opague-signed case
 		if errors.Is(err, pkcs7.ErrNotEncryptedContent) {
-			return p7m.Content, nil
+			return p7m.Content, "", nil
 		}
 		if err == nil {
-			return pt, nil
+			return pt, fmt.Sprintf("%x", certKeyPair.cert.SerialNumber), nil
 		}
 	}
-	return nil, err
+	return nil, "", err
 }
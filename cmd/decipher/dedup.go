@@ -0,0 +1,172 @@
+package decipher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Dedup finds the same message deciphered more than once, ex. a thread in both the sender's and the recipient's mailbox.
+// Messages are the same when they have the same Message-ID and the same content: the headers and normalized body
+// of each part, whatever boundaries and header order the copy was unpacked with.
+// Messages without a Message-ID are never counted as duplicates.
+// Share one Dedup across every Decipher call of a run so duplicates are found across custodians.
+type Dedup struct {
+	// Suppress skips writing every copy after the first. success.tsv logs the copy with Status duplicate
+	// and the first copy in Duplicate Of.
+	Suppress bool
+	seen     map[dedupKey][]*occurrence
+	keys     []dedupKey
+}
+
+type dedupKey struct {
+	messageID, bodyHash string
+}
+
+// occurrence is where a copy of a message was found and written
+type occurrence struct {
+	custodian, source, output string
+}
+
+func NewDedup(suppress bool) *Dedup {
+	return &Dedup{Suppress: suppress, seen: map[dedupKey][]*occurrence{}}
+}
+
+// add records a copy of the deciphered message pt and returns it, along with the first copy when pt was seen before.
+// The caller fills in the output of the copy once it is written.
+func (d *Dedup) add(pt []byte, custodian, source string) (*occurrence, *occurrence) {
+	o := &occurrence{custodian: custodian, source: source}
+	key, ok := dedupKeyOf(pt)
+	if !ok {
+		return o, nil
+	}
+	copies := d.seen[key]
+	if len(copies) == 0 {
+		d.keys = append(d.keys, key)
+	}
+	d.seen[key] = append(copies, o)
+	if len(copies) == 0 {
+		return o, nil
+	}
+	return o, copies[0]
+}
+
+func dedupKeyOf(pt []byte) (dedupKey, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(pt))
+	if err != nil {
+		return dedupKey{}, false
+	}
+	messageID := strings.TrimSpace(msg.Header.Get("Message-ID"))
+	if messageID == "" {
+		return dedupKey{}, false
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return dedupKey{}, false
+	}
+	h := sha256.New()
+	// only the content headers of the message itself, the rest differ between mailboxes
+	writeContent(h, textproto.MIMEHeader{"Content-Type": msg.Header["Content-Type"]}, body)
+	return dedupKey{messageID: messageID, bodyHash: fmt.Sprintf("%x", h.Sum(nil))}, true
+}
+
+// writeContent writes a part in a canonical form: its headers in order, its media type without the boundary, and
+// each nested part or its normalized body. Boundaries are left out, readpst makes up new ones every time it unpacks.
+func writeContent(w io.Writer, header textproto.MIMEHeader, body []byte) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	boundary := params["boundary"]
+	for _, key := range sortedKeys(header) {
+		if key == "Content-Type" && err == nil {
+			delete(params, "boundary")
+			fmt.Fprintf(w, "%s: %s\n", key, mime.FormatMediaType(mediaType, params))
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s\n", key, strings.Join(header[key], " "))
+	}
+	w.Write([]byte("\n"))
+	switch {
+	case err == nil && strings.HasPrefix(mediaType, "multipart/") && boundary != "":
+		mr := multipart.NewReader(bytes.NewReader(body), boundary)
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				// a broken multipart ends where it stops parsing, the same way for every copy
+				return
+			}
+			partBody, err := io.ReadAll(p)
+			if err != nil {
+				return
+			}
+			w.Write([]byte("--\n"))
+			writeContent(w, p.Header, partBody)
+		}
+	case err == nil && mediaType == "message/rfc822":
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		msgBody, err := io.ReadAll(msg.Body)
+		if err != nil {
+			break
+		}
+		writeContent(w, textproto.MIMEHeader(msg.Header), msgBody)
+		return
+	}
+	w.Write(normalizeBody(body))
+}
+
+// normalizeBody drops the differences a copy picks up in transit and storage: CRLF or LF line endings,
+// trailing whitespace on each line and blank lines at the end
+func normalizeBody(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return []byte(strings.TrimRight(strings.Join(lines, "\n"), "\n"))
+}
+
+// WriteTSV writes duplicates.tsv, a row for every copy of each message found more than once.
+// All Custodians lists every custodian the message was found for, so the first copy can be produced once for all of them.
+func (d *Dedup) WriteTSV(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	f.WriteString("Message-Id\tBody-SHA256\tCustodian\tTarget\tOutput\tDuplicate\tAll Custodians\n")
+	for _, key := range d.keys {
+		copies := d.seen[key]
+		if len(copies) < 2 {
+			continue
+		}
+		custodians := []string{}
+		found := map[string]bool{}
+		for _, o := range copies {
+			if !found[o.custodian] {
+				found[o.custodian] = true
+				custodians = append(custodians, o.custodian)
+			}
+		}
+		sort.Strings(custodians)
+		for i, o := range copies {
+			f.WriteString(fmt.Sprintf(
+				"%s\t%s\t%s\t%s\t%s\t%t\t%s\n",
+				key.messageID,
+				key.bodyHash,
+				o.custodian,
+				o.source,
+				o.output,
+				i > 0,
+				strings.Join(custodians, "; "),
+			))
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,120 @@
+package decipher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecipherDedup(t *testing.T) {
+	pair := loadTestKeyPair(t)
+	msg, _ := encryptedMsg(t, pair, "Content-Type: text/plain\n\nhello world\n")
+	inDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inDir, "1.eml"), msg, 0666); err != nil {
+		t.Fatal(err)
+	}
+	pt := t.TempDir()
+	dedup := NewDedup(true)
+	for _, custodian := range []string{"alice", "bob"} {
+		if err := os.MkdirAll(filepath.Join(pt, custodian, "logs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		Decipher(inDir, testCertDir, testKeyDir, testPW, filepath.Join(pt, custodian), Options{Dedup: dedup})
+	}
+
+	if _, err := os.Stat(filepath.Join(pt, "alice", "1.eml")); err != nil {
+		t.Errorf("Expected the first copy to be written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(pt, "bob", "1.eml")); err == nil {
+		t.Error("Expected the duplicate to be suppressed")
+	}
+	success, err := os.ReadFile(filepath.Join(pt, "bob", "logs", "success.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(success), "\tduplicate\t\t\talice/1.eml\n") {
+		t.Errorf("Expected the duplicate logged with its first copy, but got\n%s", success)
+	}
+
+	if err := dedup.WriteTSV(filepath.Join(pt, "duplicates.tsv")); err != nil {
+		t.Fatal(err)
+	}
+	duplicates, err := os.ReadFile(filepath.Join(pt, "duplicates.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSuffix(string(duplicates), "\n"), "\n")
+	if len(rows) != 3 {
+		t.Fatalf("Expected a row per copy, but got\n%s", duplicates)
+	}
+	source := filepath.Join(inDir, "1.eml")
+	for i, expected := range []string{
+		"\talice\t" + source + "\t1.eml\tfalse\talice; bob",
+		"\tbob\t" + source + "\t\ttrue\talice; bob",
+	} {
+		if !strings.HasPrefix(rows[i+1], "<1@local>\t") || !strings.HasSuffix(rows[i+1], expected) {
+			t.Errorf("Expected row %d to end with %q, but got %q", i+1, expected, rows[i+1])
+		}
+	}
+}
+
+// nestedPlaintext is a multipart message with several headers per part and a message attached to it
+func nestedPlaintext(boundary, innerBoundary string) string {
+	return "Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\n\n" +
+		"--" + boundary + "\n" +
+		"Content-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: 7bit\nContent-Language: en-US\n\nhello world\n" +
+		"--" + boundary + "\n" +
+		"Content-Type: message/rfc822\nContent-Disposition: attachment; filename=\"fw.eml\"\nContent-Description: fw\n\n" +
+		"Subject: fw\nMessage-ID: <2@local>\nContent-Type: multipart/alternative; boundary=\"" + innerBoundary + "\"\n\n" +
+		"--" + innerBoundary + "\nContent-Type: text/plain\nContent-Transfer-Encoding: 7bit\n\nforwarded\n" +
+		"--" + innerBoundary + "\nContent-Type: text/html\nContent-Transfer-Encoding: 7bit\n\n<p>forwarded</p>\n" +
+		"--" + innerBoundary + "--\n" +
+		"--" + boundary + "--\n"
+}
+
+func TestDecipherDedupNested(t *testing.T) {
+	pair := loadTestKeyPair(t)
+	pt := t.TempDir()
+	dedup := NewDedup(true)
+	// each copy was unpacked separately, with its own boundaries
+	for i, custodian := range []string{"alice", "bob", "carol"} {
+		msg, _ := encryptedMsg(t, pair, nestedPlaintext(fmt.Sprintf("outer-%d", i), fmt.Sprintf("inner-%d", i)))
+		inDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(inDir, "1.eml"), msg, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(pt, custodian, "logs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		Decipher(inDir, testCertDir, testKeyDir, testPW, filepath.Join(pt, custodian), Options{Dedup: dedup})
+	}
+	for _, custodian := range []string{"bob", "carol"} {
+		success, err := os.ReadFile(filepath.Join(pt, custodian, "logs", "success.tsv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(success), "\tduplicate\t\t\talice/1.eml\n") {
+			t.Errorf("Expected %s's copy to be a duplicate of alice's, but got\n%s", custodian, success)
+		}
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	a, ok := dedupKeyOf([]byte("Message-ID: <1@local>\r\nSubject: a\r\n\r\nhello \r\nworld\r\n\r\n"))
+	if !ok {
+		t.Fatal("Expected a key")
+	}
+	b, _ := dedupKeyOf([]byte("Subject: b\nMessage-ID: <1@local>\n\nhello\nworld\n"))
+	if a != b {
+		t.Errorf("Expected line endings and trailing whitespace to be ignored, but got %v and %v", a, b)
+	}
+	c, _ := dedupKeyOf([]byte("Message-ID: <1@local>\n\nhello world\n"))
+	if a == c {
+		t.Error("Expected a different body to give a different key")
+	}
+	if _, ok := dedupKeyOf([]byte("Subject: a\n\nhello\n")); ok {
+		t.Error("Expected no key without a Message-ID")
+	}
+}
@@ -1,22 +1,31 @@
-// Takes a dir of eml files, a dir of x509 certs, a dir of PKCS8 keys paired to the certs, and a password for the keys,
-// and outputs dirs of *.eml files and an exceptions report.
+// Takes a dir of eml, msg or mbox files, a dir of x509 certs, a dir of PKCS8 keys paired to the certs, and a password for the keys,
+// and outputs dirs of *.eml files, or 1 mbox per custodian, and an exceptions report.
 // Output dir is a flat folder. Log will show original path from input.
+// Messages split out of an mbox are logged as path#offset, the byte offset of their From line.
+// Outlook .msg files are rebuilt as RFC 822 before deciphering.
 // PT emails will be dropped but logged.
 package decipher
 
 import (
+	"bufio"
 	"bytes"
 	"crypto"
+	"crypto/sha256"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/mail"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/McFlip/enigma/cmd/filter"
+	"github.com/McFlip/enigma/cmd/mbox"
+	"github.com/McFlip/enigma/cmd/outlook"
 	"github.com/youmark/pkcs8"
 )
 
@@ -25,6 +34,40 @@ type certKeyPair struct {
 	privKey crypto.PrivateKey
 }
 
+// Options toggles the optional outputs of Decipher.
+type Options struct {
+	// Sidecar keeps the original ciphertext next to each output .eml.
+	// "p7m" writes the outermost smime.p7m as DER, "source" writes the whole source message.
+	// Empty disables the sidecar.
+	Sidecar string
+	// Provenance prepends X-Enigma-* headers recording where each output came from.
+	Provenance bool
+	// Metadata writes a JSON sidecar per output with headers, decryption path, attachments and hashes.
+	Metadata bool
+	// Archive is the PST the input dir was unpacked from.
+	// When set, messages are reported by their path inside the archive instead of the unpack dir.
+	Archive string
+	// MboxVariant selects how "From " lines in mbox input are unescaped. Defaults to mboxrd.
+	MboxVariant mbox.Variant
+	// Output is "eml" for numbered .eml files or "mbox" to append every message to <custodian>.mbox.
+	// Empty means eml.
+	Output string
+	// Filter leaves messages out of scope undeciphered and unlogged, only counted. nil keeps every message.
+	Filter *filter.Filter
+	// Dedup tracks messages deciphered more than once across custodians. nil disables it.
+	Dedup *Dedup
+}
+
+const (
+	SidecarP7m    = "p7m"
+	SidecarSource = "source"
+	OutputEml     = "eml"
+	OutputMbox    = "mbox"
+)
+
+// errDuplicate is the Status of a suppressed duplicate in success.tsv. Duplicate Of names the copy that was written.
+var errDuplicate = errors.New("duplicate")
+
 type msgException struct {
 	target, from, to, cc, bcc, subj, date, messageId, attachments, err string
 }
@@ -34,7 +77,7 @@ func logMsgException(
 	msgBytes []byte,
 	msgError error,
 	errLog *os.File,
-	outFileName string,
+	outFileNames ...string,
 ) error {
 	msg, err := mail.ReadMessage(bytes.NewReader(msgBytes))
 	if err != nil {
@@ -83,8 +126,8 @@ func logMsgException(
 		msgErr.attachments,
 		msgErr.err,
 	)
-	// for success we add an extra column for the outFileName
-	if msgError == nil {
+	// success.tsv rows add extra columns for the output files
+	for _, outFileName := range outFileNames {
 		msgErrStr = fmt.Sprintf("%s\t%s", msgErrStr, outFileName)
 	}
 	msgErrStr += "\n"
@@ -96,7 +139,108 @@ func logMsgException(
 	return nil
 }
 
-func Decipher(inPstDir, inCertDir, inKeyDir, inPW, outDir string) {
+// sourceName reports where file came from, ex. ct/alice/mail.pst/Inbox/12.eml for a file unpacked from an archive
+func sourceName(file, inDir, archive string) string {
+	if archive == "" {
+		return file
+	}
+	rel, err := filepath.Rel(inDir, file)
+	if err != nil {
+		return file
+	}
+	return filepath.Join(archive, rel)
+}
+
+// folderOf is the folder of an .eml under inDir, ex. Inbox/Project for a PST unpacked by readpst
+func folderOf(file, inDir string) string {
+	rel, err := filepath.Rel(inDir, filepath.Dir(file))
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// messageScope fills in what the filters look at in a message's header, if it can be read
+func messageScope(m filter.Message, msgFile []byte) (filter.Message, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(msgFile))
+	if err != nil {
+		return m, false
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		m.Date = date
+	}
+	m.Sender = []string{msg.Header.Get("From")}
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		m.Recipients = append(m.Recipients, msg.Header.Get(key))
+	}
+	return m, true
+}
+
+// provenanceHeaders builds the X-Enigma-* block that is prepended to deciphered output.
+// The block sits above the original headers so it reads like a trace header and is never mixed in with them.
+// Opaque-signed layers are unwrapped without a key, so they are counted apart from the layers deciphered.
+func provenanceHeaders(source string, msgFile []byte, layers []cipherLayer) []byte {
+	serials := []string{}
+	signed := 0
+	for _, layer := range layers {
+		if layer.keySerial == "" {
+			signed++
+			continue
+		}
+		serials = append(serials, layer.keySerial)
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("X-Enigma-Source: %s\n", source))
+	b.WriteString(fmt.Sprintf("X-Enigma-Source-SHA256: %x\n", sha256.Sum256(msgFile)))
+	b.WriteString(fmt.Sprintf("X-Enigma-Key-Serial: %s\n", strings.Join(serials, ", ")))
+	b.WriteString(fmt.Sprintf("X-Enigma-Decrypted-At: %s\n", time.Now().UTC().Format(time.RFC3339)))
+	b.WriteString(fmt.Sprintf("X-Enigma-Layers: %d\n", len(serials)))
+	b.WriteString(fmt.Sprintf("X-Enigma-Signed-Layers: %d\n", signed))
+	return []byte(b.String())
+}
+
+// checkHeader makes sure the log at path starts with header, so new rows line up with the rows already in it
+func checkHeader(path, header string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	existing, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if existing != header {
+		return fmt.Errorf("%s has the columns %q, not %q, so rows can't be added to it. "+
+			"It was written by another version or output mode, move the logs dir aside and rerun",
+			path, strings.TrimSpace(existing), strings.TrimSpace(header))
+	}
+	return nil
+}
+
+// writeSidecar saves the original ciphertext for output number outNum and returns its file name.
+func writeSidecar(
+	sidecar, outDir string,
+	outNum int,
+	msgFile []byte,
+	layers []cipherLayer,
+) (string, error) {
+	var ctFileName string
+	var ct []byte
+	switch sidecar {
+	case SidecarP7m:
+		ctFileName = fmt.Sprintf("%d.p7m", outNum)
+		ct = layers[0].der
+	case SidecarSource:
+		ctFileName = fmt.Sprintf("%d.source.eml", outNum)
+		ct = msgFile
+	default:
+		return "", nil
+	}
+	return ctFileName, os.WriteFile(filepath.Join(outDir, ctFileName), ct, 0666)
+}
+
+func Decipher(inPstDir, inCertDir, inKeyDir, inPW, outDir string, opts Options) {
 	// logs, if they already exist skip header and we append write
 	// TODO: refactor log creation to a factory func
 	var corruptLog, decipherExceptLog, successLog, ptExceptLog *os.File
@@ -150,17 +294,24 @@ func Decipher(inPstDir, inCertDir, inKeyDir, inPW, outDir string) {
 
 	// logs successfuly deciphered plaintext
 	successPath := filepath.Join(outDir, "logs", "success.tsv")
+	successHeader := "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tStatus\tOutput\tCiphertext\tDuplicate Of\n"
+	// mbox output is located by message index and byte offset instead of a file name
+	if opts.Output == OutputMbox {
+		successHeader = "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tStatus\tIndex\tOffset\tCiphertext\tDuplicate Of\n"
+	}
 	if _, err := os.Stat(successPath); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			successLog, err = os.OpenFile(successPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 			if err != nil {
 				log.Fatalf("Can't open log file %s to write results", successPath)
 			}
-			successLog.WriteString(
-				"Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tStatus\tOutput\n",
-			)
+			successLog.WriteString(successHeader)
 		}
 	} else {
+		// appending rows with other columns would leave the log unreadable
+		if err := checkHeader(successPath, successHeader); err != nil {
+			log.Fatal(err)
+		}
 		successLog, err = os.OpenFile(successPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
 			log.Fatalf("Can't open log file %s to write results", successPath)
@@ -195,7 +346,7 @@ func Decipher(inPstDir, inCertDir, inKeyDir, inPW, outDir string) {
 		}
 		if !info.IsDir() {
 			fileExt := filepath.Ext(info.Name())
-			if fileExt == ".eml" {
+			if fileExt == ".eml" || strings.EqualFold(fileExt, ".msg") || mbox.IsMbox(path) {
 				pstFiles = append(pstFiles, path)
 			}
 		}
@@ -243,57 +394,210 @@ func Decipher(inPstDir, inCertDir, inKeyDir, inPW, outDir string) {
 		log.Fatal(err)
 	}
 
-	fileNum := 1
-	for _, file := range pstFiles {
-		msgFile, err := os.ReadFile(file)
+	var mboxOut *mbox.Writer
+	mboxName := filepath.Base(outDir) + ".mbox"
+	mboxCount := 0
+	if opts.Output == OutputMbox {
+		mboxFile, offset, count, err := openMboxOutput(filepath.Join(outDir, mboxName))
 		if err != nil {
-			corruptException := fmt.Sprintf("%s\t%s\n", file, err)
-			corruptLog.WriteString(corruptException)
-			continue
+			log.Fatalf("Can't open %s to write results: %v", mboxName, err)
+		}
+		defer mboxFile.Close()
+		mboxOut = mbox.NewWriter(mboxFile, offset)
+		mboxCount = count
+	}
+
+	fileNum := 1
+	decipherMsg := func(source string, scope filter.Message, msgFile []byte) {
+		// a message that doesn't parse is kept, to be logged as corrupt
+		if scope, ok := messageScope(scope, msgFile); ok && !opts.Filter.Keep(scope) {
+			return
 		}
 		foundCT := false
-		pt, err := walkMultipart(msgFile, certKeyPairs, &foundCT)
+		layers := []cipherLayer{}
+		pt, err := walkMultipart(msgFile, certKeyPairs, &foundCT, &layers)
 		if err != nil {
-			loggingErr := logMsgException(file, msgFile, err, decipherExceptLog, "")
+			loggingErr := logMsgException(source, msgFile, err, decipherExceptLog)
 			if loggingErr != nil {
 				// fmt.Printf("Error logging error for msg %s : %s\n", file, loggingErr)
-				corruptException := fmt.Sprintf("%s\t%s\n", file, loggingErr)
+				corruptException := fmt.Sprintf("%s\t%s\n", source, loggingErr)
 				corruptLog.WriteString(corruptException)
 			}
-			continue
+			return
 		}
 		if foundCT {
-			// output files are auto numbered .eml files
-			fullPath := filepath.Join(outDir, fmt.Sprint(fileNum)+".eml")
-			for _, err := os.Stat(fullPath); err == nil; _, err = os.Stat(fullPath) {
+			var found *occurrence
+			if opts.Dedup != nil {
+				var first *occurrence
+				found, first = opts.Dedup.add(pt, filepath.Base(outDir), source)
+				if first != nil && opts.Dedup.Suppress {
+					// nothing is written for a suppressed copy, so its output columns are left empty
+					cols := []string{"", ""}
+					if mboxOut != nil {
+						cols = append(cols, "")
+					}
+					cols = append(cols, filepath.Join(first.custodian, first.output))
+					loggingErr := logMsgException(source, msgFile, errDuplicate, successLog, cols...)
+					if loggingErr != nil {
+						corruptException := fmt.Sprintf("%s\t%s\n", source, loggingErr)
+						corruptLog.WriteString(corruptException)
+					}
+					return
+				}
+			}
+			if opts.Provenance {
+				pt = append(provenanceHeaders(source, msgFile, layers), pt...)
+			}
+			var outNum int
+			var output string
+			var outCols []string
+			if mboxOut != nil {
+				offset, err := mboxOut.Write(pt)
+				if err != nil {
+					fmt.Printf("Error writing out deciphered message %s : %s\n", source, err)
+				}
+				mboxCount++
+				outNum = mboxCount
+				output = fmt.Sprintf("%s#%d", mboxName, offset)
+				outCols = []string{fmt.Sprint(outNum), fmt.Sprint(offset)}
+			} else {
+				// output files are auto numbered .eml files
+				fullPath := filepath.Join(outDir, fmt.Sprint(fileNum)+".eml")
+				for _, err := os.Stat(fullPath); err == nil; _, err = os.Stat(fullPath) {
+					fileNum++
+					fullPath = filepath.Join(outDir, fmt.Sprint(fileNum)+".eml")
+				}
+				outNum = fileNum
 				fileNum++
-				fullPath = filepath.Join(outDir, fmt.Sprint(fileNum)+".eml")
+				err = os.WriteFile(fullPath, pt, 0666)
+				if err != nil {
+					fmt.Printf("Error writing out deciphered file %s : %s\n", source, err)
+				}
+				output = fmt.Sprintf("%d.eml", outNum)
+				outCols = []string{output}
+			}
+			if found != nil {
+				found.output = output
 			}
-			fileNum++
-			err = os.WriteFile(fullPath, pt, 0666)
+			// the sidecar shares the output number so the pair sorts together
+			ctFileName, err := writeSidecar(opts.Sidecar, outDir, outNum, msgFile, layers)
 			if err != nil {
-				fmt.Printf("Error writing out deciphered file %s : %s\n", file, err)
+				fmt.Printf("Error writing out ciphertext sidecar %s : %s\n", source, err)
+			}
+			if opts.Metadata {
+				err := writeMetadata(
+					outDir,
+					outNum,
+					source,
+					output,
+					ctFileName,
+					msgFile,
+					pt,
+					layers,
+				)
+				if err != nil {
+					fmt.Printf("Error writing out metadata sidecar %s : %s\n", source, err)
+				}
 			}
 			loggingErr := logMsgException(
-				file,
+				source,
 				msgFile,
 				nil,
 				successLog,
-				fmt.Sprintf("%d.eml", fileNum-1),
+				append(outCols, ctFileName, "")...,
 			)
 			if loggingErr != nil {
 				// fmt.Printf("Error logging success for %s : %s\n", file, loggingErr)
-				corruptException := fmt.Sprintf("%s\t%s\n", file, loggingErr)
+				corruptException := fmt.Sprintf("%s\t%s\n", source, loggingErr)
 				corruptLog.WriteString(corruptException)
 			}
 		} else {
 			// either the input file was plaintext or corrupt and missing smime.p7m attachment
-			loggingErr := logMsgException(file, msgFile, errors.New("plaintext input"), ptExceptLog, "")
+			loggingErr := logMsgException(source, msgFile, errors.New("plaintext input"), ptExceptLog)
 			if loggingErr != nil {
 				// fmt.Printf("Error logging plaintext msg %s : %s\n", file, loggingErr)
-				corruptException := fmt.Sprintf("%s\t%s\n", file, loggingErr)
+				corruptException := fmt.Sprintf("%s\t%s\n", source, loggingErr)
+				corruptLog.WriteString(corruptException)
+			}
+		}
+	}
+
+	// folders of a PST are the path below the top of the mailbox, the same path getheaders reports
+	folderRoot := inPstDir
+	if opts.Archive != "" {
+		folderRoot = storeDir(inPstDir, nil)
+	}
+	for _, file := range pstFiles {
+		source := sourceName(file, inPstDir, opts.Archive)
+		if filepath.Ext(file) != ".eml" && mbox.IsMbox(file) {
+			if err := decipherMbox(file, source, opts.MboxVariant, decipherMsg); err != nil {
+				corruptException := fmt.Sprintf("%s\t%s\n", source, err)
+				corruptLog.WriteString(corruptException)
+			}
+			continue
+		}
+		if strings.EqualFold(filepath.Ext(file), ".msg") {
+			m, err := outlook.Open(file)
+			if err != nil {
+				corruptException := fmt.Sprintf("%s\t%s\n", source, err)
 				corruptLog.WriteString(corruptException)
+				continue
 			}
+			decipherMsg(source, filter.Message{NoFolders: true}, m.RFC822())
+			continue
+		}
+		msgFile, err := os.ReadFile(file)
+		if err != nil {
+			corruptException := fmt.Sprintf("%s\t%s\n", source, err)
+			corruptLog.WriteString(corruptException)
+			continue
+		}
+		decipherMsg(source, filter.Message{Folder: folderOf(file, folderRoot)}, msgFile)
+	}
+}
+
+// decipherMbox feeds each message of an mbox to decipherMsg, named source#offset
+func decipherMbox(file, source string, variant mbox.Variant, decipherMsg func(string, filter.Message, []byte)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mr := mbox.NewReader(f, variant)
+	for {
+		msg, err := mr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
 		}
+		decipherMsg(fmt.Sprintf("%s#%d", source, msg.Offset), filter.Message{NoFolders: true}, msg.Data)
+	}
+}
+
+// openMboxOutput opens an mbox for append and reports its size and how many messages it already holds
+// so numbering carries on across the PSTs of a custodian
+func openMboxOutput(path string) (*os.File, int64, int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	count := 0
+	mr := mbox.NewReader(f, mbox.MboxRD)
+	for {
+		_, err := mr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, 0, 0, err
+		}
+		count++
+	}
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, err
 	}
+	return f, offset, count, nil
 }
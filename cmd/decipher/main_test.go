@@ -0,0 +1,428 @@
+package decipher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/McFlip/enigma/cmd/filter"
+	"github.com/McFlip/enigma/cmd/mbox"
+	"github.com/smallstep/pkcs7"
+	"github.com/youmark/pkcs8"
+)
+
+const (
+	testCertDir = "../../testdata/certIn"
+	testKeyDir  = "../../testdata/keyIn"
+	testSerial  = "12c3905b55296e401270c0ceb18b5ba660db9a1f"
+	testPW      = "MrGlitter"
+)
+
+// loadTestKeyPair returns the cert/key pair from testdata
+func loadTestKeyPair(t *testing.T) certKeyPair {
+	t.Helper()
+	certBytes, err := os.ReadFile(filepath.Join(testCertDir, testSerial+".cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := os.ReadFile(filepath.Join(testKeyDir, testSerial+".key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	myCert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	myKey, err := pkcs8.ParsePKCS8PrivateKey(keyBytes, []byte(testPW))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certKeyPair{myCert, myKey}
+}
+
+// encryptedMsg wraps inner in an enveloped-data smime.p7m attachment the way readpst unpacks it.
+// It returns the message and the DER of the attachment.
+func encryptedMsg(t *testing.T, pair certKeyPair, inner string) ([]byte, []byte) {
+	t.Helper()
+	der, err := pkcs7.Encrypt([]byte(inner), []*x509.Certificate{pair.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	b.WriteString("From: sender@local\n")
+	b.WriteString("To: rcpt@local\n")
+	b.WriteString("Subject: secret\n")
+	b.WriteString("Date: Fri, 17 Apr 2020 16:00:00 +0000\n")
+	b.WriteString("Message-ID: <1@local>\n")
+	b.WriteString("X-MS-Has-Attach: yes\n")
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"b1\"\n\n")
+	b.WriteString("--b1\n")
+	b.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\n")
+	b.WriteString("Content-Transfer-Encoding: base64\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\n\n")
+	encoded := base64.StdEncoding.EncodeToString(der)
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\n")
+	b.WriteString("--b1--\n")
+	return b.Bytes(), der
+}
+
+// mkCase lays out an input dir holding msg and an output dir with its logs folder
+func mkCase(t *testing.T, msg []byte) (string, string) {
+	t.Helper()
+	inDir := t.TempDir()
+	outDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inDir, "1.eml"), msg, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(outDir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return inDir, outDir
+}
+
+func TestDecipherSidecar(t *testing.T) {
+	pair := loadTestKeyPair(t)
+	msg, der := encryptedMsg(t, pair, "Content-Type: text/plain\n\nhello world\n")
+	tests := []struct {
+		sidecar, name string
+		expected      []byte
+	}{
+		{"", "", nil},
+		{SidecarP7m, "1.p7m", der},
+		{SidecarSource, "1.source.eml", msg},
+	}
+	for _, tc := range tests {
+		inDir, outDir := mkCase(t, msg)
+		Decipher(inDir, testCertDir, testKeyDir, testPW, outDir, Options{Sidecar: tc.sidecar})
+
+		pt, err := os.ReadFile(filepath.Join(outDir, "1.eml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(pt), "hello world") {
+			t.Errorf("Expected deciphered body, but got\n%s", pt)
+		}
+		success, err := os.ReadFile(filepath.Join(outDir, "logs", "success.tsv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := strings.Split(strings.TrimRight(string(success), "\n"), "\n")
+		if len(rows) != 2 {
+			t.Fatalf("Expected 1 success row, but got\n%s", success)
+		}
+		expectedTail := fmt.Sprintf("\t1.eml\t%s\t", tc.name)
+		if !strings.HasSuffix(rows[1], expectedTail) {
+			t.Errorf("Expected row ending in %q, but got %q", expectedTail, rows[1])
+		}
+		if tc.name == "" {
+			continue
+		}
+		actual, err := os.ReadFile(filepath.Join(outDir, tc.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, tc.expected) {
+			t.Errorf("Sidecar %s does not match the original ciphertext", tc.name)
+		}
+	}
+}
+
+func TestProvenanceHeadersSignedLayer(t *testing.T) {
+	layers := []cipherLayer{{keySerial: testSerial}, {keySerial: ""}}
+	headers := string(provenanceHeaders("1.eml", []byte("msg"), layers))
+	for _, expected := range []string{
+		"X-Enigma-Key-Serial: " + testSerial + "\n",
+		"X-Enigma-Layers: 1\n",
+		"X-Enigma-Signed-Layers: 1\n",
+	} {
+		if !strings.Contains(headers, expected) {
+			t.Errorf("Expected %q in\n%s", expected, headers)
+		}
+	}
+}
+
+func TestDecipherProvenance(t *testing.T) {
+	pair := loadTestKeyPair(t)
+	msg, _ := encryptedMsg(t, pair, "Content-Type: text/plain\n\nhello world\n")
+	inDir, outDir := mkCase(t, msg)
+	Decipher(
+		inDir,
+		testCertDir,
+		testKeyDir,
+		testPW,
+		outDir,
+		Options{Provenance: true, Archive: "ct/alice/mail.pst"},
+	)
+
+	pt, err := os.ReadFile(filepath.Join(outDir, "1.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"X-Enigma-Source: ct/alice/mail.pst/1.eml\n",
+		fmt.Sprintf("X-Enigma-Source-SHA256: %x\n", sha256.Sum256(msg)),
+		"X-Enigma-Key-Serial: " + testSerial + "\n",
+		"X-Enigma-Decrypted-At: ",
+		"X-Enigma-Layers: 1\n",
+		"X-Enigma-Signed-Layers: 0\n",
+	}
+	lines := strings.SplitAfter(string(pt), "\n")
+	for i, prefix := range expected {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("Expected line %d to start with %q, but got %q", i, prefix, lines[i])
+		}
+	}
+	msgHeader, err := mail.ReadMessage(bytes.NewReader(pt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgHeader.Header.Get("Subject") != "secret" {
+		t.Errorf("Expected original headers to survive, but got\n%s", pt)
+	}
+}
+
+func TestDecipherMetadata(t *testing.T) {
+	pair := loadTestKeyPair(t)
+	inner := "Content-Type: multipart/mixed; boundary=\"b2\"\n\n" +
+		"--b2\nContent-Type: text/plain\n\nsee attached\n" +
+		"--b2\nContent-Type: text/plain; name=\"note.txt\"\n" +
+		"Content-Disposition: attachment; filename=\"note.txt\"\n" +
+		"Content-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte("attached note")) + "\n" +
+		"--b2--\n"
+	msg, der := encryptedMsg(t, pair, inner)
+	inDir, outDir := mkCase(t, msg)
+	Decipher(inDir, testCertDir, testKeyDir, testPW, outDir, Options{Metadata: true})
+
+	mdBytes, err := os.ReadFile(filepath.Join(outDir, "1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md Metadata
+	if err := json.Unmarshal(mdBytes, &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Custodian != filepath.Base(outDir) || md.Output != "1.eml" {
+		t.Errorf("Expected custodian and output to be recorded, but got %+v", md)
+	}
+	if md.Headers["Message-Id"][0] != "<1@local>" {
+		t.Errorf("Expected parsed headers, but got %v", md.Headers)
+	}
+	if len(md.Decryption) != 1 {
+		t.Fatalf("Expected 1 decryption layer, but got %+v", md.Decryption)
+	}
+	layer := md.Decryption[0]
+	if layer.ContentType != "enveloped-data" || layer.KeySerial != testSerial ||
+		layer.ContentEncryption != "des-cbc" || layer.KeyEncryption != "rsaEncryption" {
+		t.Errorf("Unexpected decryption layer %+v", layer)
+	}
+	if layer.CiphertextSHA256 != fmt.Sprintf("%x", sha256.Sum256(der)) {
+		t.Errorf("Expected hash of the envelope, but got %s", layer.CiphertextSHA256)
+	}
+	if len(md.Attachments) != 1 || md.Attachments[0].Filename != "note.txt" ||
+		md.Attachments[0].SizeBytes != len("attached note") {
+		t.Errorf("Unexpected attachments %+v", md.Attachments)
+	}
+	if md.Hashes.SourceSHA256 != fmt.Sprintf("%x", sha256.Sum256(msg)) {
+		t.Errorf("Expected hash of the source message, but got %s", md.Hashes.SourceSHA256)
+	}
+}
+
+func TestDecipherMbox(t *testing.T) {
+	pair := loadTestKeyPair(t)
+	msg, _ := encryptedMsg(t, pair, "Content-Type: text/plain\n\nhello world\n")
+	first := "From sender@local Fri Apr 17 16:00:00 2020\n"
+	second := "From sender@local Fri Apr 17 17:00:00 2020\n"
+	mboxBytes := first + string(msg) + "\n" + second + "Subject: plain\n\n>From here\n"
+	inDir := t.TempDir()
+	outDir := t.TempDir()
+	mboxPath := filepath.Join(inDir, "mail.mbox")
+	if err := os.WriteFile(mboxPath, []byte(mboxBytes), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(outDir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	Decipher(inDir, testCertDir, testKeyDir, testPW, outDir, Options{})
+
+	pt, err := os.ReadFile(filepath.Join(outDir, "1.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(pt), "hello world") {
+		t.Errorf("Expected deciphered body, but got\n%s", pt)
+	}
+	success, err := os.ReadFile(filepath.Join(outDir, "logs", "success.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(success), "\n"+mboxPath+"#0\t") {
+		t.Errorf("Expected success row for %s#0, but got\n%s", mboxPath, success)
+	}
+	ptExcept, err := os.ReadFile(filepath.Join(outDir, "logs", "ptExceptions.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("\n%s#%d\t", mboxPath, strings.Index(mboxBytes, second))
+	if !strings.Contains(string(ptExcept), expected) {
+		t.Errorf("Expected plaintext row starting %q, but got\n%s", expected, ptExcept)
+	}
+}
+
+func TestDecipherMboxOutput(t *testing.T) {
+	pair := loadTestKeyPair(t)
+	outDir := filepath.Join(t.TempDir(), "alice")
+	if err := os.MkdirAll(filepath.Join(outDir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 2 runs, as for 2 PSTs of 1 custodian, must keep appending and numbering
+	for _, body := range []string{"first body", "From the second body"} {
+		msg, _ := encryptedMsg(t, pair, "Content-Type: text/plain\n\n"+body+"\n")
+		inDir, _ := mkCase(t, msg)
+		Decipher(inDir, testCertDir, testKeyDir, testPW, outDir, Options{Output: OutputMbox, Sidecar: SidecarP7m})
+	}
+
+	f, err := os.Open(filepath.Join(outDir, "alice.mbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mr := mbox.NewReader(f, mbox.MboxRD)
+	msgs := []*mbox.Message{}
+	for {
+		m, err := mr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+	if len(msgs) != 2 || !strings.Contains(string(msgs[1].Data), "\nFrom the second body\n") {
+		t.Fatalf("Expected 2 deciphered messages with From unescaped, but got %d", len(msgs))
+	}
+
+	success, err := os.ReadFile(filepath.Join(outDir, "logs", "success.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimRight(string(success), "\n"), "\n")
+	if !strings.HasSuffix(rows[0], "\tStatus\tIndex\tOffset\tCiphertext\tDuplicate Of") {
+		t.Errorf("Expected Index and Offset columns, but got %q", rows[0])
+	}
+	for i, m := range msgs {
+		expectedTail := fmt.Sprintf("\tsuccess\t%d\t%d\t%d.p7m\t", i+1, m.Offset, i+1)
+		if !strings.HasSuffix(rows[i+1], expectedTail) {
+			t.Errorf("Expected row ending in %q, but got %q", expectedTail, rows[i+1])
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "1.eml")); err == nil {
+		t.Error("Expected no .eml output in mbox mode")
+	}
+}
+
+func TestDecipherMsg(t *testing.T) {
+	outDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(outDir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	Decipher("../../testdata/msgIn", testCertDir, testKeyDir, testPW, outDir, Options{})
+
+	pt, err := os.ReadFile(filepath.Join(outDir, "1.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(pt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Subject") != "RE: the final ultimatum" || !strings.Contains(string(pt), "Nuts!") {
+		t.Errorf("Expected deciphered reply, but got\n%s", pt)
+	}
+	success, err := os.ReadFile(filepath.Join(outDir, "logs", "success.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(success), "\n../../testdata/msgIn/TEST.msg\t") {
+		t.Errorf("Expected success row for TEST.msg, but got\n%s", success)
+	}
+}
+
+func TestDecipherFilter(t *testing.T) {
+	pair := loadTestKeyPair(t)
+	msg, _ := encryptedMsg(t, pair, "Content-Type: text/plain\n\nhello world\n")
+	inDir := t.TempDir()
+	outDir := t.TempDir()
+	// readpst unpacks the mailbox into a dir named for its top
+	top := filepath.Join(inDir, "Top of Outlook data file")
+	for _, folder := range []string{"Inbox/Archive", "Sent Items"} {
+		if err := os.MkdirAll(filepath.Join(top, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(top, folder, "1.eml"), msg, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mboxPath := filepath.Join(t.TempDir(), "mail.mbox")
+	if err := os.WriteFile(mboxPath, []byte("From sender@local Fri Apr 17 16:00:00 2020\n"+string(msg)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(outDir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	criteria, err := filter.Parse("2020-04-17", "2020-04-17", "Inbox/*", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := filter.New(criteria)
+	Decipher(inDir, testCertDir, testKeyDir, testPW, outDir, Options{Filter: scope, Archive: "ct/alice/mail.pst"})
+	// mbox has no folders, so the folder filter doesn't apply to it
+	Decipher(mboxPath, testCertDir, testKeyDir, testPW, outDir, Options{Filter: scope})
+
+	success, err := os.ReadFile(filepath.Join(outDir, "logs", "success.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(string(success)), "\n")[1:]
+	if len(rows) != 2 ||
+		!strings.HasPrefix(rows[0], "ct/alice/mail.pst/Top of Outlook data file/Inbox/Archive/1.eml\t") ||
+		!strings.HasPrefix(rows[1], mboxPath+"#0\t") {
+		t.Errorf("Expected the Inbox/Archive and mbox messages deciphered, but got\n%s", success)
+	}
+	expected := "Filter\tSetting\tCount\nundated\t\t0\nfrom-date\t2020-04-17\t0\nto-date\t2020-04-17\t0\n" +
+		"folder\tInbox/*\t1\nno-folder\t\t1\nkept\t\t2\n"
+	if scope.Summary() != expected {
+		t.Errorf("Expected\n%s\n but got\n%s", expected, scope.Summary())
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	header := "Target\tStatus\tOutput\tCiphertext\tDuplicate Of\n"
+	path := filepath.Join(t.TempDir(), "success.tsv")
+	if err := os.WriteFile(path, []byte(header+"a.eml\tsuccess\t1.eml\t\t\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHeader(path, header); err != nil {
+		t.Errorf("Expected the same header to be appended to, but got %v", err)
+	}
+	// a log from before the Ciphertext and Duplicate Of columns
+	if err := os.WriteFile(path, []byte("Target\tStatus\tOutput\na.eml\tsuccess\t1.eml\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHeader(path, header); err == nil {
+		t.Error("Expected an error for a log with other columns")
+	}
+}
@@ -0,0 +1,270 @@
+// per-message JSON sidecar so review platforms can load fields without re-parsing MIME
+package decipher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// Metadata is the JSON sidecar written next to each output when Options.Metadata is set
+type Metadata struct {
+	Custodian   string              `json:"custodian"`
+	Source      string              `json:"source"`
+	Output      string              `json:"output"`
+	Ciphertext  string              `json:"ciphertext,omitempty"`
+	Headers     map[string][]string `json:"headers"`
+	Decryption  []LayerMetadata     `json:"decryption"`
+	Attachments []AttachMetadata    `json:"attachments"`
+	Hashes      HashMetadata        `json:"hashes"`
+}
+
+type LayerMetadata struct {
+	Layer               int    `json:"layer"`
+	ContentType         string `json:"contentType"`
+	ContentEncryption   string `json:"contentEncryption,omitempty"`
+	KeyEncryption       string `json:"keyEncryption,omitempty"`
+	KeySerial           string `json:"keySerial,omitempty"`
+	CiphertextSHA256    string `json:"ciphertextSha256"`
+	CiphertextSizeBytes int    `json:"ciphertextSizeBytes"`
+}
+
+type AttachMetadata struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	SizeBytes   int    `json:"sizeBytes"`
+	MD5         string `json:"md5"`
+	SHA256      string `json:"sha256"`
+}
+
+type HashMetadata struct {
+	SourceMD5    string `json:"sourceMd5"`
+	SourceSHA256 string `json:"sourceSha256"`
+	OutputMD5    string `json:"outputMd5"`
+	OutputSHA256 string `json:"outputSha256"`
+}
+
+// the parts of a CMS ContentInfo we need to name the algorithms of a layer
+type envelopeInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  asn1.RawValue
+	KeyEncryptionAlgorithm algorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm algorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+var (
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// algorithmName maps the OIDs seen in S/MIME envelopes to readable names; anything else is reported as the dotted OID
+func algorithmName(oid asn1.ObjectIdentifier) string {
+	names := []struct {
+		oid  asn1.ObjectIdentifier
+		name string
+	}{
+		{pkcs7.OIDEncryptionAlgorithmDESCBC, "des-cbc"},
+		{pkcs7.OIDEncryptionAlgorithmDESEDE3CBC, "des-ede3-cbc"},
+		{pkcs7.OIDEncryptionAlgorithmAES128CBC, "aes128-cbc"},
+		{pkcs7.OIDEncryptionAlgorithmAES256CBC, "aes256-cbc"},
+		{pkcs7.OIDEncryptionAlgorithmAES128GCM, "aes128-gcm"},
+		{pkcs7.OIDEncryptionAlgorithmAES256GCM, "aes256-gcm"},
+		{pkcs7.OIDEncryptionAlgorithmRSA, "rsaEncryption"},
+		{pkcs7.OIDEncryptionAlgorithmRSAESOAEP, "rsaes-oaep"},
+		{oidEnvelopedData, "enveloped-data"},
+		{oidSignedData, "signed-data"},
+	}
+	for _, n := range names {
+		if n.oid.Equal(oid) {
+			return n.name
+		}
+	}
+	return oid.String()
+}
+
+// describeLayer reads the algorithms out of a layer's DER. Parse failures leave the algorithm fields blank.
+func describeLayer(i int, layer cipherLayer) LayerMetadata {
+	lm := LayerMetadata{
+		Layer:               i + 1,
+		KeySerial:           layer.keySerial,
+		CiphertextSHA256:    fmt.Sprintf("%x", sha256.Sum256(layer.der)),
+		CiphertextSizeBytes: len(layer.der),
+	}
+	var info envelopeInfo
+	if _, err := asn1.Unmarshal(layer.der, &info); err != nil {
+		return lm
+	}
+	lm.ContentType = algorithmName(info.ContentType)
+	if !info.ContentType.Equal(oidEnvelopedData) {
+		return lm
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &ed); err != nil {
+		return lm
+	}
+	lm.ContentEncryption = algorithmName(ed.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm)
+	if len(ed.RecipientInfos) > 0 {
+		lm.KeyEncryption = algorithmName(ed.RecipientInfos[0].KeyEncryptionAlgorithm.Algorithm)
+	}
+	return lm
+}
+
+// Attachment is a decoded part of a deciphered message that carries a filename
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// Attachments walks the MIME tree of msg and returns every part that carries a filename.
+// Attached emails without a filename are named message.eml.
+func Attachments(msg []byte) ([]Attachment, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	return walkAttachments(m.Header, m.Body)
+}
+
+func walkAttachments(header mail.Header, body io.Reader) ([]Attachment, error) {
+	attachments := []Attachment{}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// no or broken Content-Type is treated as a single text body
+		return attachments, nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			children, err := walkAttachments(mail.Header(p.Header), p)
+			if err != nil {
+				return nil, err
+			}
+			attachments = append(attachments, children...)
+		}
+		return attachments, nil
+	}
+	filename := params["name"]
+	if _, dParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil &&
+		dParams["filename"] != "" {
+		filename = dParams["filename"]
+	}
+	if filename == "" && mediaType == "message/rfc822" {
+		filename = "message.eml"
+	}
+	if filename == "" {
+		return attachments, nil
+	}
+	content, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return nil, err
+	}
+	return append(attachments, Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Content:     content,
+	}), nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// writeMetadata saves the JSON sidecar for output number outNum
+func writeMetadata(
+	outDir string,
+	outNum int,
+	source, output, ciphertext string,
+	msgFile, pt []byte,
+	layers []cipherLayer,
+) error {
+	md := Metadata{
+		Custodian:  filepath.Base(outDir),
+		Source:     source,
+		Output:     output,
+		Ciphertext: ciphertext,
+		Decryption: []LayerMetadata{},
+		Hashes: HashMetadata{
+			SourceMD5:    fmt.Sprintf("%x", md5.Sum(msgFile)),
+			SourceSHA256: fmt.Sprintf("%x", sha256.Sum256(msgFile)),
+			OutputMD5:    fmt.Sprintf("%x", md5.Sum(pt)),
+			OutputSHA256: fmt.Sprintf("%x", sha256.Sum256(pt)),
+		},
+	}
+	for i, layer := range layers {
+		md.Decryption = append(md.Decryption, describeLayer(i, layer))
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(pt))
+	if err != nil {
+		return err
+	}
+	md.Headers = msg.Header
+	attachments, err := walkAttachments(msg.Header, msg.Body)
+	if err != nil {
+		return err
+	}
+	md.Attachments = []AttachMetadata{}
+	for _, a := range attachments {
+		md.Attachments = append(md.Attachments, AttachMetadata{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			SizeBytes:   len(a.Content),
+			MD5:         fmt.Sprintf("%x", md5.Sum(a.Content)),
+			SHA256:      fmt.Sprintf("%x", sha256.Sum256(a.Content)),
+		})
+	}
+	mdBytes, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outDir, fmt.Sprintf("%d.json", outNum)), mdBytes, 0666)
+}
@@ -12,10 +12,23 @@ import (
 	"mime/multipart"
 	"net/mail"
 	"regexp"
+	"sort"
 	"strings"
 )
 
-func walkMultipart(attachBytes []byte, certKeyPairs []certKeyPair, foundCT *bool) ([]byte, error) {
+// cipherLayer records one enveloped-data object unwrapped while walking a message.
+// The first layer recorded is the outermost ciphertext.
+type cipherLayer struct {
+	der       []byte
+	keySerial string
+}
+
+func walkMultipart(
+	attachBytes []byte,
+	certKeyPairs []certKeyPair,
+	foundCT *bool,
+	layers *[]cipherLayer,
+) ([]byte, error) {
 	// DEBUG
 	// fmt.Printf(
 	// 	"--BEGIN walkMultipart input bytes--\n%s--END walkMultipart input bytes--\n",
@@ -41,7 +54,8 @@ func walkMultipart(attachBytes []byte, certKeyPairs []certKeyPair, foundCT *bool
 	if err != nil {
 		return attachBytes, err
 	}
-	for key, values := range msg.Header {
+	for _, key := range sortedKeys(msg.Header) {
+		values := msg.Header[key]
 		// Filter out the following message headers normally found in encrypted msg
 		// X-Ms-Has-Attach: yes
 		// Content-Type: multipart/mixed; boundary="--boundary-LibPST-iamunique-[GUID]_-_-"
@@ -94,7 +108,7 @@ func walkMultipart(attachBytes []byte, certKeyPairs []certKeyPair, foundCT *bool
 
 		// check for nested msg in a msg
 		if rfc822Re.MatchString(pContentType) {
-			childPt, err := walkMultipart(slurp, certKeyPairs, foundCT)
+			childPt, err := walkMultipart(slurp, certKeyPairs, foundCT, layers)
 			if err != nil {
 				return nil, err
 			}
@@ -113,18 +127,22 @@ func walkMultipart(attachBytes []byte, certKeyPairs []certKeyPair, foundCT *bool
 				log.Fatal(err)
 			}
 			dst = dst[:n]
-			childPt, err := decipher(dst, certKeyPairs)
+			childPt, keySerial, err := decipher(dst, certKeyPairs)
 			if err != nil {
 				return nil, err
 			}
-			childPt, err = walkMultipart(childPt, certKeyPairs, foundCT)
+			if layers != nil {
+				*layers = append(*layers, cipherLayer{der: dst, keySerial: keySerial})
+			}
+			childPt, err = walkMultipart(childPt, certKeyPairs, foundCT, layers)
 			if err != nil {
 				return nil, err
 			}
 			pt = append(pt, childPt...)
 		} else {
 			pHeader := []byte{}
-			for key, values := range p.Header {
+			for _, key := range sortedKeys(p.Header) {
+				values := p.Header[key]
 				pHeadElement := fmt.Sprintf("%s: %s\n", key, strings.Join(values, "\n    "))
 				pHeader = append(pHeader, []byte(pHeadElement)...)
 			}
@@ -135,3 +153,13 @@ func walkMultipart(attachBytes []byte, certKeyPairs []certKeyPair, foundCT *bool
 	}
 	return pt, nil
 }
+
+// sortedKeys orders the keys of a header, so the same message is written the same way every time
+func sortedKeys(header map[string][]string) []string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
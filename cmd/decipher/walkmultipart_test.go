@@ -13,12 +13,12 @@ func TestPlainMsgBody(t *testing.T) {
 	msg := []byte(expected)
 	certKeyPairs := []certKeyPair{}
 	certBytes, err := os.ReadFile(
-		"../testdata/certIn/12c3905b55296e401270c0ceb18b5ba660db9a1f.cert",
+		"../../testdata/certIn/12c3905b55296e401270c0ceb18b5ba660db9a1f.cert",
 	)
 	if err != nil {
 		t.Error(err)
 	}
-	keyBytes, err := os.ReadFile("../testdata/keyIn/12c3905b55296e401270c0ceb18b5ba660db9a1f.key")
+	keyBytes, err := os.ReadFile("../../testdata/keyIn/12c3905b55296e401270c0ceb18b5ba660db9a1f.key")
 	if err != nil {
 		t.Error(err)
 	}
@@ -33,7 +33,7 @@ func TestPlainMsgBody(t *testing.T) {
 	myCertKeyPair := certKeyPair{myCert, myKey}
 	certKeyPairs = append(certKeyPairs, myCertKeyPair)
 	foundCT := false
-	actual, err := walkMultipart(msg, certKeyPairs, &foundCT)
+	actual, err := walkMultipart(msg, certKeyPairs, &foundCT, nil)
 	if err != nil {
 		t.Error(err)
 	}
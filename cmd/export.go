@@ -0,0 +1,167 @@
+/*
+Copyright © 2024 McFlip <grady.c.denton@yahoo.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/package cmd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/McFlip/enigma/cmd/export"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export deciphered output for review platforms",
+	Long: `Export deciphered output for review platforms.
+
+  Run after decipher. Each custodian folder under pt is exported on its own.
+  Attachments are extracted under pt/custodianName/attachments so they can be loaded as family members.`,
+}
+
+// loadfileCmd represents the export loadfile command
+var loadfileCmd = &cobra.Command{
+	Use:   "loadfile",
+	Short: "Write Concordance/Relativity DAT and OPT load files",
+	Long: `Write Concordance/Relativity DAT and OPT load files.
+
+  Writes pt/custodianName/custodianName.dat and .opt next to the deciphered natives.
+  The DAT is UTF-8 with þ quotes and ASCII 20 (¶) column delimiters.
+  Native paths are relative to the DAT.
+  Columns default to the standard email fields; configure export.fields to rename, reorder or drop them.
+  Available fields:
+    DocID BegAttach EndAttach ParentDocID AttachCount Custodian
+    From To CC BCC Subject DateSent TimeSent MessageID
+    FileName FileExtension FileSize MD5 SHA256 NativePath
+    SourcePath SourceSHA256 KeySerial Ciphertext`,
+	Run: func(cmd *cobra.Command, args []string) {
+		viper.SetDefault("decipher.pt", "pt")
+		viper.SetDefault("export.pt", viper.GetString("decipher.pt"))
+		*exportPt = viper.GetString("export.pt")
+		fields := []export.FieldMap{}
+		if err := viper.UnmarshalKey("export.fields", &fields); err != nil {
+			log.Fatal("Failed to unmarshall export fields: ", err)
+		}
+		if len(fields) == 0 {
+			fields = export.DefaultFields
+		}
+		delim := export.DefaultDelimiters
+		for key, r := range map[string]*rune{
+			"export.quote":     &delim.Quote,
+			"export.delimiter": &delim.Column,
+			"export.newline":   &delim.Newline,
+		} {
+			if v := []rune(viper.GetString(key)); len(v) > 0 {
+				*r = v[0]
+			}
+		}
+
+		custodians, err := os.ReadDir(*exportPt)
+		if err != nil {
+			log.Fatal("Failed to read pt dir: ", err)
+		}
+		for _, custodian := range custodians {
+			if !custodian.IsDir() {
+				continue
+			}
+			custodianDir := filepath.Join(*exportPt, custodian.Name())
+			log.Println("Exporting ", custodian.Name())
+			docs, err := export.LoadCustodian(custodianDir)
+			if err != nil {
+				log.Fatal("Failed to load deciphered output of ", custodian.Name(), ": ", err)
+			}
+			dat, err := os.Create(filepath.Join(custodianDir, custodian.Name()+".dat"))
+			if err != nil {
+				log.Fatal("Failed to create DAT: ", err)
+			}
+			if err := export.WriteDAT(dat, docs, fields, delim, ""); err != nil {
+				log.Fatal("Failed to write DAT: ", err)
+			}
+			dat.Close()
+			opt, err := os.Create(filepath.Join(custodianDir, custodian.Name()+".opt"))
+			if err != nil {
+				log.Fatal("Failed to create OPT: ", err)
+			}
+			if err := export.WriteOPT(opt, docs, custodian.Name(), ""); err != nil {
+				log.Fatal("Failed to write OPT: ", err)
+			}
+			opt.Close()
+		}
+		log.Println("DONE!")
+	},
+}
+
+// edrmCmd represents the export edrm command
+var edrmCmd = &cobra.Command{
+	Use:   "edrm",
+	Short: "Write EDRM XML 1.2",
+	Long: `Write EDRM XML 1.2.
+
+  Writes pt/custodianName/custodianName.xml next to the deciphered natives, one batch per custodian.
+  Emails carry the EDRM # email tags, every document carries its file tags, MD5 and SHA256,
+  and attachments are linked to their parent email by Attachment relationships.
+  Native file paths are relative to the XML.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		viper.SetDefault("decipher.pt", "pt")
+		viper.SetDefault("export.pt", viper.GetString("decipher.pt"))
+		*exportPt = viper.GetString("export.pt")
+
+		custodians, err := os.ReadDir(*exportPt)
+		if err != nil {
+			log.Fatal("Failed to read pt dir: ", err)
+		}
+		for _, custodian := range custodians {
+			if !custodian.IsDir() {
+				continue
+			}
+			custodianDir := filepath.Join(*exportPt, custodian.Name())
+			log.Println("Exporting ", custodian.Name())
+			docs, err := export.LoadCustodian(custodianDir)
+			if err != nil {
+				log.Fatal("Failed to load deciphered output of ", custodian.Name(), ": ", err)
+			}
+			edrm, err := os.Create(filepath.Join(custodianDir, custodian.Name()+".xml"))
+			if err != nil {
+				log.Fatal("Failed to create EDRM XML: ", err)
+			}
+			if err := export.WriteEDRM(edrm, docs, custodian.Name(), ""); err != nil {
+				log.Fatal("Failed to write EDRM XML: ", err)
+			}
+			edrm.Close()
+		}
+		log.Println("DONE!")
+	},
+}
+
+var exportPt *string
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.AddCommand(loadfileCmd)
+	exportCmd.AddCommand(edrmCmd)
+
+	exportPt = exportCmd.PersistentFlags().
+		String("pt", "", "Dir of deciphered output from decipher. There is a subfolder for each custodian.")
+	viper.BindPFlag("export.pt", exportCmd.PersistentFlags().Lookup("pt"))
+}
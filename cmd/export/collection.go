@@ -0,0 +1,227 @@
+// Gathers the deciphered output of a custodian into documents for load files.
+// Each deciphered email is a parent document and every attachment is extracted as a child document.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/McFlip/enigma/cmd/decipher"
+)
+
+// Document is one row of a load file. Fields holds the enigma field names listed in DefaultFields.
+type Document struct {
+	DocID      string
+	ParentID   string
+	Custodian  string
+	NativePath string // relative to the custodian dir
+	Sent       time.Time
+	Fields     map[string]string
+}
+
+// AttachmentsDir is where attachments are extracted under a custodian's pt dir
+const AttachmentsDir = "attachments"
+
+// ErrMboxOutput is returned for a custodian deciphered with output: mbox, which has no native file per message
+var ErrMboxOutput = errors.New("deciphered with output: mbox, rerun decipher with output: eml to export")
+
+// ReadTSV loads a tab delimited log into rows keyed by the header line
+func ReadTSV(path string) ([]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows := []map[string]string{}
+	var header []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), "\t")
+		if header == nil {
+			header = cols
+			continue
+		}
+		row := map[string]string{}
+		for i, name := range header {
+			if i < len(cols) {
+				row[name] = cols[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// LoadCustodian reads logs/success.tsv under custodianDir and returns a document per deciphered email
+// followed by its attachments. Attachments are written out under AttachmentsDir so they have a native path.
+func LoadCustodian(custodianDir string) ([]Document, error) {
+	custodian := filepath.Base(custodianDir)
+	rows, err := ReadTSV(filepath.Join(custodianDir, "logs", "success.tsv"))
+	if err != nil {
+		return nil, err
+	}
+	docs := []Document{}
+	for _, row := range rows {
+		if _, ok := row["Offset"]; ok {
+			return nil, ErrMboxOutput
+		}
+		output := row["Output"]
+		if output == "" {
+			continue
+		}
+		msgBytes, err := os.ReadFile(filepath.Join(custodianDir, output))
+		if err != nil {
+			return nil, err
+		}
+		parent := Document{
+			DocID:      docID(custodian, output),
+			Custodian:  custodian,
+			NativePath: output,
+			Fields:     map[string]string{},
+		}
+		parent.Fields["SourcePath"] = row["Target"]
+		parent.Fields["Ciphertext"] = row["Ciphertext"]
+		fileFields(parent.Fields, output, msgBytes)
+		parent.Sent, err = headerFields(parent.Fields, msgBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", output, err)
+		}
+		if err := sidecarFields(parent.Fields, custodianDir, output); err != nil {
+			return nil, fmt.Errorf("%s: %w", output, err)
+		}
+
+		attachments, err := decipher.Attachments(msgBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", output, err)
+		}
+		children := []Document{}
+		attachDir := filepath.Join(AttachmentsDir, strings.TrimSuffix(output, filepath.Ext(output)))
+		if len(attachments) > 0 {
+			if err := os.MkdirAll(filepath.Join(custodianDir, attachDir), 0755); err != nil {
+				return nil, err
+			}
+		}
+		for i, a := range attachments {
+			// number the extracted files so duplicate attachment names can't collide
+			name := fmt.Sprintf("%d_%s", i+1, safeFileName(a.Filename))
+			nativePath := filepath.Join(attachDir, name)
+			if err := os.WriteFile(filepath.Join(custodianDir, nativePath), a.Content, 0666); err != nil {
+				return nil, err
+			}
+			child := Document{
+				DocID:      fmt.Sprintf("%s.%04d", parent.DocID, i+1),
+				ParentID:   parent.DocID,
+				Custodian:  custodian,
+				NativePath: nativePath,
+				Fields:     map[string]string{},
+			}
+			fileFields(child.Fields, a.Filename, a.Content)
+			child.Fields["SourcePath"] = row["Target"]
+			if a.ContentType == "message/rfc822" {
+				child.Sent, _ = headerFields(child.Fields, a.Content)
+			}
+			children = append(children, child)
+		}
+
+		family := append([]Document{parent}, children...)
+		endAttach := family[len(family)-1].DocID
+		for i := range family {
+			family[i].Fields["DocID"] = family[i].DocID
+			family[i].Fields["ParentDocID"] = family[i].ParentID
+			family[i].Fields["BegAttach"] = parent.DocID
+			family[i].Fields["EndAttach"] = endAttach
+			family[i].Fields["Custodian"] = custodian
+			family[i].Fields["NativePath"] = family[i].NativePath
+		}
+		family[0].Fields["AttachCount"] = fmt.Sprint(len(children))
+		docs = append(docs, family...)
+	}
+	return docs, nil
+}
+
+// docID names a deciphered email after its custodian and output number, ex. alice-12
+func docID(custodian, output string) string {
+	return fmt.Sprintf("%s-%s", custodian, strings.TrimSuffix(output, filepath.Ext(output)))
+}
+
+func fileFields(fields map[string]string, name string, content []byte) {
+	fields["FileName"] = name
+	fields["FileExtension"] = strings.TrimPrefix(filepath.Ext(name), ".")
+	fields["FileSize"] = fmt.Sprint(len(content))
+	fields["MD5"] = fmt.Sprintf("%x", md5.Sum(content))
+	fields["SHA256"] = fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// headerFields fills the email fields and returns the parsed sent date, which is zero if it can't be parsed
+func headerFields(fields map[string]string, msgBytes []byte) (time.Time, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(msgBytes))
+	if err != nil {
+		return time.Time{}, err
+	}
+	header := msg.Header
+	fields["From"] = header.Get("From")
+	fields["To"] = header.Get("To")
+	fields["CC"] = header.Get("Cc")
+	fields["BCC"] = header.Get("Bcc")
+	fields["Subject"] = header.Get("Subject")
+	fields["MessageID"] = header.Get("Message-ID")
+	date, err := mail.ParseDate(header.Get("Date"))
+	if err != nil {
+		return time.Time{}, nil
+	}
+	date = date.UTC()
+	fields["DateSent"] = date.Format("01/02/2006")
+	fields["TimeSent"] = date.Format(time.TimeOnly)
+	return date, nil
+}
+
+// sidecarFields copies what only the decipher JSON sidecar knows, if one was written
+func sidecarFields(fields map[string]string, custodianDir, output string) error {
+	mdPath := filepath.Join(custodianDir, strings.TrimSuffix(output, filepath.Ext(output))+".json")
+	mdBytes, err := os.ReadFile(mdPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var md decipher.Metadata
+	if err := json.Unmarshal(mdBytes, &md); err != nil {
+		return err
+	}
+	fields["SourceSHA256"] = md.Hashes.SourceSHA256
+	serials := []string{}
+	for _, layer := range md.Decryption {
+		if layer.KeySerial != "" {
+			serials = append(serials, layer.KeySerial)
+		}
+	}
+	fields["KeySerial"] = strings.Join(serials, ";")
+	return nil
+}
+
+// safeFileName keeps an attachment name from escaping its folder or breaking on Windows
+func safeFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"/\|?*`, r) || !unicode.IsPrint(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "." || name == "" {
+		name = "attachment"
+	}
+	return name
+}
@@ -0,0 +1,159 @@
+package export
+
+import (
+	"encoding/xml"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EDRM XML 1.2 document structure, limited to the elements enigma fills in
+type edrmRoot struct {
+	XMLName             xml.Name `xml:"Root"`
+	MajorVersion        int      `xml:"MajorVersion,attr"`
+	MinorVersion        int      `xml:"MinorVersion,attr"`
+	Description         string   `xml:"Description,attr"`
+	Locale              string   `xml:"Locale,attr"`
+	DataInterchangeType string   `xml:"DataInterchangeType,attr"`
+	Batch               edrmBatch
+}
+
+type edrmBatch struct {
+	XMLName       xml.Name           `xml:"Batch"`
+	Name          string             `xml:"name,attr"`
+	Documents     []edrmDocument     `xml:"Documents>Document"`
+	Relationships []edrmRelationship `xml:"Relationships>Relationship,omitempty"`
+}
+
+type edrmDocument struct {
+	DocID     string         `xml:"DocID,attr"`
+	DocType   string         `xml:"DocType,attr"`
+	MimeType  string         `xml:"MimeType,attr,omitempty"`
+	Tags      []edrmTag      `xml:"Tags>Tag"`
+	Files     []edrmFile     `xml:"Files>File"`
+	Locations []edrmLocation `xml:"Locations>Location"`
+}
+
+type edrmTag struct {
+	TagName     string `xml:"TagName,attr"`
+	TagValue    string `xml:"TagValue,attr"`
+	TagDataType string `xml:"TagDataType,attr"`
+}
+
+type edrmFile struct {
+	FileType     string           `xml:"FileType,attr"`
+	ExternalFile edrmExternalFile `xml:"ExternalFile"`
+}
+
+type edrmExternalFile struct {
+	FilePath string `xml:"FilePath,attr"`
+	FileName string `xml:"FileName,attr"`
+	FileSize string `xml:"FileSize,attr"`
+	Hash     string `xml:"Hash,attr"`
+}
+
+type edrmLocation struct {
+	Custodian   string `xml:"Custodian"`
+	LocationURI string `xml:"LocationURI"`
+}
+
+type edrmRelationship struct {
+	Type        string `xml:"Type,attr"`
+	ParentDocId string `xml:"ParentDocId,attr"`
+	ChildDocId  string `xml:"ChildDocId,attr"`
+}
+
+// reserved EDRM email tags and the enigma fields that fill them
+var edrmEmailTags = []FieldMap{
+	{"#From", "From"},
+	{"#To", "To"},
+	{"#CC", "CC"},
+	{"#BCC", "BCC"},
+	{"#Subject", "Subject"},
+}
+
+// WriteEDRM writes docs as an EDRM XML 1.2 batch named batchName.
+// Emails get the reserved # email tags, every document gets its hashes and source as custom tags,
+// and attachments are linked to their parent email with Attachment relationships.
+func WriteEDRM(w io.Writer, docs []Document, batchName, nativePrefix string) error {
+	root := edrmRoot{
+		MajorVersion:        1,
+		MinorVersion:        2,
+		Description:         "Deciphered email exported by enigma",
+		Locale:              "US",
+		DataInterchangeType: "Update",
+		Batch:               edrmBatch{Name: batchName},
+	}
+	for _, doc := range docs {
+		ed := edrmDocument{DocID: doc.DocID, DocType: "File"}
+		isEmail := doc.ParentID == "" || strings.EqualFold(doc.Fields["FileExtension"], "eml")
+		if isEmail {
+			ed.DocType = "Message"
+			ed.MimeType = "message/rfc822"
+			for _, t := range edrmEmailTags {
+				ed.Tags = append(ed.Tags, edrmTag{t.Name, doc.Fields[t.Field], "Text"})
+			}
+			if !doc.Sent.IsZero() {
+				ed.Tags = append(ed.Tags, edrmTag{"#DateSent", doc.Sent.Format(time.RFC3339), "DateTime"})
+			}
+			if doc.ParentID == "" {
+				ed.Tags = append(
+					ed.Tags,
+					edrmTag{"#HasAttachments", boolTag(doc.Fields["AttachCount"] != "0"), "Boolean"},
+					edrmTag{"#AttachmentCount", doc.Fields["AttachCount"], "Integer"},
+				)
+			}
+			ed.Tags = append(ed.Tags, edrmTag{"MessageID", doc.Fields["MessageID"], "Text"})
+		}
+		ed.Tags = append(
+			ed.Tags,
+			edrmTag{"#FileName", doc.Fields["FileName"], "Text"},
+			edrmTag{"#FileExtension", doc.Fields["FileExtension"], "Text"},
+			edrmTag{"#FileSize", doc.Fields["FileSize"], "Integer"},
+			edrmTag{"MD5", doc.Fields["MD5"], "Text"},
+			edrmTag{"SHA256", doc.Fields["SHA256"], "Text"},
+			edrmTag{"SourcePath", doc.Fields["SourcePath"], "Text"},
+		)
+		for _, name := range []string{"SourceSHA256", "KeySerial"} {
+			if doc.Fields[name] != "" {
+				ed.Tags = append(ed.Tags, edrmTag{name, doc.Fields[name], "Text"})
+			}
+		}
+		nativePath := filepath.Join(nativePrefix, doc.NativePath)
+		ed.Files = []edrmFile{{
+			FileType: "Native",
+			ExternalFile: edrmExternalFile{
+				FilePath: windowsPath(filepath.Dir(nativePath)),
+				FileName: filepath.Base(nativePath),
+				FileSize: doc.Fields["FileSize"],
+				Hash:     doc.Fields["MD5"],
+			},
+		}}
+		ed.Locations = []edrmLocation{{Custodian: doc.Custodian, LocationURI: doc.Fields["SourcePath"]}}
+		root.Batch.Documents = append(root.Batch.Documents, ed)
+		if doc.ParentID != "" {
+			root.Batch.Relationships = append(
+				root.Batch.Relationships,
+				edrmRelationship{Type: "Attachment", ParentDocId: doc.ParentID, ChildDocId: doc.DocID},
+			)
+		}
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func boolTag(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
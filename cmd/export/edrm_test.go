@@ -0,0 +1,59 @@
+package export
+
+import (
+	"encoding/xml"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteEDRM(t *testing.T) {
+	docs, err := LoadCustodian(mkCustodian(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmlPath := filepath.Join(t.TempDir(), "alice.xml")
+	f, err := os.Create(xmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteEDRM(f, docs, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	xmlBytes, err := os.ReadFile(xmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root edrmRoot
+	if err := xml.Unmarshal(xmlBytes, &root); err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Batch.Documents) != 2 || root.Batch.Documents[0].DocType != "Message" {
+		t.Errorf("Expected an email and its attachment, but got %+v", root.Batch.Documents)
+	}
+	expected := edrmRelationship{Type: "Attachment", ParentDocId: "alice-1", ChildDocId: "alice-1.0001"}
+	if len(root.Batch.Relationships) != 1 || root.Batch.Relationships[0] != expected {
+		t.Errorf("Expected relationship %+v, but got %+v", expected, root.Batch.Relationships)
+	}
+	file := root.Batch.Documents[1].Files[0].ExternalFile
+	if file.FilePath != "attachments\\1" || file.FileName != "1_note.txt" {
+		t.Errorf("Unexpected native file reference %+v", file)
+	}
+
+	// the official EDRM 1.2 schema isn't shipped, EDRM_XSD points at a copy to validate against it
+	xsd := os.Getenv("EDRM_XSD")
+	if xsd == "" {
+		t.Skip("set EDRM_XSD to the EDRM 1.2 schema to validate against it")
+	}
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Skip("xmllint is needed to validate against the schema, install libxml2-utils")
+	}
+	out, err := exec.Command(xmllint, "--noout", "--schema", xsd, xmlPath).CombinedOutput()
+	if err != nil {
+		t.Errorf("EDRM XML failed schema validation: %s", out)
+	}
+}
@@ -0,0 +1,115 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// FieldMap names a load file column and the enigma field that fills it
+type FieldMap struct {
+	Name  string
+	Field string
+}
+
+// DefaultFields are the load file columns used when none are configured
+var DefaultFields = []FieldMap{
+	{"DocID", "DocID"},
+	{"BegAttach", "BegAttach"},
+	{"EndAttach", "EndAttach"},
+	{"ParentDocID", "ParentDocID"},
+	{"AttachCount", "AttachCount"},
+	{"Custodian", "Custodian"},
+	{"From", "From"},
+	{"To", "To"},
+	{"CC", "CC"},
+	{"BCC", "BCC"},
+	{"Subject", "Subject"},
+	{"DateSent", "DateSent"},
+	{"TimeSent", "TimeSent"},
+	{"MessageID", "MessageID"},
+	{"FileName", "FileName"},
+	{"FileExtension", "FileExtension"},
+	{"FileSize", "FileSize"},
+	{"MD5", "MD5"},
+	{"SHA256", "SHA256"},
+	{"NativePath", "NativePath"},
+	{"SourcePath", "SourcePath"},
+	{"SourceSHA256", "SourceSHA256"},
+	{"KeySerial", "KeySerial"},
+	{"Ciphertext", "Ciphertext"},
+}
+
+// Delimiters of a Concordance DAT.
+// The defaults are the Concordance ones: þ quotes each value, ASCII 20 (shown as ¶) separates values
+// and ® stands in for line breaks inside a value.
+type Delimiters struct {
+	Quote, Column, Newline rune
+}
+
+var DefaultDelimiters = Delimiters{Quote: 'þ', Column: '\x14', Newline: '®'}
+
+// WriteDAT writes docs as a UTF-8 Concordance DAT with a header row.
+// Native paths are written relative to the DAT with Windows separators, prefixed with nativePrefix.
+func WriteDAT(w io.Writer, docs []Document, fields []FieldMap, delim Delimiters, nativePrefix string) error {
+	bw := bufio.NewWriter(w)
+	// BOM so Windows review tools pick up UTF-8
+	bw.WriteString("\ufeff")
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Name
+	}
+	writeDATRow(bw, names, delim)
+	for _, doc := range docs {
+		values := make([]string, len(fields))
+		for i, f := range fields {
+			values[i] = doc.Fields[f.Field]
+			if f.Field == "NativePath" {
+				values[i] = windowsPath(filepath.Join(nativePrefix, doc.NativePath))
+			}
+		}
+		writeDATRow(bw, values, delim)
+	}
+	return bw.Flush()
+}
+
+func writeDATRow(w *bufio.Writer, values []string, delim Delimiters) {
+	for i, v := range values {
+		if i > 0 {
+			w.WriteRune(delim.Column)
+		}
+		v = strings.NewReplacer(
+			"\r\n", string(delim.Newline),
+			"\n", string(delim.Newline),
+			"\r", string(delim.Newline),
+			string(delim.Quote), "",
+			string(delim.Column), " ",
+		).Replace(v)
+		w.WriteRune(delim.Quote)
+		w.WriteString(v)
+		w.WriteRune(delim.Quote)
+	}
+	w.WriteString("\r\n")
+}
+
+// WriteOPT writes an Opticon cross-reference with one single-page entry per document pointing at its native.
+// Enigma does not image documents; this is for platforms that insist on an OPT alongside the DAT.
+func WriteOPT(w io.Writer, docs []Document, volume, nativePrefix string) error {
+	bw := bufio.NewWriter(w)
+	for _, doc := range docs {
+		fmt.Fprintf(
+			bw,
+			"%s,%s,%s,Y,,,1\r\n",
+			doc.DocID,
+			volume,
+			windowsPath(filepath.Join(nativePrefix, doc.NativePath)),
+		)
+	}
+	return bw.Flush()
+}
+
+func windowsPath(path string) string {
+	return strings.ReplaceAll(filepath.ToSlash(path), "/", "\\")
+}
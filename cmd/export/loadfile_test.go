@@ -0,0 +1,120 @@
+package export
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMsg = "From: sender@local\n" +
+	"To: rcpt@local\n" +
+	"Subject: secret\n" +
+	"Date: Fri, 17 Apr 2020 16:00:00 +0000\n" +
+	"Message-Id: <1@local>\n" +
+	"Content-Type: multipart/mixed; boundary=\"b2\"\n\n" +
+	"--b2\nContent-Type: text/plain\n\nsee attached\n" +
+	"--b2\nContent-Type: text/plain; name=\"note.txt\"\n" +
+	"Content-Disposition: attachment; filename=\"note.txt\"\n" +
+	"Content-Transfer-Encoding: base64\n\n" +
+	"YXR0YWNoZWQgbm90ZQ==\n" +
+	"--b2--\n"
+
+// mkCustodian lays out pt/alice the way decipher leaves it
+func mkCustodian(t *testing.T) string {
+	t.Helper()
+	custodianDir := filepath.Join(t.TempDir(), "alice")
+	if err := os.MkdirAll(filepath.Join(custodianDir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	success := "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tStatus\tOutput\tCiphertext\n" +
+		"ct/alice/mail.pst/Inbox/3.eml\tsender@local\trcpt@local\t\t\tsecret\t\t<1@local>\tyes\tsuccess\t1.eml\t\n"
+	err := os.WriteFile(filepath.Join(custodianDir, "logs", "success.tsv"), []byte(success), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(custodianDir, "1.eml"), []byte(testMsg), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return custodianDir
+}
+
+func TestLoadCustodian(t *testing.T) {
+	custodianDir := mkCustodian(t)
+	docs, err := LoadCustodian(custodianDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("Expected an email and its attachment, but got %d docs", len(docs))
+	}
+	parent, child := docs[0], docs[1]
+	if parent.DocID != "alice-1" || child.DocID != "alice-1.0001" || child.ParentID != "alice-1" {
+		t.Errorf("Unexpected doc IDs %s %s parent %s", parent.DocID, child.DocID, child.ParentID)
+	}
+	for _, doc := range docs {
+		if doc.Fields["BegAttach"] != "alice-1" || doc.Fields["EndAttach"] != "alice-1.0001" {
+			t.Errorf("Unexpected family range for %s: %s-%s",
+				doc.DocID, doc.Fields["BegAttach"], doc.Fields["EndAttach"])
+		}
+	}
+	if parent.Fields["DateSent"] != "04/17/2020" || parent.Fields["AttachCount"] != "1" ||
+		parent.Fields["SourcePath"] != "ct/alice/mail.pst/Inbox/3.eml" {
+		t.Errorf("Unexpected parent fields %v", parent.Fields)
+	}
+	content, err := os.ReadFile(filepath.Join(custodianDir, child.NativePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := base64.StdEncoding.DecodeString("YXR0YWNoZWQgbm90ZQ==")
+	if !bytes.Equal(content, expected) {
+		t.Errorf("Expected extracted attachment %q, but got %q", expected, content)
+	}
+}
+
+func TestLoadCustodianMboxOutput(t *testing.T) {
+	custodianDir := mkCustodian(t)
+	success := "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tStatus\tIndex\tOffset\tCiphertext\n" +
+		"ct/alice/mail.pst/Inbox/3.eml\tsender@local\trcpt@local\t\t\tsecret\t\t<1@local>\tyes\tsuccess\t1\t0\t\n"
+	err := os.WriteFile(filepath.Join(custodianDir, "logs", "success.tsv"), []byte(success), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCustodian(custodianDir); !errors.Is(err, ErrMboxOutput) {
+		t.Errorf("Expected ErrMboxOutput, but got %v", err)
+	}
+}
+
+func TestWriteDAT(t *testing.T) {
+	docs, err := LoadCustodian(mkCustodian(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	fields := []FieldMap{{"BEGDOC", "DocID"}, {"SUBJECT", "Subject"}, {"NATIVE", "NativePath"}}
+	if err := WriteDAT(&b, docs, fields, DefaultDelimiters, ""); err != nil {
+		t.Fatal(err)
+	}
+	expected := "\ufeff" +
+		"þBEGDOCþ\x14þSUBJECTþ\x14þNATIVEþ\r\n" +
+		"þalice-1þ\x14þsecretþ\x14þ1.emlþ\r\n" +
+		"þalice-1.0001þ\x14þþ\x14þattachments\\1\\1_note.txtþ\r\n"
+	if b.String() != expected {
+		t.Errorf("Expected\n%q\n but got\n%q", expected, b.String())
+	}
+}
+
+func TestWriteDATEscapes(t *testing.T) {
+	docs := []Document{{Fields: map[string]string{"Subject": "line1\r\nline2 þ\x14"}}}
+	var b bytes.Buffer
+	if err := WriteDAT(&b, docs, []FieldMap{{"Subject", "Subject"}}, DefaultDelimiters, ""); err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(b.String(), "\r\n")
+	if rows[1] != "þline1®line2  þ" {
+		t.Errorf("Expected delimiters stripped from values, but got %q", rows[1])
+	}
+}
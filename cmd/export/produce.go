@@ -0,0 +1,208 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Production configures Bates numbering and how documents are split into volumes
+type Production struct {
+	Prefix       string // Bates prefix, ex. ABC
+	Start        int    // first Bates number
+	End          int    // last Bates number the range allows; 0 means no limit
+	Digits       int    // zero padding of the Bates number, also the most digits a Bates number may have
+	VolumePrefix string // ex. VOL gives VOL001, VOL002
+	// MaxVolumeBytes and MaxVolumeDocs cap each volume; 0 means no limit.
+	// Families are never split, so a single family larger than the cap gets a volume to itself.
+	MaxVolumeBytes int64
+	MaxVolumeDocs  int
+}
+
+// ProductionFields are the DAT columns used for a production when none are configured
+var ProductionFields = productionFields()
+
+func productionFields() []FieldMap {
+	fields := []FieldMap{{"BegBates", "BegBates"}, {"EndBates", "EndBates"}}
+	// DefaultFields without DocID, which is the Bates number in a production
+	fields = append(fields, DefaultFields[1:]...)
+	return append(fields, FieldMap{"OriginalDocID", "OriginalDocID"}, FieldMap{"Volume", "Volume"})
+}
+
+// Volume is a folder of the production holding NATIVES and DATA
+type Volume struct {
+	Name string
+	Docs []Document
+	Size int64
+}
+
+// Plan assigns Bates numbers to docs in order and splits them into volumes.
+// Doc IDs, family and parent fields are rewritten in Bates terms; the old ID is kept as OriginalDocID.
+// Native paths become NATIVES/<Bates><ext> within the volume.
+func Plan(docs []Document, p Production) ([]Volume, error) {
+	if p.Digits <= 0 {
+		p.Digits = 7
+	}
+	if p.VolumePrefix == "" {
+		p.VolumePrefix = "VOL"
+	}
+	// a number wider than Digits would no longer sort with the rest of the range
+	last := p.Start + len(docs) - 1
+	switch {
+	case p.Start < 0:
+		return nil, fmt.Errorf("Bates start %d is negative", p.Start)
+	case len(strconv.Itoa(last)) > p.Digits:
+		return nil, fmt.Errorf("%d documents from Bates number %d run to %d, which is more than %d digits",
+			len(docs), p.Start, last, p.Digits)
+	case p.End > 0 && last > p.End:
+		return nil, fmt.Errorf("%d documents from Bates number %d run to %d, past the end of the range at %d",
+			len(docs), p.Start, last, p.End)
+	}
+	bates := map[string]string{}
+	for i, doc := range docs {
+		bates[doc.DocID] = fmt.Sprintf("%s%0*d", p.Prefix, p.Digits, p.Start+i)
+	}
+
+	volumes := []Volume{}
+	var cur *Volume
+	for _, family := range families(docs) {
+		var familySize int64
+		for _, doc := range family {
+			size, err := strconv.ParseInt(doc.Fields["FileSize"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad file size: %w", doc.DocID, err)
+			}
+			familySize += size
+		}
+		full := cur != nil && len(cur.Docs) > 0 &&
+			((p.MaxVolumeBytes > 0 && cur.Size+familySize > p.MaxVolumeBytes) ||
+				(p.MaxVolumeDocs > 0 && len(cur.Docs)+len(family) > p.MaxVolumeDocs))
+		if cur == nil || full {
+			volumes = append(volumes, Volume{Name: fmt.Sprintf("%s%03d", p.VolumePrefix, len(volumes)+1)})
+			cur = &volumes[len(volumes)-1]
+		}
+		for _, doc := range family {
+			produced := Document{
+				DocID:      bates[doc.DocID],
+				ParentID:   bates[doc.ParentID],
+				Custodian:  doc.Custodian,
+				NativePath: filepath.Join("NATIVES", bates[doc.DocID]+filepath.Ext(doc.NativePath)),
+				Sent:       doc.Sent,
+				Fields:     map[string]string{},
+			}
+			for k, v := range doc.Fields {
+				produced.Fields[k] = v
+			}
+			produced.Fields["OriginalDocID"] = doc.DocID
+			produced.Fields["DocID"] = produced.DocID
+			produced.Fields["BegBates"] = produced.DocID
+			produced.Fields["EndBates"] = produced.DocID
+			produced.Fields["BegAttach"] = bates[doc.Fields["BegAttach"]]
+			produced.Fields["EndAttach"] = bates[doc.Fields["EndAttach"]]
+			produced.Fields["ParentDocID"] = produced.ParentID
+			produced.Fields["Volume"] = cur.Name
+			produced.Fields["NativePath"] = produced.NativePath
+			// keep the custodian-relative location so the native can still be copied
+			produced.Fields["OriginalNativePath"] = filepath.Join(doc.Custodian, doc.NativePath)
+			cur.Docs = append(cur.Docs, produced)
+		}
+		cur.Size += familySize
+	}
+	return volumes, nil
+}
+
+// families groups consecutive docs that share a BegAttach
+func families(docs []Document) [][]Document {
+	groups := [][]Document{}
+	for i, doc := range docs {
+		if i == 0 || doc.Fields["BegAttach"] != docs[i-1].Fields["BegAttach"] {
+			groups = append(groups, []Document{})
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], doc)
+	}
+	return groups
+}
+
+// WriteVolume copies the natives of vol from ptDir into outDir/<volume>/NATIVES
+// and writes its DAT and OPT into outDir/<volume>/DATA.
+// Load file paths start at the volume folder, ex. VOL001\NATIVES\ABC0000001.eml
+func WriteVolume(ptDir, outDir string, vol Volume, fields []FieldMap, delim Delimiters) error {
+	volDir := filepath.Join(outDir, vol.Name)
+	if err := os.Mkdir(volDir, 0755); err != nil {
+		return err
+	}
+	for _, sub := range []string{"NATIVES", "DATA"} {
+		if err := os.Mkdir(filepath.Join(volDir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	for _, doc := range vol.Docs {
+		src := filepath.Join(ptDir, doc.Fields["OriginalNativePath"])
+		if err := copyFile(src, filepath.Join(volDir, doc.NativePath)); err != nil {
+			return err
+		}
+	}
+	dat, err := os.Create(filepath.Join(volDir, "DATA", vol.Name+".dat"))
+	if err != nil {
+		return err
+	}
+	defer dat.Close()
+	if err := WriteDAT(dat, vol.Docs, fields, delim, vol.Name); err != nil {
+		return err
+	}
+	opt, err := os.Create(filepath.Join(volDir, "DATA", vol.Name+".opt"))
+	if err != nil {
+		return err
+	}
+	defer opt.Close()
+	return WriteOPT(opt, vol.Docs, vol.Name, vol.Name)
+}
+
+// WriteManifest lists every produced document with its volume, Bates number, origin and hashes
+func WriteManifest(w io.Writer, volumes []Volume) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(
+		"Volume\tBegBates\tEndBates\tBegAttach\tEndAttach\tCustodian\tOriginalDocID\tNativePath\tFileSize\tMD5\tSHA256\tSourcePath\n",
+	)
+	for _, vol := range volumes {
+		for _, doc := range vol.Docs {
+			fmt.Fprintf(
+				bw,
+				"%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				vol.Name,
+				doc.Fields["BegBates"],
+				doc.Fields["EndBates"],
+				doc.Fields["BegAttach"],
+				doc.Fields["EndAttach"],
+				doc.Custodian,
+				doc.Fields["OriginalDocID"],
+				windowsPath(filepath.Join(vol.Name, doc.NativePath)),
+				doc.Fields["FileSize"],
+				doc.Fields["MD5"],
+				doc.Fields["SHA256"],
+				doc.Fields["SourcePath"],
+			)
+		}
+	}
+	return bw.Flush()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
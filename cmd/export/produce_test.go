@@ -0,0 +1,140 @@
+package export
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFamilies builds n emails with one attachment each, every document sized 10 bytes
+func testFamilies(n int) []Document {
+	docs := []Document{}
+	for i := 1; i <= n; i++ {
+		parent := fmt.Sprintf("alice-%d", i)
+		child := parent + ".0001"
+		for _, id := range []string{parent, child} {
+			doc := Document{
+				DocID:      id,
+				Custodian:  "alice",
+				NativePath: id + ".eml",
+				Fields: map[string]string{
+					"FileSize":  "10",
+					"BegAttach": parent,
+					"EndAttach": child,
+				},
+			}
+			if id == child {
+				doc.ParentID = parent
+				doc.NativePath = filepath.Join(AttachmentsDir, id+".txt")
+			}
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+func TestPlanBatesRange(t *testing.T) {
+	docs := testFamilies(3)
+	for _, test := range []struct {
+		name string
+		p    Production
+		last string // empty when the range doesn't fit
+	}{
+		{"fits the digits", Production{Prefix: "ABC", Start: 94, Digits: 2}, "ABC99"},
+		{"wider than the digits", Production{Prefix: "ABC", Start: 95, Digits: 2}, ""},
+		{"ends on the end bound", Production{Prefix: "ABC", Start: 1, End: 6}, "ABC0000006"},
+		{"past the end bound", Production{Prefix: "ABC", Start: 1, End: 5}, ""},
+		{"negative start", Production{Prefix: "ABC", Start: -1}, ""},
+	} {
+		volumes, err := Plan(docs, test.p)
+		if test.last == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if last := volumes[0].Docs[len(docs)-1].DocID; last != test.last {
+			t.Errorf("%s: expected the last Bates number %s, but got %s", test.name, test.last, last)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	volumes, err := Plan(testFamilies(3), Production{Prefix: "ABC", Start: 100, MaxVolumeDocs: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 2 || len(volumes[0].Docs) != 4 || len(volumes[1].Docs) != 2 {
+		t.Fatalf("Expected families kept whole in 2 volumes, but got %+v", volumes)
+	}
+	if volumes[1].Name != "VOL002" || volumes[0].Size != 40 {
+		t.Errorf("Unexpected volume %s of %d bytes", volumes[1].Name, volumes[0].Size)
+	}
+	child := volumes[1].Docs[1]
+	expected := map[string]string{
+		"BegBates":      "ABC0000105",
+		"BegAttach":     "ABC0000104",
+		"EndAttach":     "ABC0000105",
+		"ParentDocID":   "ABC0000104",
+		"OriginalDocID": "alice-3.0001",
+		"Volume":        "VOL002",
+	}
+	for k, v := range expected {
+		if child.Fields[k] != v {
+			t.Errorf("Expected %s %s, but got %s", k, v, child.Fields[k])
+		}
+	}
+	if child.NativePath != filepath.Join("NATIVES", "ABC0000105.txt") {
+		t.Errorf("Unexpected native path %s", child.NativePath)
+	}
+}
+
+func TestPlanByteCap(t *testing.T) {
+	// a family bigger than the cap still gets produced, alone in its volume
+	volumes, err := Plan(testFamilies(2), Production{Prefix: "ABC", Start: 1, MaxVolumeBytes: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 2 || volumes[0].Size != 20 {
+		t.Errorf("Expected one family per volume, but got %+v", volumes)
+	}
+}
+
+func TestWriteVolume(t *testing.T) {
+	ptDir := filepath.Dir(mkCustodian(t))
+	docs, err := LoadCustodian(filepath.Join(ptDir, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := Plan(docs, Production{Prefix: "ABC", Start: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	if err := WriteVolume(ptDir, outDir, volumes[0], ProductionFields, DefaultDelimiters); err != nil {
+		t.Fatal(err)
+	}
+	native, err := os.ReadFile(filepath.Join(outDir, "VOL001", "NATIVES", "ABC0000001.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(native) != testMsg {
+		t.Errorf("Expected the deciphered email copied as the native")
+	}
+	opt, err := os.ReadFile(filepath.Join(outDir, "VOL001", "DATA", "VOL001.opt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(opt), "ABC0000001,VOL001,VOL001\\NATIVES\\ABC0000001.eml,Y,,,1\r\n") {
+		t.Errorf("Unexpected OPT\n%s", opt)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "VOL001", "DATA", "VOL001.dat")); err != nil {
+		t.Error(err)
+	}
+}
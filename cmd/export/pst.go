@@ -0,0 +1,103 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/McFlip/enigma/cmd/mbox"
+	"github.com/McFlip/enigma/cmd/outlook"
+)
+
+// WritePST gathers the deciphered output of the custodian at custodianDir into a new Unicode PST at pstPath
+// and returns how many messages it holds. Both eml and mbox decipher output are read.
+func WritePST(custodianDir, pstPath string) (int, error) {
+	rows, err := ReadTSV(filepath.Join(custodianDir, "logs", "success.tsv"))
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Create(pstPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w, err := outlook.NewPSTWriter(f, filepath.Base(custodianDir))
+	if err != nil {
+		return 0, err
+	}
+
+	var mboxFile *os.File
+	count := 0
+	for _, row := range rows {
+		var msgBytes []byte
+		if offset := row["Offset"]; offset != "" {
+			if mboxFile == nil {
+				mboxFile, err = os.Open(filepath.Join(custodianDir, filepath.Base(custodianDir)+".mbox"))
+				if err != nil {
+					return 0, err
+				}
+				defer mboxFile.Close()
+			}
+			msgBytes, err = readMboxAt(mboxFile, offset)
+		} else if row["Output"] != "" {
+			msgBytes, err = os.ReadFile(filepath.Join(custodianDir, row["Output"]))
+		} else {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", row["Target"], err)
+		}
+		m, err := outlook.FromRFC822(msgBytes)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", row["Target"], err)
+		}
+		if err := w.AddMessage(pstFolder(row["Target"]), m); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, w.Close()
+}
+
+// readMboxAt reads the message whose From line starts at offset in mbox output, which decipher writes as mboxrd
+func readMboxAt(f *os.File, offset string) ([]byte, error) {
+	n, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mbox.NewReader(io.NewSectionReader(f, n, 1<<62), mbox.MboxRD).Next()
+	if err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
+
+// pstFolder places a message by where decipher found it. Messages unpacked from a PST or OST keep their folders
+// under a folder named for that PST, ex. ct/alice/mail.pst/Inbox/12.eml goes in mail.pst/Inbox.
+// Messages split out of an mbox, ex. ct/alice/archive.mbox#1024, go in a folder named for the mbox and loose files
+// in one named for their directory. Folder names may hold a #, only a trailing #offset marks an mbox message.
+func pstFolder(target string) []string {
+	target = filepath.ToSlash(target)
+	parts := strings.Split(target, "/")
+	for i, part := range parts[:len(parts)-1] {
+		if ext := strings.ToLower(filepath.Ext(part)); ext == ".pst" || ext == ".ost" {
+			return parts[i : len(parts)-1]
+		}
+	}
+	if i := strings.LastIndex(target, "#"); i >= 0 {
+		if _, err := strconv.ParseUint(target[i+1:], 10, 64); err == nil {
+			return []string{pathBase(target[:i])}
+		}
+	}
+	if len(parts) < 2 {
+		return []string{"Deciphered"}
+	}
+	return []string{parts[len(parts)-2]}
+}
+
+func pathBase(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
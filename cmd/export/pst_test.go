@@ -0,0 +1,168 @@
+package export
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/McFlip/enigma/cmd/mbox"
+	pst "github.com/mooijtech/go-pst/v6/pkg"
+	"github.com/mooijtech/go-pst/v6/pkg/properties"
+	"github.com/rotisserie/eris"
+)
+
+// readPST lists the subjects in each folder of the PST at path, keyed by folder path
+func readPST(t *testing.T, path string) map[string][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pstFile, err := pst.New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pstFile.Cleanup()
+	subjects := map[string][]string{}
+	err = pstFile.WalkFolders(func(folder *pst.Folder) error {
+		it, err := folder.GetMessageIterator()
+		if eris.Is(err, pst.ErrMessagesNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for it.Next() {
+			if m, ok := it.Value().Properties.(*properties.Message); ok {
+				subjects[folder.Name] = append(subjects[folder.Name], m.GetSubject())
+			}
+		}
+		return it.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subjects
+}
+
+func TestWritePST(t *testing.T) {
+	custodianDir := mkCustodian(t)
+	pstPath := filepath.Join(custodianDir, "alice.pst")
+	count, err := WritePST(custodianDir, pstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 message, but got %d", count)
+	}
+	if subjects := readPST(t, pstPath); !reflect.DeepEqual(subjects["Inbox"], []string{"secret"}) {
+		t.Errorf("Unexpected folders and subjects %v", subjects)
+	}
+}
+
+// go-pst is lenient, so the PST is also read back with readpst from libpst when it is installed
+func TestWritePSTReadpst(t *testing.T) {
+	readpst, err := exec.LookPath("readpst")
+	if err != nil {
+		t.Skip("readpst is needed to read the PST back with libpst")
+	}
+	custodianDir := mkCustodian(t)
+	pstPath := filepath.Join(custodianDir, "alice.pst")
+	if _, err := WritePST(custodianDir, pstPath); err != nil {
+		t.Fatal(err)
+	}
+	unpack := t.TempDir()
+	if out, err := exec.Command(readpst, "-o", unpack, "-t", "e", "-e", pstPath).CombinedOutput(); err != nil {
+		t.Fatalf("readpst failed: %v\n%s", err, out)
+	}
+	emls := map[string]string{}
+	err = filepath.WalkDir(unpack, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".eml" {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		emls[filepath.ToSlash(path)] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emls) != 1 {
+		t.Fatalf("Expected readpst to extract 1 message, but got %v", emls)
+	}
+	for path, eml := range emls {
+		if !strings.Contains(path, "/mail.pst/Inbox/") || !strings.Contains(eml, "Subject: secret") {
+			t.Errorf("Expected the secret message in mail.pst/Inbox, but got %s\n%s", path, eml)
+		}
+	}
+}
+
+// and checked with pffinfo from libpff when it is installed
+func TestWritePSTPffinfo(t *testing.T) {
+	pffinfo, err := exec.LookPath("pffinfo")
+	if err != nil {
+		t.Skip("pffinfo is needed to read the PST back with libpff")
+	}
+	custodianDir := mkCustodian(t)
+	pstPath := filepath.Join(custodianDir, "alice.pst")
+	if _, err := WritePST(custodianDir, pstPath); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(pffinfo, pstPath).CombinedOutput(); err != nil {
+		t.Errorf("pffinfo failed: %v\n%s", err, out)
+	}
+}
+
+func TestWritePSTMbox(t *testing.T) {
+	custodianDir := filepath.Join(t.TempDir(), "alice")
+	if err := os.MkdirAll(filepath.Join(custodianDir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(custodianDir, "alice.mbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw := mbox.NewWriter(f, 0)
+	success := "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tStatus\tIndex\tOffset\tCiphertext\n"
+	for i, subject := range []string{"first", "second"} {
+		msg := strings.Replace(testMsg, "Subject: secret", "Subject: "+subject, 1)
+		offset, err := mw.Write([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		success += fmt.Sprintf("ct/alice/archive.mbox#%d\t\t\t\t\t%s\t\t\t\tsuccess\t%d\t%d\t\n", i*100, subject, i+1, offset)
+	}
+	f.Close()
+	err = os.WriteFile(filepath.Join(custodianDir, "logs", "success.tsv"), []byte(success), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pstPath := filepath.Join(custodianDir, "alice.pst")
+	if _, err := WritePST(custodianDir, pstPath); err != nil {
+		t.Fatal(err)
+	}
+	if subjects := readPST(t, pstPath); !reflect.DeepEqual(subjects["archive.mbox"], []string{"first", "second"}) {
+		t.Errorf("Unexpected folders and subjects %v", subjects)
+	}
+}
+
+func TestPSTFolder(t *testing.T) {
+	for target, want := range map[string][]string{
+		"ct/alice/mail.pst/Inbox/Sub/12.eml":     {"mail.pst", "Inbox", "Sub"},
+		"ct/alice/cache.ost/Inbox/3.eml":         {"cache.ost", "Inbox"},
+		"ct/alice/mail.pst/Case #12/Inbox/4.eml": {"mail.pst", "Case #12", "Inbox"},
+		"ct/alice/Case #12/note.msg":             {"Case #12"},
+		"ct/alice/archive.mbox#1024":             {"archive.mbox"},
+		"ct/alice/loose/note.msg":                {"loose"},
+		"note.eml":                               {"Deciphered"},
+	} {
+		if got := pstFolder(target); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, but got %v", target, want, got)
+		}
+	}
+}
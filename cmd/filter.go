@@ -0,0 +1,61 @@
+/*
+Copyright © 2024 McFlip <grady.c.denton@yahoo.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/package cmd
+
+import (
+	"log"
+
+	"github.com/McFlip/enigma/cmd/filter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// filterFlags are the scope filters shared by getheaders, getSigs and decipher, by config key
+var filterFlags = []struct{ key, flag, usage string }{
+	{"fromDate", "from-date", "only messages sent on or after this date, YYYY-MM-DD"},
+	{"toDate", "to-date", "only messages sent on or before this date, YYYY-MM-DD"},
+	{"folder", "folder", "only messages in folders matching this glob, ex. 'Sent*' or 'Inbox/*'. mbox and msg input has no folders and is kept"},
+	{"sender", "sender", "only messages whose sender name or address matches this regex"},
+	{"recipient", "recipient", "only messages with a recipient name or address matching this regex"},
+}
+
+// addFilterFlags adds the scope filters to cmd
+func addFilterFlags(cmd *cobra.Command) {
+	for _, f := range filterFlags {
+		cmd.PersistentFlags().String(f.flag, "", f.usage)
+	}
+}
+
+// scopeFilter reads the filter section of the config, overridden by the flags of the running command.
+// The flags are bound here rather than in init because every command shares the same config keys.
+func scopeFilter(cmd *cobra.Command) filter.Criteria {
+	values := make([]string, len(filterFlags))
+	for i, f := range filterFlags {
+		viper.BindPFlag("filter."+f.key, cmd.Flags().Lookup(f.flag))
+		values[i] = viper.GetString("filter." + f.key)
+	}
+	criteria, err := filter.Parse(values[0], values[1], values[2], values[3], values[4])
+	if err != nil {
+		log.Fatal(err)
+	}
+	return criteria
+}
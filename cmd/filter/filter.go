@@ -0,0 +1,210 @@
+// Scope a run to the date range, folders, senders and recipients named in a discovery request.
+// Every message left out is counted against the filter that excluded it, so the scope can be defended.
+package filter
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DateLayout is how from and to dates are given, ex. 2020-04-17
+const DateLayout = "2006-01-02"
+
+// Criteria are the filters a message must pass. Zero values match everything.
+type Criteria struct {
+	// From and To bound the date sent. To covers the whole of its day.
+	From, To time.Time
+	// Folder is a glob matched against the folder name and the folder path, ex. Sent* or Inbox/*
+	Folder string
+	// Sender and Recipient are matched against each name and address
+	Sender, Recipient *regexp.Regexp
+}
+
+// Parse reads the criteria as they are configured. Empty strings leave a filter off.
+func Parse(fromDate, toDate, folder, sender, recipient string) (Criteria, error) {
+	var c Criteria
+	var err error
+	if fromDate != "" {
+		if c.From, err = time.Parse(DateLayout, fromDate); err != nil {
+			return c, fmt.Errorf("from-date must be YYYY-MM-DD: %w", err)
+		}
+	}
+	if toDate != "" {
+		if c.To, err = time.Parse(DateLayout, toDate); err != nil {
+			return c, fmt.Errorf("to-date must be YYYY-MM-DD: %w", err)
+		}
+	}
+	if !c.From.IsZero() && !c.To.IsZero() && c.To.Before(c.From) {
+		return c, fmt.Errorf("to-date %s is before from-date %s", toDate, fromDate)
+	}
+	if folder != "" {
+		if _, err := path.Match(folder, ""); err != nil {
+			return c, fmt.Errorf("bad folder glob %q: %w", folder, err)
+		}
+		c.Folder = folder
+	}
+	if sender != "" {
+		if c.Sender, err = regexp.Compile(sender); err != nil {
+			return c, fmt.Errorf("bad sender regex: %w", err)
+		}
+	}
+	if recipient != "" {
+		if c.Recipient, err = regexp.Compile(recipient); err != nil {
+			return c, fmt.Errorf("bad recipient regex: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Empty is true when no filter is set
+func (c Criteria) Empty() bool {
+	return c.From.IsZero() && c.To.IsZero() && c.Folder == "" && c.Sender == nil && c.Recipient == nil
+}
+
+// Message is what the filters look at
+type Message struct {
+	// Folder is the folder path inside the mailbox, / separated
+	Folder string
+	// NoFolders is set for input that has no folders, such as mbox and .msg, so the folder filter doesn't apply
+	NoFolders bool
+	// Date sent, zero when unknown
+	Date time.Time
+	// Sender and Recipients are names and addresses, in any order
+	Sender, Recipients []string
+}
+
+// Reasons a message is left out, in the order they are checked
+const (
+	ReasonUndated   = "undated"
+	ReasonFromDate  = "from-date"
+	ReasonToDate    = "to-date"
+	ReasonFolder    = "folder"
+	ReasonSender    = "sender"
+	ReasonRecipient = "recipient"
+)
+
+// NoFolder counts the messages kept without a folder filter check because their input has no folders.
+// They are also counted as kept.
+const NoFolder = "no-folder"
+
+// Filter applies Criteria and keeps count. It is safe for concurrent use.
+// A nil Filter keeps every message.
+type Filter struct {
+	Criteria
+	mu       sync.Mutex
+	kept     int
+	noFolder int
+	excluded map[string]int
+}
+
+func New(c Criteria) *Filter {
+	return &Filter{Criteria: c, excluded: map[string]int{}}
+}
+
+// Keep reports whether m is in scope, and counts it as kept or against the first filter it fails
+func (f *Filter) Keep(m Message) bool {
+	if f == nil {
+		return true
+	}
+	reason := f.reason(m)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if reason != "" {
+		f.excluded[reason]++
+		return false
+	}
+	f.kept++
+	if f.Folder != "" && m.NoFolders {
+		f.noFolder++
+	}
+	return true
+}
+
+func (f *Filter) reason(m Message) string {
+	switch {
+	case (!f.From.IsZero() || !f.To.IsZero()) && m.Date.IsZero():
+		// a message without a date can't be shown to be in range
+		return ReasonUndated
+	case !f.From.IsZero() && m.Date.Before(f.From):
+		return ReasonFromDate
+	case !f.To.IsZero() && !m.Date.Before(f.To.AddDate(0, 0, 1)):
+		return ReasonToDate
+	case f.Folder != "" && !m.NoFolders && !MatchFolder(f.Folder, m.Folder):
+		return ReasonFolder
+	case f.Sender != nil && !matchAny(f.Sender, m.Sender):
+		return ReasonSender
+	case f.Recipient != nil && !matchAny(f.Recipient, m.Recipients):
+		return ReasonRecipient
+	}
+	return ""
+}
+
+// MatchFolder reports whether glob matches the folder's name or its path, ex. Sent* or Inbox/*.
+// A message with no folder matches no glob.
+func MatchFolder(glob, folder string) bool {
+	if folder == "" {
+		return false
+	}
+	folder = strings.Trim(folder, "/")
+	for _, name := range []string{folder, path.Base(folder)} {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if v != "" && re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary is the scope of the run as a TSV, each filter with its setting and the number of messages it excluded,
+// then the number kept. With a folder filter, the messages kept from input without folders are counted too.
+func (f *Filter) Summary() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("Filter\tSetting\tCount\n")
+	row := func(name, setting string) {
+		b.WriteString(fmt.Sprintf("%s\t%s\t%d\n", name, setting, f.excluded[name]))
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		row(ReasonUndated, "")
+	}
+	if !f.From.IsZero() {
+		row(ReasonFromDate, f.From.Format(DateLayout))
+	}
+	if !f.To.IsZero() {
+		row(ReasonToDate, f.To.Format(DateLayout))
+	}
+	if f.Folder != "" {
+		row(ReasonFolder, f.Folder)
+		b.WriteString(fmt.Sprintf("%s\t\t%d\n", NoFolder, f.noFolder))
+	}
+	if f.Sender != nil {
+		row(ReasonSender, f.Sender.String())
+	}
+	if f.Recipient != nil {
+		row(ReasonRecipient, f.Recipient.String())
+	}
+	b.WriteString(fmt.Sprintf("kept\t\t%d\n", f.kept))
+	return b.String()
+}
+
+// WriteSummary writes Summary to path. Nothing is written for a nil Filter or one with no criteria.
+func (f *Filter) WriteSummary(path string) error {
+	if f == nil || f.Empty() {
+		return nil
+	}
+	return os.WriteFile(path, []byte(f.Summary()), 0644)
+}
@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeep(t *testing.T) {
+	c, err := Parse("2020-04-01", "2020-04-30", "Sent*", `@local$`, `(?i)smith`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New(c)
+	in := Message{
+		Folder:     "Top of Outlook data file/Sent Items",
+		Date:       time.Date(2020, 4, 30, 23, 59, 0, 0, time.UTC),
+		Sender:     []string{"Jones, Ann", "ann.jones@local"},
+		Recipients: []string{"Smith, John", "john.smith@remote"},
+	}
+	for _, test := range []struct {
+		name     string
+		change   func(m *Message)
+		expected bool
+	}{
+		{"in scope", func(m *Message) {}, true},
+		{"undated", func(m *Message) { m.Date = time.Time{} }, false},
+		{"too early", func(m *Message) { m.Date = time.Date(2020, 3, 31, 23, 59, 0, 0, time.UTC) }, false},
+		{"too late", func(m *Message) { m.Date = time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC) }, false},
+		{"other folder", func(m *Message) { m.Folder = "Inbox" }, false},
+		{"no folder", func(m *Message) { m.Folder = "" }, false},
+		{"input without folders", func(m *Message) { m.Folder, m.NoFolders = "", true }, true},
+		{"other sender", func(m *Message) { m.Sender = []string{"ann@remote"} }, false},
+		{"other recipient", func(m *Message) { m.Recipients = []string{"Doe, Jane"} }, false},
+	} {
+		m := in
+		test.change(&m)
+		if got := f.Keep(m); got != test.expected {
+			t.Errorf("%s: expected %t, but got %t", test.name, test.expected, got)
+		}
+	}
+	expected := "Filter\tSetting\tCount\n" +
+		"undated\t\t1\n" +
+		"from-date\t2020-04-01\t1\n" +
+		"to-date\t2020-04-30\t1\n" +
+		"folder\tSent*\t2\n" +
+		"no-folder\t\t1\n" +
+		"sender\t@local$\t1\n" +
+		"recipient\t(?i)smith\t1\n" +
+		"kept\t\t2\n"
+	if f.Summary() != expected {
+		t.Errorf("Expected\n%s\n but got\n%s", expected, f.Summary())
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, args := range [][]string{
+		{"04/01/2020", "", "", "", ""},
+		{"2020-04-30", "2020-04-01", "", "", ""},
+		{"", "", "[", "", ""},
+		{"", "", "", "(", ""},
+	} {
+		if _, err := Parse(args[0], args[1], args[2], args[3], args[4]); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+	c, err := Parse("", "", "", "", "")
+	if err != nil || !c.Empty() {
+		t.Errorf("Expected empty criteria, but got %+v %v", c, err)
+	}
+	var f *Filter
+	if !f.Keep(Message{}) {
+		t.Error("Expected a nil filter to keep everything")
+	}
+}
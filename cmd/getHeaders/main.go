@@ -0,0 +1,763 @@
+// Parse header metadata out of PST, OST, mbox and Outlook .msg files into a tab delimited report per custodian.
+// Emails attached to other emails are reported too, to any depth, each row after the row of its parent.
+package getheaders
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/McFlip/enigma/cmd/decipher"
+	"github.com/McFlip/enigma/cmd/filter"
+	"github.com/McFlip/enigma/cmd/mbox"
+	"github.com/McFlip/enigma/cmd/outlook"
+	pst "github.com/mooijtech/go-pst/v6/pkg"
+	"github.com/mooijtech/go-pst/v6/pkg/properties"
+	"github.com/rotisserie/eris"
+	"golang.org/x/text/encoding"
+
+	charsets "github.com/emersion/go-message/charset"
+)
+
+const tsvHeader = "PstFile\tFolder\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tHasAttachments\tIsEncrypted\tAttachmentFileNames\tID\tParentID\tDepth" +
+	"\tSMTPFrom\tSMTPTo\tSMTPCc\tReceived\tReturn-Path\tX-Originating-IP\tContent-Type\tRecipients\tSMIMEType\n"
+
+// Options for GetHeaders
+type Options struct {
+	// MboxVariant selects how "From " lines in mbox input are unescaped. Defaults to mboxrd.
+	MboxVariant mbox.Variant
+	// RawHeaders writes the transport header block of each message to transportHeaders.jsonl next to the report.
+	RawHeaders bool
+	// Workers is how many files are read at once, each with its own reader. Defaults to the number of CPUs.
+	Workers int
+	// Filter scopes the report. Each custodian's filterSummary.tsv counts the messages left out.
+	Filter filter.Criteria
+}
+
+// headerRow is one line of headerMetaData.tsv.
+// id locates the message in its file, ex. TEST.pst#2097188 or mail.mbox#0. A message attached to another
+// has the id of its parent plus /n for the nth attachment, its parent's id in parentID, and depth 1 more than its parent.
+type headerRow struct {
+	pstFile, folder, from, to, cc, bcc, subj, date, messageId string
+	hasAttach, isEncrypted                                    bool
+	attachments                                               []string
+	id, parentID                                              string
+	depth                                                     int
+	transport                                                 transportFields
+	rawHeaders                                                string
+	recipients                                                []outlook.Recipient
+	smime                                                     string
+	sent                                                      time.Time // zero when unknown
+	noFolders                                                 bool      // mbox and msg input has no folders
+}
+
+// child is the row template for the message in attachment i of r
+func (r headerRow) child(i int) headerRow {
+	return headerRow{
+		pstFile:   r.pstFile,
+		folder:    r.folder,
+		id:        fmt.Sprintf("%s/%d", r.id, i),
+		parentID:  r.id,
+		depth:     r.depth + 1,
+		noFolders: r.noFolders,
+	}
+}
+
+func (r headerRow) String() string {
+	var b strings.Builder
+	for _, field := range []string{r.pstFile, r.folder, r.from, r.to, r.cc, r.bcc, printable(r.subj), r.date, r.messageId} {
+		b.WriteString(field)
+		b.WriteRune('\t')
+	}
+	b.WriteString(fmt.Sprintf("%t\t%t\t", r.hasAttach, r.isEncrypted))
+	for _, attachmentName := range r.attachments {
+		b.WriteString(attachmentName)
+		b.WriteRune(';')
+	}
+	b.WriteString(fmt.Sprintf("\t%s\t%s\t%d", r.id, r.parentID, r.depth))
+	t := r.transport
+	for _, field := range []string{t.from, t.to, t.cc, t.received, t.returnPath, t.originatingIP, t.contentType} {
+		b.WriteRune('\t')
+		b.WriteString(printable(field))
+	}
+	b.WriteRune('\t')
+	b.WriteString(printable(formatRecipients(r.recipients)))
+	b.WriteRune('\t')
+	b.WriteString(r.smime)
+	b.WriteRune('\n')
+	return b.String()
+}
+
+// scope is what the filters look at in the row
+func (r headerRow) scope() filter.Message {
+	m := filter.Message{
+		Folder:     r.folder,
+		NoFolders:  r.noFolders,
+		Date:       r.sent,
+		Sender:     []string{r.from, r.transport.from},
+		Recipients: []string{r.to, r.cc, r.bcc},
+	}
+	for _, recipient := range r.recipients {
+		m.Recipients = append(m.Recipients, recipient.Name, recipient.Address)
+	}
+	return m
+}
+
+// subject string has non-printable characters causing problems in Excel when opening csv
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func GetHeaders(inDir, outDir string, opts Options) {
+	pst.ExtendCharsets(func(name string, enc encoding.Encoding) {
+		charsets.RegisterEncoding(name, enc)
+	})
+
+	// Walk the input first, so files can be read in parallel while rows are still reported in walk order
+	var custodianOut string
+	var custodianFilter *filter.Filter
+	var jobs []*job
+	summaries := map[string]*filter.Filter{}
+	// a file that can't be read is reported in its custodian's errors.tsv, the other files are still read
+	fileErrors := map[string][]fileError{}
+	var custodians []string
+	filepath.Walk(inDir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if info.IsDir() {
+			// Processing custodian folder
+			// for custodian input dir create custodian output dir
+			base := filepath.Base(path)
+			if base == inDir {
+				return nil
+			}
+			custodianOut = filepath.Join(outDir, base)
+			err := os.Mkdir(custodianOut, 0755)
+			if err != nil {
+				log.Fatal(
+					"Error making custodian subfolder in header_out outpath ",
+					custodianOut,
+					" err: ",
+					err,
+				)
+			}
+			startReport(custodianOut, opts.RawHeaders)
+			custodians = append(custodians, custodianOut)
+			custodianFilter = nil
+			if !opts.Filter.Empty() {
+				custodianFilter = filter.New(opts.Filter)
+				summaries[custodianOut] = custodianFilter
+			}
+			return nil
+		}
+
+		// Processing custodian PST, OST, msg and mbox files
+		if !mbox.IsMbox(path) && !strings.EqualFold(filepath.Ext(info.Name()), ".msg") {
+			if _, err := outlook.OpenStore(path); errors.Is(err, outlook.ErrNotStore) {
+				fileErrors[custodianOut] = append(fileErrors[custodianOut],
+					fileError{path, errors.New("not a pst, ost, msg or mbox file")})
+				return nil
+			} else if err != nil {
+				fileErrors[custodianOut] = append(fileErrors[custodianOut], fileError{path, err})
+				return nil
+			}
+		}
+		jobs = append(jobs, &job{
+			path:         path,
+			name:         info.Name(),
+			custodianOut: custodianOut,
+			filter:       custodianFilter,
+			done:         make(chan struct{}),
+		})
+		return nil
+	})
+
+	// each worker opens its own reader on the file it is given
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	queue := make(chan *job)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range queue {
+				j.run(opts)
+				close(j.done)
+			}
+		}()
+	}
+	go func() {
+		for _, j := range jobs {
+			queue <- j
+		}
+		close(queue)
+	}()
+	for _, j := range jobs {
+		<-j.done
+		for _, err := range j.messageErrs {
+			fileErrors[j.custodianOut] = append(fileErrors[j.custodianOut], fileError{j.path, err})
+		}
+		// the rows read before an error are kept, the error says the file wasn't read to the end
+		if j.err != nil {
+			fileErrors[j.custodianOut] = append(fileErrors[j.custodianOut], fileError{j.path, j.err})
+		}
+		if err := j.merge(); err != nil {
+			fileErrors[j.custodianOut] = append(fileErrors[j.custodianOut],
+				fileError{j.path, fmt.Errorf("can't write results: %w", err)})
+		}
+	}
+	for _, custodianOut := range custodians {
+		errs := fileErrors[custodianOut]
+		if len(errs) > 0 {
+			log.Printf("%d errors reading the files in %s, see %s\n", len(errs), custodianOut, errorReport)
+		}
+		errorsPath := filepath.Join(custodianOut, errorReport)
+		if err := writeErrors(errorsPath, errs); err != nil {
+			log.Fatalf("Can't write %s: %v", errorsPath, err)
+		}
+	}
+	for custodianOut, custodianFilter := range summaries {
+		summaryPath := filepath.Join(custodianOut, filterSummary)
+		if err := custodianFilter.WriteSummary(summaryPath); err != nil {
+			log.Fatalf("Can't write %s: %v", summaryPath, err)
+		}
+	}
+}
+
+// startReport creates the custodian's headerMetaData.tsv, and transportHeaders.jsonl when raw headers are kept
+func startReport(custodianOut string, rawHeaders bool) {
+	logPath := filepath.Join(custodianOut, headerMetaData)
+	if _, err := os.Stat(logPath); errors.Is(err, os.ErrNotExist) {
+		// TSV header
+		if err := os.WriteFile(logPath, []byte(tsvHeader), 0644); err != nil {
+			log.Fatalf("Can't open log file %s to write results", logPath)
+		}
+	}
+	if rawHeaders {
+		headersPath := filepath.Join(custodianOut, transportHeaders)
+		headersFile, err := os.OpenFile(headersPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("Can't open %s to write raw headers", headersPath)
+		}
+		headersFile.Close()
+	}
+}
+
+const (
+	headerMetaData   = "headerMetaData.tsv"
+	transportHeaders = "transportHeaders.jsonl"
+	filterSummary    = "filterSummary.tsv"
+	errorReport      = "errors.tsv"
+)
+
+// fileError is a row of errors.tsv, an input file that couldn't be read to the end or a message in it that was
+// only partly read
+type fileError struct {
+	path string
+	err  error
+}
+
+// writeErrors writes errors.tsv, a row per error in walk order. Multi line errors from go-pst are kept on 1 row.
+func writeErrors(path string, errs []fileError) error {
+	sort.SliceStable(errs, func(i, k int) bool { return errs[i].path < errs[k].path })
+	var b strings.Builder
+	b.WriteString("File\tError\n")
+	for _, e := range errs {
+		b.WriteString(e.path + "\t" + strings.Join(strings.Fields(fmt.Sprintf("%v", e.err)), " ") + "\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// job is one input file. Workers spool its rows to part files in the custodian's output dir,
+// so memory stays bounded by the number of workers, then the parts are appended to the report in walk order.
+type job struct {
+	path, name, custodianOut string
+	filter                   *filter.Filter
+	tsvPart, headersPart     string
+	err                      error
+	messageErrs              []error
+	done                     chan struct{}
+}
+
+func (j *job) run(opts Options) {
+	// go-pst can panic on a corrupt file, which is an error of this file only
+	defer func() {
+		if p := recover(); p != nil {
+			j.err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	tsv, err := os.CreateTemp(j.custodianOut, headerMetaData+".*.part")
+	if err != nil {
+		j.err = err
+		return
+	}
+	defer tsv.Close()
+	j.tsvPart = tsv.Name()
+	tsvWriter := bufio.NewWriter(tsv)
+	defer tsvWriter.Flush()
+	out := &report{tsv: tsvWriter, filter: j.filter}
+	defer func() { j.messageErrs = out.errs }()
+	if opts.RawHeaders {
+		headers, err := os.CreateTemp(j.custodianOut, transportHeaders+".*.part")
+		if err != nil {
+			j.err = err
+			return
+		}
+		defer headers.Close()
+		j.headersPart = headers.Name()
+		headersWriter := bufio.NewWriter(headers)
+		defer headersWriter.Flush()
+		out.headers = json.NewEncoder(headersWriter)
+	}
+	j.err = processFile(j.path, j.name, opts.MboxVariant, out)
+}
+
+// merge appends the job's part files to the custodian's report and removes them, even when appending fails
+func (j *job) merge() error {
+	var errs []error
+	for _, part := range []struct{ path, dst string }{
+		{j.tsvPart, headerMetaData},
+		{j.headersPart, transportHeaders},
+	} {
+		if part.path == "" {
+			continue
+		}
+		if err := appendFile(filepath.Join(j.custodianOut, part.dst), part.path); err != nil {
+			errs = append(errs, err)
+		}
+		if err := os.Remove(part.path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// processFile writes the rows for one PST, OST, msg or mbox file
+func processFile(path, name string, variant mbox.Variant, out *report) error {
+	if mbox.IsMbox(path) {
+		if err := processMbox(path, name, variant, out); err != nil {
+			return fmt.Errorf("failed to read mbox: %w", err)
+		}
+		return nil
+	}
+	if strings.EqualFold(filepath.Ext(name), ".msg") {
+		rows, err := msgRows(path, name)
+		if err != nil {
+			return fmt.Errorf("failed to read msg file: %w", err)
+		}
+		for _, row := range rows {
+			out.write(row)
+		}
+		return nil
+	}
+	if err := processPST(path, name, out); err != nil {
+		return fmt.Errorf("failed to walk folders: %w", err)
+	}
+	return nil
+}
+
+// report is where a custodian's rows go
+type report struct {
+	tsv     io.Writer
+	headers *json.Encoder  // nil unless raw headers are kept
+	filter  *filter.Filter // nil keeps every row
+	skip    bool           // the last top level message was filtered out
+	errs    []error        // messages that were only partly read, the rest of the file still is
+}
+
+func (r *report) errorf(format string, a ...any) {
+	r.errs = append(r.errs, fmt.Errorf(format, a...))
+}
+
+// rawHeaders is one line of transportHeaders.jsonl, tied to its row by ID
+type rawHeaders struct {
+	ID      string
+	Headers string
+}
+
+func (r *report) write(row headerRow) {
+	// attached messages are in or out with the message they are attached to
+	if row.depth == 0 {
+		r.skip = !r.filter.Keep(row.scope())
+	}
+	if r.skip {
+		return
+	}
+	io.WriteString(r.tsv, row.String())
+	if r.headers != nil && row.rawHeaders != "" {
+		r.headers.Encode(rawHeaders{ID: row.id, Headers: row.rawHeaders})
+	}
+}
+
+// processPST writes a row for each message in the PST at path
+func processPST(path, name string, out *report) error {
+	// open file; create reader
+	reader, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open PST file: %w", err)
+	}
+	defer reader.Close()
+	pstFile, err := pst.New(reader)
+	if err != nil {
+		return fmt.Errorf("failed to open PST file: %w", err)
+	}
+	defer pstFile.Cleanup()
+
+	// Walk through the folders of the mailbox. Folder is the path below the top, the same path readpst unpacks to.
+	return outlook.WalkMailbox(pstFile, func(folder *pst.Folder, folderPath string) error {
+		fmt.Printf("Walking folder: %s in %s\n", folderPath, name)
+
+		messageIterator, err := folder.GetMessageIterator()
+
+		if eris.Is(err, pst.ErrMessagesNotFound) {
+			// Folder has no messages.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Iterate through messages.
+		for messageIterator.Next() {
+			message := messageIterator.Value()
+			row := headerRow{
+				pstFile: name,
+				folder:  folderPath,
+				id:      fmt.Sprintf("%s#%d", name, message.Identifier),
+			}
+			if err := writePSTMessage(out, message, row); err != nil {
+				return err
+			}
+		}
+
+		return messageIterator.Err()
+	})
+}
+
+// writePSTMessage writes the row for message, filled in from the template row, then the rows of any messages embedded in it
+func writePSTMessage(out *report, message *pst.Message, row headerRow) error {
+	// We only care about messages, not calendar items etc.
+	messageProperties, ok := message.Properties.(*properties.Message)
+	if !ok {
+		return nil
+	}
+	row.from = messageProperties.GetSenderName()
+	row.to = messageProperties.GetDisplayTo()
+	row.cc = messageProperties.GetDisplayCc()
+	row.bcc = messageProperties.GetDisplayBcc()
+	row.subj = messageProperties.GetSubject()
+	// Date is encoded as Unix nanosecond timestamp
+	row.date = time.Unix(0, messageProperties.GetClientSubmitTime()).UTC().Format(time.UnixDate)
+	if submitted := messageProperties.GetClientSubmitTime(); submitted != 0 {
+		row.sent = time.Unix(0, submitted).UTC()
+	}
+	row.messageId = messageProperties.GetInternetMessageId()
+	row.hasAttach, _ = message.HasAttachments()
+	row.setTransport(messageProperties.GetTransportMessageHeaders())
+	// a broken recipient table only loses the recipients of this message
+	recipients, err := pstRecipients(message)
+	if err != nil {
+		out.errorf("%s: can't read recipients: %w", row.id, err)
+	}
+	row.recipients = recipients
+
+	localdescriptors := message.LocalDescriptors
+	messageClassPropertyReader, err := message.PropertyContext.GetPropertyReader(26, localdescriptors)
+	if err != nil {
+		return err
+	}
+	messageClass, err := messageClassPropertyReader.GetString()
+	if err != nil {
+		return err
+	}
+	// is this encrypted?
+	row.setSMIME(messageClass, nil)
+
+	attachmentIterator, err := message.GetAttachmentIterator()
+
+	if eris.Is(err, pst.ErrAttachmentsNotFound) {
+		// This message has no attachments.
+		out.write(row)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var children []headerRow
+	var embedded []*pst.Message
+	var parts []smimePart
+	for i := 0; attachmentIterator.Next(); i++ {
+		attachment := attachmentIterator.Value()
+
+		child, err := embeddedMessage(message.File, attachment)
+		if err != nil {
+			return err
+		}
+
+		attachmentName := attachment.GetAttachLongFilename()
+
+		if attachmentName == "" && child != nil {
+			// Outlook names embedded messages by display name only
+			if displayNameReader, err := attachment.PropertyContext.GetPropertyReader(propDisplayName, attachment.LocalDescriptors); err == nil {
+				attachmentName, _ = displayNameReader.GetString()
+			}
+		}
+		if attachmentName == "" {
+			attachmentName = fmt.Sprintf("UNKNOWN_%d", attachment.Identifier)
+		}
+		row.attachments = append(row.attachments, attachmentName)
+
+		if child != nil {
+			children = append(children, row.child(i))
+			embedded = append(embedded, child)
+		} else {
+			parts = append(parts, newSMIMEPart(attachment.GetAttachMimeTag(), attachmentName, attachmentHead(attachment)))
+		}
+	}
+	if attachmentIterator.Err() != nil {
+		return attachmentIterator.Err()
+	}
+	row.setSMIME(messageClass, parts)
+	out.write(row)
+	for i, child := range embedded {
+		if err := writePSTMessage(out, child, children[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	propDisplayName      = 0x3001
+	propAttachDataObject = 0x3701
+	attachEmbeddedMsg    = 5
+)
+
+// attachmentHead reads the start of a file attachment's data, or nothing when it has none
+func attachmentHead(attachment *pst.Attachment) []byte {
+	dataReader, err := attachment.PropertyContext.GetPropertyReader(propAttachDataObject, attachment.LocalDescriptors)
+	if err != nil {
+		return nil
+	}
+	head := make([]byte, cmsHeadSize)
+	if dataReader.Size() < int64(len(head)) {
+		head = head[:dataReader.Size()]
+	}
+	n, _ := dataReader.ReadAt(head, 0)
+	return head[:n]
+}
+
+// embeddedMessage opens the Outlook message stored in attachment, or returns nil when it holds a file.
+// The message is a subnode of the attachment, named by the first 4 bytes of the attachment's data object.
+func embeddedMessage(file *pst.File, attachment *pst.Attachment) (*pst.Message, error) {
+	if attachment.GetAttachMethod() != attachEmbeddedMsg {
+		return nil, nil
+	}
+	objectReader, err := attachment.PropertyContext.GetPropertyReader(propAttachDataObject, attachment.LocalDescriptors)
+	if err != nil {
+		return nil, err
+	}
+	object := make([]byte, 4)
+	if _, err := objectReader.ReadAt(object, 0); err != nil {
+		return nil, err
+	}
+	localDescriptor, err := pst.FindLocalDescriptor(pst.Identifier(binary.LittleEndian.Uint32(object)), attachment.LocalDescriptors)
+	if err != nil {
+		return nil, err
+	}
+	heapOnNode, err := file.GetHeapOnNodeFromLocalDescriptor(localDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	localDescriptors, err := file.GetLocalDescriptorsFromIdentifier(localDescriptor.LocalDescriptorsIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	propertyContext, err := file.GetPropertyContext(heapOnNode)
+	if err != nil {
+		return nil, err
+	}
+	messageProperties := &properties.Message{}
+	if err := propertyContext.Populate(messageProperties, localDescriptors); err != nil {
+		return nil, err
+	}
+	return &pst.Message{
+		File:             file,
+		Identifier:       localDescriptor.Identifier,
+		PropertyContext:  propertyContext,
+		LocalDescriptors: localDescriptors,
+		Properties:       messageProperties,
+	}, nil
+}
+
+// processMbox writes a row for each message in the mbox at path.
+// mbox has no folders, so the message's location is recorded in PstFile as name#offset.
+func processMbox(path, name string, variant mbox.Variant, out *report) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mr := mbox.NewReader(f, variant)
+	for {
+		m, err := mr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		id := fmt.Sprintf("%s#%d", name, m.Offset)
+		rows, err := mimeRows(headerRow{pstFile: id, id: id, noFolders: true}, m.Data)
+		if err != nil {
+			out.errorf("%s: failed to parse message: %w", id, err)
+			continue
+		}
+		for _, row := range rows {
+			out.write(row)
+		}
+	}
+}
+
+// mimeRows builds the row for an RFC822 message, filled in from the template row,
+// followed by the rows of any messages attached to it
+func mimeRows(row headerRow, msgBytes []byte) ([]headerRow, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(msgBytes))
+	if err != nil {
+		return nil, err
+	}
+	dec := mime.WordDecoder{CharsetReader: charsets.Reader}
+	decode := func(key string) string {
+		value, err := dec.DecodeHeader(msg.Header.Get(key))
+		if err != nil {
+			return msg.Header.Get(key)
+		}
+		return value
+	}
+	row.from = decode("From")
+	row.to = decode("To")
+	row.cc = decode("Cc")
+	row.bcc = decode("Bcc")
+	row.subj = decode("Subject")
+	row.date = msg.Header.Get("Date")
+	row.messageId = msg.Header.Get("Message-ID")
+	row.setTransport(headerBlock(msgBytes))
+	row.recipients = mimeRecipients(msg.Header)
+	if date, err := msg.Header.Date(); err == nil {
+		row.date = date.UTC().Format(time.UnixDate)
+		row.sent = date
+	}
+	attachments, err := decipher.Attachments(msgBytes)
+	if err != nil {
+		return nil, err
+	}
+	body := newSMIMEPart(msg.Header.Get("Content-Type"), "", nil)
+	singlePart := !strings.HasPrefix(body.mediaType, "multipart/") && len(attachments) == 1
+	if singlePart {
+		// a single part message is its own attachment
+		body.head = newSMIMEPart("", "", attachments[0].Content).head
+	}
+	parts := []smimePart{body}
+	var nested []headerRow
+	for i, attachment := range attachments {
+		row.attachments = append(row.attachments, attachment.Filename)
+		// readpst style messages carry the envelope as an smime.p7m attachment
+		if !singlePart {
+			parts = append(parts, newSMIMEPart(attachment.ContentType, attachment.Filename, attachment.Content))
+		}
+		if attachment.ContentType == "message/rfc822" {
+			child := row.child(i)
+			children, err := mimeRows(child, attachment.Content)
+			if err != nil {
+				log.Printf("Failed to parse attached message %s: %v\n", child.id, err)
+				continue
+			}
+			nested = append(nested, children...)
+		}
+	}
+	row.hasAttach = len(attachments) > 0
+	row.setSMIME("", parts)
+	return append([]headerRow{row}, nested...), nil
+}
+
+// msgRows reads the rows for an Outlook .msg and the messages embedded in it from their properties,
+// matching what is reported for PST messages
+func msgRows(path, name string) ([]headerRow, error) {
+	m, err := outlook.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return outlookRows(m, headerRow{pstFile: name, id: name, noFolders: true}), nil
+}
+
+func outlookRows(m *outlook.Message, row headerRow) []headerRow {
+	row.from = m.SenderName
+	row.to = m.DisplayTo
+	row.cc = m.DisplayCc
+	row.bcc = m.DisplayBcc
+	row.subj = m.Subject
+	row.messageId = m.MessageID
+	row.hasAttach = len(m.Attachments) > 0
+	var parts []smimePart
+	for _, attachment := range m.Attachments {
+		if attachment.Embedded == nil {
+			parts = append(parts, newSMIMEPart(attachment.MimeTag, attachment.Filename, attachment.Data))
+		}
+	}
+	row.setSMIME(m.Class, parts)
+	row.setTransport(m.TransportHeaders)
+	row.recipients = m.Recipients
+	if !m.Submitted.IsZero() {
+		row.date = m.Submitted.Format(time.UnixDate)
+		row.sent = m.Submitted
+	}
+	var nested []headerRow
+	for i, attachment := range m.Attachments {
+		attachmentName := attachment.Filename
+		if attachmentName == "" {
+			attachmentName = fmt.Sprintf("UNKNOWN_%d", i)
+		}
+		row.attachments = append(row.attachments, attachmentName)
+		if attachment.Embedded != nil {
+			nested = append(nested, outlookRows(attachment.Embedded, row.child(i))...)
+		}
+	}
+	return append([]headerRow{row}, nested...)
+}
@@ -0,0 +1,490 @@
+package getheaders
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/McFlip/enigma/cmd/filter"
+	"github.com/McFlip/enigma/cmd/mbox"
+	"github.com/McFlip/enigma/cmd/outlook"
+)
+
+func TestProcessPST(t *testing.T) {
+	var b bytes.Buffer
+	if err := processPST("../../testdata/pstIn/TEST.pst", "TEST.pst", &report{tsv: &b}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"TEST.pst\tSent Items\tGeneral William C. Lee\t101st Airborne Division\t\t\trendezvous with destiny\tWed Aug 19 01:00:00 UTC 1942\t\ttrue\tfalse\tUNKNOWN_32805;\tTEST.pst#2097220\t\t0" +
+			"\tsender@local\trecip@local\t\t\t\t\tmultipart/signed; protocol=\"application/pkcs7-signature\"; micalg=\"sha-256\"; boundary=\"----996C6A47152AA7127C5091123919F9B1\"" +
+			"\tTo: 101st Airborne Division <recip@local>\tclear-signed",
+		"TEST.pst\tInbox\tRonald Reagan\tUSA\t\t\trendezvous with destiny and the final ultimatum\tTue Oct 27 01:16:44 UTC 1964\t\tfalse\tfalse\t\tTEST.pst#2097188\t\t0" +
+			"\tsender@local\trecip@local\t\t\t\t\ttext/plain; charset=\"iso-8859-1\"\tTo: USA <recip@local>\tnone",
+		"TEST.pst\tInbox/buried/deep/down\tGeneral von Luttwitz\tBrig. Gen. Anthony C. McAuliffe\t\t\tRE: the final ultimatum\tSat Jan 22 17:01:00 UTC 1944\t\ttrue\ttrue\tsmime.p7m;\tTEST.pst#2097252\t\t0" +
+			"\tzee.Germans@local\tda.Muricans@local\t\t\t\t\tapplication/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"" +
+			"\tTo: Brig. Gen. Anthony C. McAuliffe <da.Muricans@local>\tencrypted",
+	}
+	actual := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %d rows, but got\n%s", len(expected), b.String())
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("Expected\n%q\n but got\n%q", expected[i], actual[i])
+		}
+	}
+}
+
+// an OST has the same layout as a PST, only the client magic in the header differs
+func TestProcessOST(t *testing.T) {
+	data, err := os.ReadFile("../../testdata/pstIn/TEST.pst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[8:10], "SO")
+	path := filepath.Join(t.TempDir(), "TEST.ost")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := outlook.OpenStore(path); err != nil || !s.OST {
+		t.Fatalf("Expected an OST, but got %v %v", s, err)
+	}
+	var b bytes.Buffer
+	if err := processPST(path, "TEST.ost", &report{tsv: &b}); err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.Count(b.String(), "TEST.ost\t"); rows != 3 {
+		t.Errorf("Expected 3 rows, but got\n%s", b.String())
+	}
+}
+
+func TestProcessMbox(t *testing.T) {
+	second := "From b@local Fri Apr 17 17:00:00 2020\n"
+	in := "From a@local Fri Apr 17 16:00:00 2020\n" +
+		"From: =?UTF-8?Q?Caf=C3=A9?= <a@local>\n" +
+		"To: b@local\n" +
+		"Subject: one\n" +
+		"Date: Fri, 17 Apr 2020 12:00:00 -0400\n" +
+		"Message-ID: <1@local>\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: text/plain\n\nbody\n" +
+		"--b1\nContent-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\n" +
+		"Content-Disposition: attachment; filename=\"smime.p7m\"\nContent-Transfer-Encoding: base64\n\nMIAGCSqGSIb3DQEHA6CA\n" +
+		"--b1--\n\n" +
+		second +
+		"From: b@local\nSubject: two\n\n>From here\n"
+	path := filepath.Join(t.TempDir(), "mail.mbox")
+	if err := os.WriteFile(path, []byte(in), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := processMbox(path, "mail.mbox", mbox.MboxRD, &report{tsv: &b}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "mail.mbox#0\t\tCafé <a@local>\tb@local\t\t\tone\tFri Apr 17 16:00:00 UTC 2020\t<1@local>\ttrue\ttrue\tsmime.p7m;\tmail.mbox#0\t\t0" +
+		"\ta@local\tb@local\t\t\t\t\tmultipart/mixed; boundary=\"b1\"\tTo: b@local\tencrypted\n"
+	secondID := fmt.Sprintf("mail.mbox#%d", strings.Index(in, second))
+	expected += secondID + "\t\tb@local\t\t\t\ttwo\t\t\tfalse\tfalse\t\t" + secondID + "\t\t0\tb@local\t\t\t\t\t\t\t\tnone\n"
+	if b.String() != expected {
+		t.Errorf("Expected\n%q\n but got\n%q", expected, b.String())
+	}
+}
+
+func TestProcessMboxBadMessage(t *testing.T) {
+	second := "From b@local Fri Apr 17 17:00:00 2020\n"
+	in := "From a@local Fri Apr 17 16:00:00 2020\nnot a header\n\nbody\n\n" + second + "From: b@local\nSubject: two\n\nbody\n"
+	path := filepath.Join(t.TempDir(), "mail.mbox")
+	if err := os.WriteFile(path, []byte(in), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	out := &report{tsv: &b}
+	if err := processMbox(path, "mail.mbox", mbox.MboxRD, out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.errs) != 1 || !strings.HasPrefix(out.errs[0].Error(), "mail.mbox#0: failed to parse message: ") {
+		t.Errorf("Expected the first message's parse error, but got %v", out.errs)
+	}
+	secondID := fmt.Sprintf("mail.mbox#%d", strings.Index(in, second))
+	if !strings.HasPrefix(b.String(), secondID+"\t") || strings.Count(b.String(), "\n") != 1 {
+		t.Errorf("Expected only the second message's row, but got\n%s", b.String())
+	}
+}
+
+func TestMsgRows(t *testing.T) {
+	rows, err := msgRows("../../testdata/msgIn/TEST.msg", "TEST.msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "TEST.msg\t\tGeneral von Luttwitz\tBrig. Gen. Anthony C. McAuliffe\t\t\tRE: the final ultimatum\tFri Apr 17 16:00:00 UTC 2020\t<ultimatum@local>\ttrue\ttrue\tsmime.p7m;\tTEST.msg\t\t0\t\t\t\t\t\t\t" +
+		"\tTo: Brig. Gen. Anthony C. McAuliffe <rcpt@local>\tencrypted\n"
+	if len(rows) != 1 || rows[0].String() != expected {
+		t.Errorf("Expected\n%q\n but got\n%q", expected, rows)
+	}
+}
+
+func TestProcessPSTEmbedded(t *testing.T) {
+	inner := &outlook.Message{
+		Class:       "IPM.Note.SMIME",
+		Subject:     "the final ultimatum",
+		SenderName:  "General von Luttwitz",
+		Attachments: []outlook.Attachment{{Filename: "smime.p7m", MimeTag: "application/pkcs7-mime", Data: envelopedHead}},
+	}
+	middle := &outlook.Message{
+		Subject:     "FW: the final ultimatum",
+		SenderName:  "Brig. Gen. Anthony C. McAuliffe",
+		Attachments: []outlook.Attachment{{Embedded: inner}},
+	}
+	outer := &outlook.Message{
+		Subject:    "FW: FW: the final ultimatum",
+		SenderName: "Ronald Reagan",
+		Recipients: []outlook.Recipient{
+			{Type: outlook.RecipientTo, Name: "Smith, John", Address: "john.smith@local"},
+			{Type: outlook.RecipientCc, Address: "jane@local"},
+			{Type: outlook.RecipientBcc, Name: "Records", Address: "records@local"},
+		},
+		Attachments: []outlook.Attachment{
+			{Filename: "notes.txt", Data: []byte("nuts")},
+			{Filename: "forward.msg", Embedded: middle},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "nested.pst")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := outlook.NewPSTWriter(f, "nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddMessage([]string{"Inbox"}, outer); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var b bytes.Buffer
+	if err := processPST(path, "nested.pst", &report{tsv: &b}); err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, but got\n%s", b.String())
+	}
+	outerID := strings.Split(rows[0], "\t")[12]
+	for i, expected := range []string{
+		"\tRonald Reagan\tSmith, John\tjane@local\tRecords\tFW: FW: the final ultimatum\t",
+		"\tBrig. Gen. Anthony C. McAuliffe\t\t\t\tFW: the final ultimatum\t",
+		"\tGeneral von Luttwitz\t\t\t\tthe final ultimatum\t",
+	} {
+		if !strings.HasPrefix(rows[i], "nested.pst\tInbox"+expected) {
+			t.Errorf("Expected row %d to start with %q, but got %q", i, expected, rows[i])
+		}
+	}
+	for i, expected := range []string{
+		"\tfalse\tnotes.txt;forward.msg;\t" + outerID + "\t\t0\t\t\t\t\t\t\t\t" +
+			"To: Smith, John <john.smith@local>; Cc: jane@local; Bcc: Records <records@local>",
+		"\ttrue\tfalse\tthe final ultimatum;\t",
+		"\ttrue\tsmime.p7m;\t" + outerID + "/1/0\t" + outerID + "/1\t2\t\t\t\t\t\t\t\t\tencrypted",
+	} {
+		if !strings.Contains(rows[i], expected) {
+			t.Errorf("Expected row %d to contain %q, but got %q", i, expected, rows[i])
+		}
+	}
+	if !strings.HasSuffix(rows[1], "\t"+outerID+"/1\t"+outerID+"\t1\t\t\t\t\t\t\t\t\tnone") {
+		t.Errorf("Unexpected ids in %q", rows[1])
+	}
+}
+
+func TestMimeRowsNested(t *testing.T) {
+	in := "From: a@local\r\nSubject: FW: one\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n" +
+		"--b1\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+		"--b1\r\nContent-Type: message/rfc822\r\n\r\n" +
+		"From: b@local\r\nSubject: one\r\n" +
+		"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\n\r\nxx\r\n" +
+		"--b1--\r\n"
+	rows, err := mimeRows(headerRow{pstFile: "mail.mbox#0", id: "mail.mbox#0"}, []byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"mail.mbox#0\t\ta@local\t\t\t\tFW: one\t\t\ttrue\tfalse\tmessage.eml;\tmail.mbox#0\t\t0\ta@local\t\t\t\t\t\tmultipart/mixed; boundary=\"b1\"\t\tnone\n",
+		"mail.mbox#0\t\tb@local\t\t\t\tone\t\t\ttrue\ttrue\tsmime.p7m;\tmail.mbox#0/0\tmail.mbox#0\t1" +
+			"\tb@local\t\t\t\t\t\tapplication/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\t\tencrypted\n",
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("Expected %d rows, but got %q", len(expected), rows)
+	}
+	for i := range expected {
+		if rows[i].String() != expected[i] {
+			t.Errorf("Expected\n%q\n but got\n%q", expected[i], rows[i].String())
+		}
+	}
+}
+
+func TestOutlookRowsNested(t *testing.T) {
+	m := &outlook.Message{
+		Subject: "FW: ultimatum",
+		Attachments: []outlook.Attachment{{
+			Filename: "ultimatum.msg",
+			Embedded: &outlook.Message{
+				Class:       "IPM.Note.SMIME",
+				Subject:     "ultimatum",
+				Attachments: []outlook.Attachment{{Filename: "smime.p7m", MimeTag: "application/pkcs7-mime", Data: envelopedHead}},
+			},
+		}},
+	}
+	rows := outlookRows(m, headerRow{pstFile: "fw.msg", id: "fw.msg"})
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, but got %q", rows)
+	}
+	expected := "fw.msg\t\t\t\t\t\tultimatum\t\t\ttrue\ttrue\tsmime.p7m;\tfw.msg/0\tfw.msg\t1\t\t\t\t\t\t\t\t\tencrypted\n"
+	if rows[1].String() != expected || rows[0].isEncrypted {
+		t.Errorf("Expected\n%q\n but got\n%q", expected, rows[1].String())
+	}
+}
+
+func TestFormatRecipients(t *testing.T) {
+	recipients := []outlook.Recipient{
+		{Type: outlook.RecipientTo, Name: "Smith, John", Address: "john.smith@local"},
+		{Type: outlook.RecipientCc, Name: "jane@local", Address: "jane@local"},
+		{Type: outlook.RecipientBcc, Name: "Legacy", Address: "/O=ORG/OU=EXCHANGE/CN=RECIPIENTS/CN=LEGACY"},
+		{Type: outlook.RecipientTo, Name: "Unresolved"},
+	}
+	expected := "To: Smith, John <john.smith@local>; Cc: jane@local; " +
+		"Bcc: Legacy </O=ORG/OU=EXCHANGE/CN=RECIPIENTS/CN=LEGACY>; To: Unresolved"
+	if actual := formatRecipients(recipients); actual != expected {
+		t.Errorf("Expected\n%q\n but got\n%q", expected, actual)
+	}
+}
+
+func TestGetHeadersWorkers(t *testing.T) {
+	pstData, err := os.ReadFile("../../testdata/pstIn/TEST.pst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgData, err := os.ReadFile("../../testdata/msgIn/TEST.msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxData := "From a@local Fri Apr 17 16:00:00 2020\nFrom: a@local\nSubject: one\n\nbody\n"
+
+	// GetHeaders expects relative paths, as given in the config
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	files := map[string][]byte{
+		"header_in/alice/TEST.pst":  pstData,
+		"header_in/alice/TEST.msg":  msgData,
+		"header_in/alice/mail.mbox": []byte(mboxData),
+		"header_in/alice/b.pst":     pstData,
+		"header_in/bob/TEST.ost":    pstData,
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{1, 4} {
+		out := fmt.Sprintf("out%d", workers)
+		if err := os.Mkdir(out, 0755); err != nil {
+			t.Fatal(err)
+		}
+		GetHeaders("header_in", out, Options{MboxVariant: mbox.MboxRD, RawHeaders: true, Workers: workers})
+	}
+	for _, name := range []string{"alice/headerMetaData.tsv", "alice/transportHeaders.jsonl", "bob/headerMetaData.tsv", "bob/transportHeaders.jsonl"} {
+		one, err := os.ReadFile(filepath.Join("out1", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		four, err := os.ReadFile(filepath.Join("out4", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(one, four) {
+			t.Errorf("%s differs with 4 workers:\n%s\nvs 1 worker:\n%s", name, four, one)
+		}
+	}
+
+	// rows are in walk order, file by file
+	tsv, err := os.ReadFile("out4/alice/headerMetaData.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(tsv), tsvHeader) {
+		t.Errorf("Expected the TSV header first, but got\n%s", tsv)
+	}
+	var order []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(tsv), "\n"), "\n")[1:] {
+		file, _, _ := strings.Cut(strings.Split(line, "\t")[0], "#")
+		if len(order) == 0 || order[len(order)-1] != file {
+			order = append(order, file)
+		}
+	}
+	expected := []string{"TEST.msg", "TEST.pst", "b.pst", "mail.mbox"}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected files in order %v, but got %v", expected, order)
+	}
+	parts, _ := filepath.Glob("out4/*/*.part")
+	if len(parts) != 0 {
+		t.Errorf("Expected part files to be removed, but found %v", parts)
+	}
+}
+
+func TestGetHeadersBadFiles(t *testing.T) {
+	pstData, err := os.ReadFile("../../testdata/pstIn/TEST.pst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	// a PST cut short after its header is still recognized as a store, but can't be walked
+	files := map[string][]byte{
+		"header_in/alice/a.pst":     pstData,
+		"header_in/alice/b.pst":     pstData[:len(pstData)/4],
+		"header_in/alice/notes.txt": []byte("not mail"),
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir("out", 0755); err != nil {
+		t.Fatal(err)
+	}
+	GetHeaders("header_in", "out", Options{Workers: 2})
+
+	report, err := os.ReadFile("out/alice/errors.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSuffix(string(report), "\n"), "\n")
+	if len(rows) != 3 || rows[0] != "File\tError" ||
+		!strings.HasPrefix(rows[1], filepath.Join("header_in", "alice", "b.pst")+"\t") ||
+		!strings.HasPrefix(rows[2], filepath.Join("header_in", "alice", "notes.txt")+"\t") {
+		t.Errorf("Expected errors for the truncated PST and the text file, but got\n%s", report)
+	}
+	tsv, err := os.ReadFile("out/alice/headerMetaData.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(tsv), "\na.pst\t") {
+		t.Errorf("Expected the rows of the whole PST, but got\n%s", tsv)
+	}
+	parts, _ := filepath.Glob("out/*/*.part")
+	if len(parts) != 0 {
+		t.Errorf("Expected part files to be removed, but found %v", parts)
+	}
+}
+
+func TestGetHeadersBadRecipients(t *testing.T) {
+	pstData, err := os.ReadFile("../../testdata/pstIn/TEST.pst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the table type of the recipient table of the message in Sent Items
+	pstData[83843] = 0
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.MkdirAll("header_in/alice", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("header_in/alice/a.pst", pstData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("out", 0755); err != nil {
+		t.Fatal(err)
+	}
+	GetHeaders("header_in", "out", Options{})
+
+	tsv, err := os.ReadFile("out/alice/headerMetaData.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSuffix(string(tsv), "\n"), "\n")
+	if len(rows) != 4 || !strings.HasSuffix(rows[1], "\t\tclear-signed") {
+		t.Errorf("Expected every message, the first without recipients, but got\n%s", tsv)
+	}
+	report, err := os.ReadFile("out/alice/errors.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "a.pst\ta.pst#2097220: can't read recipients: ") {
+		t.Errorf("Expected the recipient error of the message, but got\n%s", report)
+	}
+}
+
+func TestProcessPSTFilter(t *testing.T) {
+	criteria, err := filter.Parse("1943-01-01", "", "", "", "(?i)muricans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filter.New(criteria)
+	var b bytes.Buffer
+	if err := processPST("../../testdata/pstIn/TEST.pst", "TEST.pst", &report{tsv: &b, filter: f}); err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(rows) != 1 || !strings.HasPrefix(rows[0], "TEST.pst\tInbox/buried/deep/down\tGeneral von Luttwitz\t") {
+		t.Errorf("Expected only the message to the Muricans, but got\n%s", b.String())
+	}
+	expected := "Filter\tSetting\tCount\nundated\t\t0\nfrom-date\t1943-01-01\t1\nrecipient\t(?i)muricans\t1\nkept\t\t1\n"
+	if f.Summary() != expected {
+		t.Errorf("Expected\n%s\n but got\n%s", expected, f.Summary())
+	}
+}
+
+func TestReportFilterNested(t *testing.T) {
+	criteria, err := filter.Parse("", "", "", "^b@", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	out := &report{tsv: &b, filter: filter.New(criteria)}
+	for _, row := range []headerRow{
+		{id: "a", from: "a@local"},
+		{id: "a/0", from: "b@local", depth: 1},
+		{id: "b", from: "b@local"},
+		{id: "b/0", from: "a@local", depth: 1},
+	} {
+		out.write(row)
+	}
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		ids = append(ids, strings.Split(line, "\t")[12])
+	}
+	if strings.Join(ids, ",") != "b,b/0" {
+		t.Errorf("Expected attached messages to follow their parent, but got %v", ids)
+	}
+}
@@ -0,0 +1,145 @@
+package getheaders
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/McFlip/enigma/cmd/outlook"
+	pst "github.com/mooijtech/go-pst/v6/pkg"
+	"github.com/rotisserie/eris"
+
+	charsets "github.com/emersion/go-message/charset"
+)
+
+// recipient table columns, see MS-OXPROPS
+const (
+	nidRecipientTable = 0x692
+	propRecipientType = 0x0C15
+	propEmailAddress  = 0x3003
+	propSmtpAddress   = 0x39FE
+)
+
+var recipientTypes = map[int]string{
+	outlook.RecipientTo:  "To",
+	outlook.RecipientCc:  "Cc",
+	outlook.RecipientBcc: "Bcc",
+}
+
+// formatRecipients lists recipients for the Recipients column, ex. To: Smith, John <john.smith@local>; Cc: jane@local
+func formatRecipients(recipients []outlook.Recipient) string {
+	formatted := make([]string, len(recipients))
+	for i, r := range recipients {
+		rType, ok := recipientTypes[r.Type]
+		if !ok {
+			rType = fmt.Sprintf("Type %d", r.Type)
+		}
+		switch {
+		case r.Name == "" || r.Name == r.Address:
+			formatted[i] = fmt.Sprintf("%s: %s", rType, r.Address)
+		case r.Address == "":
+			formatted[i] = fmt.Sprintf("%s: %s", rType, r.Name)
+		default:
+			formatted[i] = fmt.Sprintf("%s: %s <%s>", rType, r.Name, r.Address)
+		}
+	}
+	return strings.Join(formatted, "; ")
+}
+
+// pstRecipients reads the recipient table of message. Exchange recipients are addressed by legacy DN,
+// so the SMTP address is taken from PR_SMTP_ADDRESS where the table has it.
+func pstRecipients(message *pst.Message) ([]outlook.Recipient, error) {
+	localDescriptor, err := pst.FindLocalDescriptor(nidRecipientTable, message.LocalDescriptors)
+	if err != nil {
+		// no recipient table
+		return nil, nil
+	}
+	heapOnNode, err := message.File.GetHeapOnNodeFromLocalDescriptor(localDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	localDescriptors, err := message.File.GetLocalDescriptorsFromIdentifier(localDescriptor.LocalDescriptorsIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	tableContext, err := message.File.GetTableContext(heapOnNode, localDescriptors,
+		propRecipientType, propDisplayName, propEmailAddress, propSmtpAddress)
+	if eris.Is(err, pst.ErrTableContextNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	recipients := []outlook.Recipient{}
+	for _, row := range tableContext.Properties {
+		var r outlook.Recipient
+		var email, smtp string
+		for _, property := range row {
+			propertyReader, err := tableContext.GetPropertyReader(property, localDescriptors...)
+			if err != nil {
+				return nil, err
+			}
+			if property.ID == propRecipientType {
+				rType, err := propertyReader.GetInteger32()
+				if err != nil {
+					return nil, err
+				}
+				// drop the resend and submitted flags
+				r.Type = int(rType & 0x0FFFFFFF)
+				continue
+			}
+			var value string
+			switch property.Type {
+			case pst.PropertyTypeString:
+				value, err = propertyReader.GetString()
+			case pst.PropertyTypeString8:
+				value, err = propertyReader.GetString8(65001)
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			switch property.ID {
+			case propDisplayName:
+				r.Name = value
+			case propEmailAddress:
+				email = value
+			case propSmtpAddress:
+				smtp = value
+			}
+		}
+		r.Address = smtp
+		if r.Address == "" {
+			// an EX address without PR_SMTP_ADDRESS stays a legacy DN
+			r.Address = email
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// mimeRecipients lists the recipients in the To, Cc and Bcc headers of a message
+func mimeRecipients(header mail.Header) []outlook.Recipient {
+	parser := mail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: charsets.Reader}}
+	recipients := []outlook.Recipient{}
+	for _, field := range []struct {
+		name  string
+		rType int
+	}{{"To", outlook.RecipientTo}, {"Cc", outlook.RecipientCc}, {"Bcc", outlook.RecipientBcc}} {
+		value := header.Get(field.name)
+		if value == "" {
+			continue
+		}
+		list, err := parser.ParseList(value)
+		if err != nil {
+			recipients = append(recipients, outlook.Recipient{Type: field.rType, Name: strings.Join(strings.Fields(value), " ")})
+			continue
+		}
+		for _, a := range list {
+			recipients = append(recipients, outlook.Recipient{Type: field.rType, Name: a.Name, Address: a.Address})
+		}
+	}
+	return recipients
+}
@@ -0,0 +1,178 @@
+package getheaders
+
+import (
+	"encoding/asn1"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// SMIMEType column values
+const (
+	smimeNone         = "none"
+	smimeEncrypted    = "encrypted"
+	smimeClearSigned  = "clear-signed"
+	smimeOpaqueSigned = "opaque-signed"
+	// the message looks like S/MIME but the class and parts don't say which kind, or disagree. Review these by hand.
+	smimeUnknown = "unknown"
+	// IPM.Note.SMIME is used for both encrypted and opaque signed messages, the smime.p7m part tells them apart
+	smimeOpaque = "opaque"
+)
+
+// CMS content types, see RFC 5652 and RFC 5083
+var (
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAuthEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 23}
+)
+
+// cmsHeadSize is enough of a CMS ContentInfo to read its content type
+const cmsHeadSize = 32
+
+// outlookSMIMEClasses are the message classes Outlook gives secure mail, in lower case. See MS-OXOSMIME.
+var outlookSMIMEClasses = map[string]string{
+	"ipm.note.smime":                 smimeOpaque,
+	"ipm.note.smime.multipartsigned": smimeClearSigned,
+	"ipm.note.secure":                smimeEncrypted,
+	"ipm.note.secure.sign":           smimeClearSigned,
+}
+
+// setSMIME classifies the row's message. Only messages known to be encrypted are reported as IsEncrypted.
+func (r *headerRow) setSMIME(class string, parts []smimePart) {
+	r.smime = classifySMIME(class, parts)
+	r.isEncrypted = r.smime == smimeEncrypted
+}
+
+// smimePart is what classifySMIME looks at in a body part or attachment
+type smimePart struct {
+	mediaType string
+	params    map[string]string
+	filename  string
+	head      []byte // the first bytes of the decoded content, if any
+}
+
+// classifySMIME works out the SMIMEType of a message from its Outlook message class, empty for RFC822 messages,
+// and its parts. An Outlook message is only classified when its class and its parts agree.
+func classifySMIME(class string, parts []smimePart) string {
+	classKind := ""
+	if class != "" {
+		class = strings.ToLower(class)
+		classKind = outlookSMIMEClasses[class]
+		if classKind == "" && (strings.Contains(class, ".smime") || strings.Contains(class, ".secure")) {
+			// receipts, reports and other variants
+			classKind = smimeUnknown
+		}
+	}
+	var found string
+	for _, part := range parts {
+		kind := part.kind()
+		switch {
+		case kind == "":
+			continue
+		case found != "" && found != kind:
+			return smimeUnknown
+		}
+		found = kind
+	}
+
+	switch {
+	case classKind == smimeUnknown || found == smimeUnknown:
+		return smimeUnknown
+	case found == "" && classKind == "":
+		return smimeNone
+	case found == "" && classKind == smimeOpaque:
+		return smimeUnknown
+	case found == "":
+		return classKind
+	case class == "":
+		return found
+	case classKind == found:
+		return found
+	case classKind == smimeOpaque && (found == smimeEncrypted || found == smimeOpaqueSigned):
+		return found
+	}
+	// an Outlook class that isn't S/MIME with an S/MIME attachment, or the class and attachment disagree
+	return smimeUnknown
+}
+
+// kind is the SMIMEType this part makes its message, or empty when it isn't an S/MIME part
+func (p smimePart) kind() string {
+	mediaType := strings.ToLower(p.mediaType)
+	ext := strings.ToLower(filepath.Ext(p.filename))
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		switch ext {
+		case ".p7m":
+			mediaType = "application/pkcs7-mime"
+		case ".p7s":
+			mediaType = "application/pkcs7-signature"
+		}
+	}
+	switch mediaType {
+	case "multipart/signed":
+		// Outlook keeps a clear signed message as one attachment tagged multipart/signed, without the protocol
+		if protocol := strings.ToLower(p.params["protocol"]); protocol != "" && !strings.Contains(protocol, "pkcs7-signature") {
+			return ""
+		}
+		return smimeClearSigned
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+		return smimeClearSigned
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+	default:
+		return ""
+	}
+
+	switch strings.ToLower(p.params["smime-type"]) {
+	case "enveloped-data", "authenveloped-data":
+		return smimeEncrypted
+	case "signed-data":
+		return smimeOpaqueSigned
+	case "certs-only":
+		// a certificate bundle, not a message
+		return ""
+	}
+	// Outlook's MIME tags have no smime-type, and it's optional in RFC822, so look at the CMS content type
+	oid, ok := cmsContentType(p.head)
+	switch {
+	case !ok:
+		return smimeUnknown
+	case oid.Equal(oidEnvelopedData), oid.Equal(oidAuthEnvelopedData):
+		return smimeEncrypted
+	case oid.Equal(oidSignedData):
+		// signed receipts and certs-only bundles are signed data too, but neither is sent as a message of its own
+		return smimeOpaqueSigned
+	}
+	return smimeUnknown
+}
+
+// cmsContentType reads the content type at the start of a CMS ContentInfo, so only the first few bytes are needed.
+// ContentInfo is a SEQUENCE of the content type OID then the content.
+func cmsContentType(head []byte) (asn1.ObjectIdentifier, bool) {
+	if len(head) < 2 || head[0] != 0x30 {
+		return nil, false
+	}
+	i := 2
+	if head[1] > 0x80 {
+		// long form length, BER's indefinite length 0x80 has no length bytes
+		i += int(head[1] & 0x7f)
+	}
+	if i >= len(head) {
+		return nil, false
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(head[i:], &oid); err != nil {
+		return nil, false
+	}
+	return oid, true
+}
+
+// newSMIMEPart parses contentType, which may be a bare MIME tag, and keeps the start of content
+func newSMIMEPart(contentType, filename string, content []byte) smimePart {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(contentType)
+	}
+	if len(content) > cmsHeadSize {
+		content = content[:cmsHeadSize]
+	}
+	return smimePart{mediaType: mediaType, params: params, filename: filename, head: content}
+}
@@ -0,0 +1,42 @@
+package getheaders
+
+import "testing"
+
+// the start of a BER encoded CMS EnvelopedData, as in an smime.p7m
+var envelopedHead = []byte{0x30, 0x80, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x03, 0xa0, 0x80}
+
+func TestClassifySMIME(t *testing.T) {
+	signedHead := []byte{0x30, 0x82, 0x0f, 0x00, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x02, 0xa0}
+	p7m := func(head []byte) smimePart {
+		return newSMIMEPart("application/pkcs7-mime", "smime.p7m", head)
+	}
+	for _, test := range []struct {
+		name, class string
+		parts       []smimePart
+		expected    string
+	}{
+		{"plain Outlook", "IPM.Note", []smimePart{newSMIMEPart("text/plain", "notes.txt", []byte("nuts"))}, smimeNone},
+		{"Outlook encrypted", "IPM.Note.SMIME", []smimePart{p7m(envelopedHead)}, smimeEncrypted},
+		{"Outlook opaque signed", "IPM.Note.SMIME", []smimePart{p7m(signedHead)}, smimeOpaqueSigned},
+		{"Outlook opaque without envelope", "IPM.Note.SMIME", nil, smimeUnknown},
+		{"Outlook clear signed", "IPM.Note.SMIME.MultipartSigned", []smimePart{newSMIMEPart("multipart/signed", "smime.p7m", []byte("Content-Type"))}, smimeClearSigned},
+		{"legacy encrypted", "IPM.Note.Secure", nil, smimeEncrypted},
+		{"legacy signed", "ipm.note.secure.sign", nil, smimeClearSigned},
+		{"receipt", "REPORT.IPM.Note.SMIME.MultipartSigned.IPNRN", nil, smimeUnknown},
+		{"class and attachment disagree", "IPM.Note.SMIME.MultipartSigned", []smimePart{p7m(envelopedHead)}, smimeUnknown},
+		{"p7m attached to plain mail", "IPM.Note", []smimePart{p7m(envelopedHead)}, smimeUnknown},
+		{"smime-type", "", []smimePart{newSMIMEPart("application/x-pkcs7-mime; smime-type=signed-data", "", nil)}, smimeOpaqueSigned},
+		{"readpst attachment", "", []smimePart{newSMIMEPart("multipart/mixed; boundary=b1", "", nil), p7m(envelopedHead)}, smimeEncrypted},
+		{"unreadable envelope", "", []smimePart{p7m([]byte("xx"))}, smimeUnknown},
+		{"multipart signed", "", []smimePart{
+			newSMIMEPart(`multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary=b1`, "", nil),
+			newSMIMEPart("application/pkcs7-signature", "smime.p7s", nil),
+		}, smimeClearSigned},
+		{"PGP signed", "", []smimePart{newSMIMEPart(`multipart/signed; protocol="application/pgp-signature"; boundary=b1`, "", nil)}, smimeNone},
+		{"certificate bundle", "", []smimePart{newSMIMEPart("application/pkcs7-mime; smime-type=certs-only", "certs.p7c", nil)}, smimeNone},
+	} {
+		if got := classifySMIME(test.class, test.parts); got != test.expected {
+			t.Errorf("%s: expected %s, but got %s", test.name, test.expected, got)
+		}
+	}
+}
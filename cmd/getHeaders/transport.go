@@ -0,0 +1,76 @@
+package getheaders
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	charsets "github.com/emersion/go-message/charset"
+)
+
+// transportFields are the headers broken out of the transport header block, the headers as the message went over SMTP.
+// Messages that never left Exchange have no transport headers and these stay empty.
+type transportFields struct {
+	from, to, cc  string // addresses only, semicolon separated
+	received      string // Received headers, newest hop first, separated by " | "
+	returnPath    string
+	originatingIP string
+	contentType   string
+}
+
+// setTransport keeps the raw header block and breaks out the transport fields
+func (r *headerRow) setTransport(raw string) {
+	if strings.TrimSpace(raw) == "" {
+		return
+	}
+	r.rawHeaders = raw
+	r.transport = parseTransport(raw)
+}
+
+func parseTransport(raw string) transportFields {
+	// a partial header is still worth reporting, so read errors are ignored
+	header, _ := textproto.NewReader(bufio.NewReader(strings.NewReader(raw + "\r\n\r\n"))).ReadMIMEHeader()
+	received := []string{}
+	for _, hop := range header.Values("Received") {
+		received = append(received, strings.Join(strings.Fields(hop), " "))
+	}
+	return transportFields{
+		from:          addresses(header.Get("From")),
+		to:            addresses(header.Get("To")),
+		cc:            addresses(header.Get("Cc")),
+		received:      strings.Join(received, " | "),
+		returnPath:    strings.Trim(strings.TrimSpace(header.Get("Return-Path")), "<>"),
+		originatingIP: strings.Trim(strings.TrimSpace(header.Get("X-Originating-IP")), "[]"),
+		contentType:   strings.Join(strings.Fields(header.Get("Content-Type")), " "),
+	}
+}
+
+// addresses lists the SMTP addresses in an address header, or the header as is when it doesn't parse
+func addresses(value string) string {
+	if value == "" {
+		return ""
+	}
+	parser := mail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: charsets.Reader}}
+	list, err := parser.ParseList(value)
+	if err != nil {
+		return strings.Join(strings.Fields(value), " ")
+	}
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		addrs[i] = a.Address
+	}
+	return strings.Join(addrs, "; ")
+}
+
+// headerBlock is the header of an RFC822 message as written, up to the blank line
+func headerBlock(msg []byte) string {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(msg, []byte(sep)); i >= 0 {
+			return string(msg[:i+len(sep)/2])
+		}
+	}
+	return string(msg)
+}
@@ -0,0 +1,54 @@
+package getheaders
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testTransport = "Received: from mx.local (mx.local [10.0.0.2])\r\n" +
+	"\tby mail.local with ESMTP; Fri, 17 Apr 2020 16:00:02 +0000\r\n" +
+	"Received: from laptop (unknown [192.168.1.5]) by mx.local; Fri, 17 Apr 2020 16:00:01 +0000\r\n" +
+	"Return-Path: <bounce@local>\r\n" +
+	"X-Originating-IP: [192.168.1.5]\r\n" +
+	"From: =?utf-8?q?Caf=C3=A9?= <cafe@local>\r\n" +
+	"To: \"One\" <one@local>, two@local\r\n" +
+	"Cc: undisclosed-recipients:;\r\n" +
+	"Content-Type: multipart/mixed;\r\n boundary=\"b1\"\r\n\r\n"
+
+func TestParseTransport(t *testing.T) {
+	expected := transportFields{
+		from: "cafe@local",
+		to:   "one@local; two@local",
+		received: "from mx.local (mx.local [10.0.0.2]) by mail.local with ESMTP; Fri, 17 Apr 2020 16:00:02 +0000 | " +
+			"from laptop (unknown [192.168.1.5]) by mx.local; Fri, 17 Apr 2020 16:00:01 +0000",
+		returnPath:    "bounce@local",
+		originatingIP: "192.168.1.5",
+		contentType:   "multipart/mixed; boundary=\"b1\"",
+	}
+	if actual := parseTransport(testTransport); actual != expected {
+		t.Errorf("Expected\n%+v\n but got\n%+v", expected, actual)
+	}
+}
+
+func TestReportRawHeaders(t *testing.T) {
+	var tsv, headers bytes.Buffer
+	out := &report{tsv: &tsv, headers: json.NewEncoder(&headers)}
+	rows, err := mimeRows(headerRow{pstFile: "mail.mbox#0", id: "mail.mbox#0"}, []byte(testTransport+"--b1\r\n\r\nbody\r\n--b1--\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.write(rows[0])
+	out.write(headerRow{id: "no headers"})
+	if !strings.Contains(tsv.String(), "\tcafe@local\tone@local; two@local\t\tfrom mx.local") {
+		t.Errorf("Unexpected row %q", tsv.String())
+	}
+	var raw rawHeaders
+	if err := json.Unmarshal(headers.Bytes(), &raw); err != nil {
+		t.Fatalf("Expected 1 line of raw headers, but got %q: %v", headers.String(), err)
+	}
+	if raw.ID != "mail.mbox#0" || raw.Headers != strings.TrimSuffix(testTransport, "\r\n") {
+		t.Errorf("Unexpected raw headers %+v", raw)
+	}
+}
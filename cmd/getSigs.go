@@ -21,7 +21,10 @@ THE SOFTWARE.
 */package cmd
 
 import (
+	"log"
+
 	getsigs "github.com/McFlip/enigma/cmd/getSigs"
+	"github.com/McFlip/enigma/cmd/mbox"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -35,18 +38,61 @@ var getSigsCmd = &cobra.Command{
   
   Extract custodian IDs from CN field in certs from signed emails
   Input is a folder of PST files with signed emails sent by the custodian
-  Output is custodian metadata`,
+  Only the PST's sent folder is read. It is found by the entry ID in the message
+  store, so a localized name like Gesendete Elemente works, or else by the name
+  Sent Items. folders picks other folders by globs on the folder name or path,
+  ex. Gesendete* or Archive/*/Sent. allFolders reads every folder but keeps only
+  messages sent by the PST's owner, known by the senders of its sent mail.
+  mbox files may be used as well. mbox has no Sent Items, so every signed message is read.
+  Output is custodian metadata: signers.tsv has a row per signer cert with the
+  name, email, EDIPI, UPN, serial, issuer, CA, validity dates and key usages,
+  and the message it came from with its sender. Email is the cert's own, or the
+  sender's when the cert has none. UPN is left empty when the cert has none.
+  commonName.txt lists each Common Name once.
+  keyHistory.tsv lists each cert once by serial, grouped by custodian (EDIPI or
+  email) and ordered by the first and last dates it signed a message, with a
+  row for each encryption cert it named and when that was first and last seen.
+  The encryption cert escrow holds the key for is often not the signing cert.
+  Its serial and issuer are read from the SMIMEEncryptionKeyPreference signed
+  attribute, or found among the certs sent with the signature, and reported
+  with the SMIMECapabilities the signer's mail client advertised.
+  The shared filters (from-date, to-date, folder, sender, recipient) scope which
+  signed messages are read, and filterSummary.tsv counts those left out.
+  Files are read in parallel, 'workers' at a time (default one per CPU).
+  errors.tsv lists what couldn't be read in each file, ex. a corrupt PST, and
+  warns when the sent folder was found by name or not at all.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		viper.SetDefault("signed.pstDir", "signedPSTs")
 		*pstDir = viper.GetString("signed.pstDir")
 		viper.SetDefault("signed.custodianInfoDir", "custodianInfo")
 		*custodianInfoDir = viper.GetString("signed.custodianInfoDir")
+		viper.SetDefault("signed.mboxVariant", string(mbox.MboxRD))
+		*sigsMboxVariant = viper.GetString("signed.mboxVariant")
+		if *sigsMboxVariant != string(mbox.MboxRD) && *sigsMboxVariant != string(mbox.MboxO) {
+			log.Fatal("mboxVariant must be one of: mboxrd, mboxo")
+		}
+
+		viper.SetDefault("signed.folders", []string{})
+		*sigsFolders = viper.GetStringSlice("signed.folders")
+		viper.SetDefault("signed.allFolders", false)
+		*sigsAllFolders = viper.GetBool("signed.allFolders")
+		viper.SetDefault("signed.workers", 0)
+		*sigsWorkers = viper.GetInt("signed.workers")
 
-		getsigs.GetSigs(*pstDir, *custodianInfoDir)
+		getsigs.GetSigs(*pstDir, *custodianInfoDir, getsigs.Options{
+			MboxVariant: mbox.Variant(*sigsMboxVariant),
+			Filter:      scopeFilter(cmd),
+			Folders:     *sigsFolders,
+			AllFolders:  *sigsAllFolders,
+			Workers:     *sigsWorkers,
+		})
 	},
 }
 
-var pstDir, custodianInfoDir *string
+var pstDir, custodianInfoDir, sigsMboxVariant *string
+var sigsFolders *[]string
+var sigsAllFolders *bool
+var sigsWorkers *int
 
 func init() {
 	rootCmd.AddCommand(getSigsCmd)
@@ -55,9 +101,22 @@ func init() {
 		String("pstDir", "", "source directory of input PSTs containing signed emails sent by the custodians")
 	viper.BindPFlag("signed.pstDir", getSigsCmd.PersistentFlags().Lookup("pstDir"))
 	custodianInfoDir = getSigsCmd.PersistentFlags().
-		String("custodianInfoDir", "", "the file 'commonNames.txt' will be output here. It will contain common names which includes EDIPI #s.")
+		String("custodianInfoDir", "", "signers.tsv and commonName.txt will be output here. They hold the signer cert profiles and common names, which include EDIPI #s.")
 	viper.BindPFlag(
 		"signed.custodianInfoDir",
 		getSigsCmd.PersistentFlags().Lookup("custodianInfoDir"),
 	)
+	sigsMboxVariant = getSigsCmd.PersistentFlags().
+		String("mboxVariant", "", "how From lines are escaped in mbox input: 'mboxrd' or 'mboxo'")
+	viper.BindPFlag("signed.mboxVariant", getSigsCmd.PersistentFlags().Lookup("mboxVariant"))
+	sigsFolders = getSigsCmd.PersistentFlags().
+		StringSlice("folders", nil, "PST folders to read, globs on the folder name or path. Defaults to the sent folder.")
+	viper.BindPFlag("signed.folders", getSigsCmd.PersistentFlags().Lookup("folders"))
+	sigsAllFolders = getSigsCmd.PersistentFlags().
+		Bool("allFolders", false, "read every PST folder, keeping only messages sent by the PST's owner")
+	viper.BindPFlag("signed.allFolders", getSigsCmd.PersistentFlags().Lookup("allFolders"))
+	sigsWorkers = getSigsCmd.PersistentFlags().
+		Int("workers", 0, "how many files to read at once, 0 for one per CPU")
+	viper.BindPFlag("signed.workers", getSigsCmd.PersistentFlags().Lookup("workers"))
+	addFilterFlags(getSigsCmd)
 }
@@ -0,0 +1,193 @@
+package getsigs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	pkcs7 "github.com/smallstep/pkcs7"
+)
+
+// Signed attributes that name the cert to encrypt to, see RFC 8551 2.5
+var (
+	oidSMIMECapabilities         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 15}
+	oidEncryptionKeyPreference   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 11}
+	oidMSEncryptionKeyPreference = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 16, 4}
+)
+
+// How the encryption cert was found, in the order they are tried
+const (
+	fromKeyPreference   = "key preference"
+	fromMSKeyPreference = "Microsoft key preference"
+	fromCertBag         = "certificate bag"
+	fromSigner          = "signer cert"
+)
+
+// capabilityNames are the S/MIME capabilities mail clients usually list, the rest are shown by OID
+var capabilityNames = map[string]string{
+	"2.16.840.1.101.3.4.1.42":    "AES-256-CBC",
+	"2.16.840.1.101.3.4.1.22":    "AES-192-CBC",
+	"2.16.840.1.101.3.4.1.2":     "AES-128-CBC",
+	"2.16.840.1.101.3.4.1.46":    "AES-256-GCM",
+	"2.16.840.1.101.3.4.1.6":     "AES-128-GCM",
+	"1.2.840.113549.3.7":         "3DES-CBC",
+	"1.2.840.113549.3.2":         "RC2-CBC",
+	"1.3.14.3.2.7":               "DES-CBC",
+	"2.16.840.1.101.3.4.2.1":     "SHA-256",
+	"2.16.840.1.101.3.4.2.2":     "SHA-384",
+	"2.16.840.1.101.3.4.2.3":     "SHA-512",
+	"1.3.14.3.2.26":              "SHA-1",
+	"1.2.840.113549.1.1.1":       "RSA",
+	"1.2.840.113549.1.1.10":      "RSASSA-PSS",
+	"1.2.840.113549.1.1.7":       "RSAES-OAEP",
+	"1.2.840.113549.1.9.16.11.1": "Prefer Binary Inside",
+}
+
+type capability struct {
+	ID     asn1.ObjectIdentifier
+	Params asn1.RawValue `asn1:"optional"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+// recipientKeyIdentifier is the [1] choice of SMIMEEncryptionKeyPreference. Only the key identifier is needed,
+// the optional date and other attribute after it are skipped.
+type recipientKeyIdentifier struct {
+	SubjectKeyIdentifier []byte
+}
+
+// signerOf reads the profile of the only signer of p7, with the encryption cert the signer asks to be sent mail with.
+// sender is the address the message was sent from.
+func signerOf(p7 *pkcs7.PKCS7, sender string) (Signer, bool) {
+	cert := p7.GetOnlySigner()
+	if cert == nil {
+		return Signer{}, false
+	}
+	s := newSigner(cert, sender)
+	s.setEncryption(p7, cert)
+	return s, true
+}
+
+// setEncryption finds the signer's encryption cert. In DoD style PKI it is a separate cert with the same subject,
+// and it is the one escrow holds the key for. The key preference attributes name it by issuer and serial or by
+// key identifier. Without them the certs sent along with the signature are searched, then the signing cert is
+// used if it can encrypt.
+func (s *Signer) setEncryption(p7 *pkcs7.PKCS7, signer *x509.Certificate) {
+	var capabilities []capability
+	if err := p7.UnmarshalSignedAttribute(oidSMIMECapabilities, &capabilities); err == nil {
+		for _, c := range capabilities {
+			name, ok := capabilityNames[c.ID.String()]
+			if !ok {
+				name = c.ID.String()
+			}
+			s.Capabilities = append(s.Capabilities, name)
+		}
+	}
+
+	var preference asn1.RawValue
+	if err := p7.UnmarshalSignedAttribute(oidEncryptionKeyPreference, &preference); err == nil {
+		if s.preferred(p7.Certificates, preference) {
+			s.EncryptionFrom = fromKeyPreference
+			return
+		}
+	}
+	var msPreference issuerAndSerial
+	if err := p7.UnmarshalSignedAttribute(oidMSEncryptionKeyPreference, &msPreference); err == nil {
+		s.setIssuerAndSerial(p7.Certificates, msPreference)
+		s.EncryptionFrom = fromMSKeyPreference
+		return
+	}
+	if cert := bagEncryptionCert(p7.Certificates, signer); cert != nil {
+		s.setEncryptionCert(cert)
+		s.EncryptionFrom = fromCertBag
+		return
+	}
+	if canEncrypt(signer) {
+		s.setEncryptionCert(signer)
+		s.EncryptionFrom = fromSigner
+	}
+}
+
+// preferred reads SMIMEEncryptionKeyPreference, a choice of issuer and serial [0], recipient key identifier [1]
+// or subject key identifier [2]. A key identifier can only be turned into a serial if the cert came with the signature.
+func (s *Signer) preferred(certs []*x509.Certificate, preference asn1.RawValue) bool {
+	if preference.Class != asn1.ClassContextSpecific {
+		return false
+	}
+	var keyID []byte
+	switch preference.Tag {
+	case 0:
+		var ias issuerAndSerial
+		if _, err := asn1.UnmarshalWithParams(preference.FullBytes, &ias, "tag:0"); err != nil {
+			return false
+		}
+		s.setIssuerAndSerial(certs, ias)
+		return true
+	case 1:
+		var rki recipientKeyIdentifier
+		if _, err := asn1.UnmarshalWithParams(preference.FullBytes, &rki, "tag:1"); err != nil {
+			return false
+		}
+		keyID = rki.SubjectKeyIdentifier
+	case 2:
+		keyID = preference.Bytes
+	default:
+		return false
+	}
+	for _, cert := range certs {
+		if len(keyID) > 0 && bytes.Equal(cert.SubjectKeyId, keyID) {
+			s.setEncryptionCert(cert)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Signer) setIssuerAndSerial(certs []*x509.Certificate, ias issuerAndSerial) {
+	for _, cert := range certs {
+		if cert.SerialNumber.Cmp(ias.Serial) == 0 && bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) {
+			s.setEncryptionCert(cert)
+			return
+		}
+	}
+	// the cert wasn't sent with the signature, issuer and serial are all escrow needs
+	s.EncryptionSerial = fmt.Sprintf("%x", ias.Serial)
+	var rdns pkix.RDNSequence
+	if _, err := asn1.Unmarshal(ias.Issuer.FullBytes, &rdns); err == nil {
+		var issuer pkix.Name
+		issuer.FillFromRDNSequence(&rdns)
+		s.EncryptionIssuer = distinguishedName(issuer)
+	}
+}
+
+func (s *Signer) setEncryptionCert(cert *x509.Certificate) {
+	s.EncryptionSerial = fmt.Sprintf("%x", cert.SerialNumber)
+	s.EncryptionIssuer = distinguishedName(cert.Issuer)
+	s.EncryptionNotAfter = cert.NotAfter.UTC()
+}
+
+// bagEncryptionCert picks the cert sent with the signature that has the signer's subject and can encrypt.
+// The one valid longest is the current one.
+func bagEncryptionCert(certs []*x509.Certificate, signer *x509.Certificate) *x509.Certificate {
+	var found *x509.Certificate
+	for _, cert := range certs {
+		if cert.Equal(signer) || cert.IsCA || !bytes.Equal(cert.RawSubject, signer.RawSubject) || !canEncrypt(cert) {
+			continue
+		}
+		if found == nil || cert.NotAfter.After(found.NotAfter) {
+			found = cert
+		}
+	}
+	return found
+}
+
+// canEncrypt is true when cert allows key transport or agreement. A cert without key usage allows anything.
+func canEncrypt(cert *x509.Certificate) bool {
+	return cert.KeyUsage == 0 || cert.KeyUsage&(x509.KeyUsageKeyEncipherment|x509.KeyUsageKeyAgreement) != 0
+}
@@ -0,0 +1,146 @@
+package getsigs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// issueCert issues a cert for DOE.JANE.1234567890 by ca, or a self signed one when ca is nil
+func issueCert(t *testing.T, serial int64, usage x509.KeyUsage, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "DOE.JANE.1234567890"},
+		NotBefore:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:     usage,
+		SubjectKeyId: []byte{byte(serial)},
+	}
+	if ca == nil {
+		template.Subject = pkix.Name{CommonName: "DOD EMAIL CA-59"}
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		ca, caKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestSignerOfEncryption(t *testing.T) {
+	ca, caKey := issueCert(t, 1, x509.KeyUsageCertSign, nil, nil)
+	signing, signingKey := issueCert(t, 0x51, x509.KeyUsageDigitalSignature, ca, caKey)
+	encryption, _ := issueCert(t, 0xe1, x509.KeyUsageKeyEncipherment, ca, caKey)
+	unsent, _ := issueCert(t, 0xe2, x509.KeyUsageKeyEncipherment, ca, caKey)
+
+	marshal := func(v interface{}, params string) asn1.RawValue {
+		der, err := asn1.MarshalWithParams(v, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asn1.RawValue{FullBytes: der}
+	}
+	byIssuerAndSerial := func(cert *x509.Certificate) issuerAndSerial {
+		return issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, Serial: cert.SerialNumber}
+	}
+	capabilities := pkcs7.Attribute{Type: oidSMIMECapabilities, Value: []capability{
+		{ID: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}},
+		{ID: asn1.ObjectIdentifier{1, 2, 3}},
+	}}
+
+	for _, test := range []struct {
+		name       string
+		attributes []pkcs7.Attribute
+		bag        []*x509.Certificate
+		serial     string
+		notAfter   bool
+		from       string
+	}{
+		{
+			"issuer and serial preference",
+			[]pkcs7.Attribute{{Type: oidEncryptionKeyPreference, Value: marshal(byIssuerAndSerial(encryption), "tag:0")}},
+			[]*x509.Certificate{encryption},
+			"e1", true, fromKeyPreference,
+		},
+		{
+			"preference not sent",
+			[]pkcs7.Attribute{{Type: oidEncryptionKeyPreference, Value: marshal(byIssuerAndSerial(unsent), "tag:0")}},
+			[]*x509.Certificate{encryption},
+			"e2", false, fromKeyPreference,
+		},
+		{
+			"subject key identifier preference",
+			[]pkcs7.Attribute{{Type: oidEncryptionKeyPreference, Value: marshal(encryption.SubjectKeyId, "tag:2")}},
+			[]*x509.Certificate{unsent, encryption},
+			"e1", true, fromKeyPreference,
+		},
+		{
+			"Microsoft preference",
+			[]pkcs7.Attribute{{Type: oidMSEncryptionKeyPreference, Value: byIssuerAndSerial(unsent)}},
+			nil,
+			"e2", false, fromMSKeyPreference,
+		},
+		{"certificate bag", nil, []*x509.Certificate{ca, encryption}, "e1", true, fromCertBag},
+		{"signing only", nil, []*x509.Certificate{ca}, "", false, ""},
+	} {
+		sd, err := pkcs7.NewSignedData([]byte("signed body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := pkcs7.SignerInfoConfig{ExtraSignedAttributes: append(test.attributes, capabilities)}
+		if err := sd.AddSigner(signing, signingKey, config); err != nil {
+			t.Fatal(err)
+		}
+		for _, cert := range test.bag {
+			sd.AddCertificate(cert)
+		}
+		der, err := sd.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p7, err := pkcs7.Parse(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, ok := signerOf(p7, "")
+		if !ok {
+			t.Fatalf("%s: expected a signer", test.name)
+		}
+		if s.Serial != "51" || s.EncryptionSerial != test.serial || s.EncryptionFrom != test.from {
+			t.Errorf("%s: expected encryption serial %q from %q, but got %q from %q",
+				test.name, test.serial, test.from, s.EncryptionSerial, s.EncryptionFrom)
+		}
+		if test.serial != "" && s.EncryptionIssuer != "CN=DOD EMAIL CA-59" {
+			t.Errorf("%s: expected the encryption cert issuer, but got %q", test.name, s.EncryptionIssuer)
+		}
+		if s.EncryptionNotAfter.IsZero() == test.notAfter {
+			t.Errorf("%s: expected the validity only when the cert was sent, but got %v", test.name, s.EncryptionNotAfter)
+		}
+		if strings.Join(s.Capabilities, "; ") != "AES-256-CBC; 1.2.3" {
+			t.Errorf("%s: expected the capabilities, but got %v", test.name, s.Capabilities)
+		}
+		if test.serial != "" && !strings.HasSuffix(s.String(), "\nEncryption Serial: "+test.serial+"\nEncryption Issuer: CN=DOD EMAIL CA-59") {
+			t.Errorf("%s: expected the encryption cert at the end of\n%s", test.name, s)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package getsigs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cert is a signing cert seen in 1 or more messages, with when it was first and last used
+type Cert struct {
+	// Custodian groups the certs of 1 person, their EDIPI or else their email
+	Custodian string
+	// Signer is the profile from the last message the cert signed, so the encryption cert is the current one
+	Signer
+	// FirstSigned and LastSigned are the dates of the earliest and latest messages it signed, zero when none were dated
+	FirstSigned, LastSigned time.Time
+	Messages                int
+	// Encryption is every encryption cert named alongside the signing cert, in the order they were first seen.
+	// Escrow holds a key for each.
+	Encryption []EncryptionCert
+}
+
+// EncryptionCert is an encryption cert a signer advertised, with when it was first and last seen
+type EncryptionCert struct {
+	Serial, Issuer, From string
+	// FirstSeen and LastSeen are the dates of the earliest and latest messages naming it, zero when none were dated
+	FirstSeen, LastSeen time.Time
+}
+
+// addEncryption records the encryption cert of s, once per issuer and serial
+func (c *Cert) addEncryption(s Signer) {
+	if s.EncryptionSerial == "" {
+		return
+	}
+	i := 0
+	for i < len(c.Encryption) && (c.Encryption[i].Serial != s.EncryptionSerial || c.Encryption[i].Issuer != s.EncryptionIssuer) {
+		i++
+	}
+	if i == len(c.Encryption) {
+		c.Encryption = append(c.Encryption, EncryptionCert{Serial: s.EncryptionSerial, Issuer: s.EncryptionIssuer, From: s.EncryptionFrom})
+	}
+	e := &c.Encryption[i]
+	if s.Sent.IsZero() {
+		return
+	}
+	if e.FirstSeen.IsZero() || s.Sent.Before(e.FirstSeen) {
+		e.FirstSeen = s.Sent
+	}
+	if s.Sent.After(e.LastSeen) {
+		e.LastSeen = s.Sent
+	}
+}
+
+// keyHistory dedups the signers by cert, issuer and serial, and orders each custodian's certs by when they were used.
+// Undated certs go after the dated ones, by validity.
+func keyHistory(signers []Signer) []Cert {
+	type certKey struct{ issuer, serial string }
+	found := map[certKey]*Cert{}
+	certs := []*Cert{}
+	for _, s := range signers {
+		key := certKey{s.Issuer, s.Serial}
+		c, ok := found[key]
+		if !ok {
+			c = &Cert{Custodian: custodianOf(s), Signer: s}
+			found[key] = c
+			certs = append(certs, c)
+		}
+		c.Messages++
+		c.addEncryption(s)
+		if s.Sent.IsZero() {
+			continue
+		}
+		if c.FirstSigned.IsZero() || s.Sent.Before(c.FirstSigned) {
+			c.FirstSigned = s.Sent
+		}
+		if !s.Sent.Before(c.LastSigned) {
+			c.LastSigned = s.Sent
+			c.Signer = s
+		}
+	}
+	history := make([]Cert, len(certs))
+	for i, c := range certs {
+		sort.SliceStable(c.Encryption, func(i, j int) bool {
+			a, b := c.Encryption[i], c.Encryption[j]
+			if a.FirstSeen.IsZero() != b.FirstSeen.IsZero() {
+				return !a.FirstSeen.IsZero()
+			}
+			return a.FirstSeen.Before(b.FirstSeen)
+		})
+		history[i] = *c
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		a, b := history[i], history[j]
+		switch {
+		case a.Custodian != b.Custodian:
+			return a.Custodian < b.Custodian
+		case a.FirstSigned.IsZero() != b.FirstSigned.IsZero():
+			return !a.FirstSigned.IsZero()
+		case !a.FirstSigned.Equal(b.FirstSigned):
+			return a.FirstSigned.Before(b.FirstSigned)
+		}
+		return a.NotBefore.Before(b.NotBefore)
+	})
+	return history
+}
+
+// custodianOf is who a signer is. The EDIPI stays with a person through renewals and name changes.
+func custodianOf(s Signer) string {
+	switch {
+	case s.EDIPI != "":
+		return s.EDIPI
+	case s.Email != "":
+		return strings.ToLower(s.Email)
+	}
+	return s.CommonName
+}
+
+const keyHistoryHeader = "Custodian\tName\tEmail\tCommon Name\tSerial\tIssuer\tNot Before\tNot After\t" +
+	"First Signed\tLast Signed\tMessages\tEncryption Serial\tEncryption Issuer\tEncryption From\t" +
+	"Encryption First Seen\tEncryption Last Seen\n"
+
+// keyHistoryTSV is the history as keyHistory.tsv, a row per encryption cert of each signing cert,
+// or 1 row for a signing cert that named none
+func keyHistoryTSV(history []Cert) string {
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	var b strings.Builder
+	b.WriteString(keyHistoryHeader)
+	for _, c := range history {
+		encryption := c.Encryption
+		if len(encryption) == 0 {
+			encryption = []EncryptionCert{{}}
+		}
+		for _, e := range encryption {
+			b.WriteString(strings.Join([]string{
+				c.Custodian,
+				c.Name,
+				c.Email,
+				c.CommonName,
+				c.Serial,
+				c.Issuer,
+				date(c.NotBefore),
+				date(c.NotAfter),
+				date(c.FirstSigned),
+				date(c.LastSigned),
+				fmt.Sprint(c.Messages),
+				e.Serial,
+				e.Issuer,
+				e.From,
+				date(e.FirstSeen),
+				date(e.LastSeen),
+			}, "\t"))
+			b.WriteRune('\n')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,76 @@
+package getsigs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyHistory(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 1, d, 0, 0, 0, 0, time.UTC) }
+	renewed := Signer{CommonName: "DOE.JANE.1234567890", EDIPI: "1234567890", Serial: "b2", Issuer: "CN=CA-60", NotBefore: day(1)}
+	old := Signer{CommonName: "DOE.JANE.1234567890", EDIPI: "1234567890", Serial: "a1", Issuer: "CN=CA-59"}
+	married := Signer{CommonName: "SMITH.JANE.1234567890", EDIPI: "1234567890", Serial: "c3", Issuer: "CN=CA-60"}
+	other := Signer{CommonName: "Pat Jones", Email: "Pat.Jones@local", Serial: "a1", Issuer: "CN=Other CA"}
+	at := func(s Signer, sent time.Time, encryption string) Signer {
+		s.Sent = sent
+		s.EncryptionSerial = encryption
+		return s
+	}
+	history := keyHistory([]Signer{
+		at(renewed, day(20), "e2"),
+		at(old, day(3), "e1"),
+		at(other, time.Time{}, ""),
+		at(renewed, day(10), "e2"),
+		at(married, time.Time{}, ""),
+		at(old, day(5), "e1"),
+		at(renewed, day(25), "e3"),
+		at(renewed, time.Time{}, "e2"),
+	})
+
+	expected := []struct {
+		custodian, serial, encryption string
+		first, last                   time.Time
+		messages                      int
+	}{
+		{"1234567890", "a1", "e1", day(3), day(5), 2},
+		{"1234567890", "b2", "e3", day(10), day(25), 4},
+		{"1234567890", "c3", "", time.Time{}, time.Time{}, 1},
+		{"pat.jones@local", "a1", "", time.Time{}, time.Time{}, 1},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("Expected %d certs, but got %+v", len(expected), history)
+	}
+	for i, e := range expected {
+		c := history[i]
+		if c.Custodian != e.custodian || c.Serial != e.serial || c.EncryptionSerial != e.encryption ||
+			!c.FirstSigned.Equal(e.first) || !c.LastSigned.Equal(e.last) || c.Messages != e.messages {
+			t.Errorf("%d: expected %+v, but got %s %s %s %v %v %d",
+				i, e, c.Custodian, c.Serial, c.EncryptionSerial, c.FirstSigned, c.LastSigned, c.Messages)
+		}
+	}
+
+	// the renewed cert named 2 encryption certs, escrow needs both keys
+	expectedEncryption := []EncryptionCert{
+		{Serial: "e2", FirstSeen: day(10), LastSeen: day(20)},
+		{Serial: "e3", FirstSeen: day(25), LastSeen: day(25)},
+	}
+	if !reflect.DeepEqual(history[1].Encryption, expectedEncryption) {
+		t.Errorf("Expected encryption certs %+v, but got %+v", expectedEncryption, history[1].Encryption)
+	}
+
+	rows := strings.Split(strings.TrimSuffix(keyHistoryTSV(history), "\n"), "\n")
+	if len(rows) != len(expected)+2 || rows[0] != strings.TrimSuffix(keyHistoryHeader, "\n") {
+		t.Fatalf("Expected a header and a row per encryption cert, but got\n%s", strings.Join(rows, "\n"))
+	}
+	for i, suffix := range []string{
+		"\t2021-01-10T00:00:00Z\t2021-01-25T00:00:00Z\t4\te2\t\t\t2021-01-10T00:00:00Z\t2021-01-20T00:00:00Z",
+		"\t2021-01-10T00:00:00Z\t2021-01-25T00:00:00Z\t4\te3\t\t\t2021-01-25T00:00:00Z\t2021-01-25T00:00:00Z",
+		"\t1\t\t\t\t\t",
+	} {
+		if !strings.HasSuffix(rows[i+2], suffix) {
+			t.Errorf("Expected row %d to end with %q, but got %q", i+2, suffix, rows[i+2])
+		}
+	}
+}
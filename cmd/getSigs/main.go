@@ -1,10 +1,13 @@
 // Parse certificate info from signed emails. This info helps you fetch keys from escrow.
+// Input is PST or OST files, where the sent folder is read unless other folders are chosen,
+// or mbox files, where every signed message is read.
 package getsigs
 
 import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -15,8 +18,14 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/McFlip/enigma/cmd/filter"
+	"github.com/McFlip/enigma/cmd/mbox"
+	"github.com/McFlip/enigma/cmd/outlook"
 	pkcs7 "github.com/smallstep/pkcs7"
 
 	"golang.org/x/text/encoding"
@@ -28,18 +37,76 @@ import (
 	charsets "github.com/emersion/go-message/charset"
 )
 
-func GetSigs(inDir, outDir string) {
-	// get list of pst files to process
+// Options scopes which messages GetSigs reads
+type Options struct {
+	// MboxVariant selects how "From " lines in mbox input are unescaped. Defaults to mboxrd.
+	MboxVariant mbox.Variant
+	// Filter scopes the signed messages read. filterSummary.tsv counts those left out.
+	Filter filter.Criteria
+	// Folders are globs matched against the name and path of each PST folder, ex. Gesendete* or Archive/*/Sent.
+	// Empty reads the folder the PST files sent mail in, whatever it is called, or else folders named Sent Items.
+	Folders []string
+	// AllFolders reads every PST folder but only keeps messages sent by the PST's owner,
+	// known by the senders of the messages in its sent folder. Without sent mail every sender is kept.
+	AllFolders bool
+	// Workers is how many files are read at once. Defaults to the number of CPUs.
+	Workers int
+}
+
+// result is what reading 1 file found, the signers of its signed messages and what went wrong along the way.
+// Warnings are what may have been read differently than asked, ex. a sent folder found by name.
+type result struct {
+	File     string
+	Signers  []Signer
+	Errs     []error
+	Warnings []string
+}
+
+func (r *result) errorf(format string, a ...interface{}) {
+	r.Errs = append(r.Errs, fmt.Errorf(format, a...))
+}
+
+func (r *result) warnf(format string, a ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, a...))
+}
+
+// recoverPanic turns a panic while reading a file, ex. on a corrupt PST, into an error of its result
+func (r *result) recoverPanic() {
+	if p := recover(); p != nil {
+		r.errorf("panic: %v", p)
+	}
+}
+
+var registerCharsets sync.Once
+
+// GetSigs reads the signer certs of the signed messages in inDir that are in scope into outDir.
+// When filter criteria are set, filterSummary.tsv in outDir counts the signed messages left out.
+// errors.tsv in outDir lists what couldn't be read in each file.
+func GetSigs(inDir, outDir string, opts Options) {
+	// the charsets go into a global map, so they are registered before the workers start
+	registerCharsets.Do(func() {
+		pst.ExtendCharsets(func(name string, enc encoding.Encoding) {
+			charsets.RegisterEncoding(name, enc)
+		})
+	})
+
+	// get list of pst, ost and mbox files to process
 	files := []string{}
+	stores := map[string]bool{}
 	err := filepath.Walk(inDir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			fileExt := filepath.Ext(info.Name())
-			if fileExt == ".pst" {
-				files = append(files, path)
-			}
+		if info.IsDir() {
+			return nil
+		}
+		if _, err := outlook.OpenStore(path); err == nil {
+			stores[path] = true
+			files = append(files, path)
+		} else if !errors.Is(err, outlook.ErrNotStore) {
+			log.Printf("Skipping %s: %v\n", path, err)
+		} else if mbox.IsMbox(path) {
+			files = append(files, path)
 		}
 		return nil
 	})
@@ -50,20 +117,67 @@ func GetSigs(inDir, outDir string) {
 		log.Fatal("Error: input dir is empty")
 	}
 
-	// process each pst in a goroutine
-	// get cert back in channel
-	c := make(chan string)
-	var commonNames []string
-	for _, file := range files {
-		go processPST(file, c)
+	var scope *filter.Filter
+	if !opts.Filter.Empty() {
+		scope = filter.New(opts.Filter)
 	}
-	for completedFiles := 0; completedFiles < len(files); completedFiles++ {
-		currMsg := <-c
-		if currMsg == "" {
-			continue
+	// a pool of workers reads the files, each result is kept in walk order
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	results := make([]result, len(files))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if stores[files[j]] {
+					results[j] = processPST(files[j], opts, scope)
+				} else {
+					results[j] = processMbox(files[j], opts.MboxVariant, scope)
+				}
+			}
+		}()
+	}
+	for j := range files {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+
+	var found []Signer
+	failed, warned := 0, 0
+	for _, res := range results {
+		for _, signer := range res.Signers {
+			log.Println("FOUND: ", signer)
+			found = append(found, signer)
+		}
+		if len(res.Errs) > 0 {
+			failed++
+		}
+		if len(res.Warnings) > 0 {
+			warned++
+		}
+	}
+	if failed > 0 || warned > 0 {
+		log.Printf("%d of %d files had errors and %d had warnings, see errors.tsv\n", failed, len(files), warned)
+	}
+	rows := signersHeader
+	for _, signer := range found {
+		rows += signer.row()
+	}
+	// the same cert signs many messages, list each common name once
+	history := keyHistory(found)
+	commonNames := []string{}
+	listed := map[string]bool{}
+	for _, cert := range history {
+		if !listed[cert.CommonName] {
+			listed[cert.CommonName] = true
+			commonNames = append(commonNames, cert.CommonName)
 		}
-		log.Println("FOUND: ", currMsg)
-		commonNames = append(commonNames, currMsg)
 	}
 	err = os.WriteFile(
 		filepath.Join(outDir, "commonName.txt"),
@@ -73,48 +187,98 @@ func GetSigs(inDir, outDir string) {
 	if err != nil {
 		log.Fatal("failed to write output to commonName.txt")
 	}
+	if err := os.WriteFile(filepath.Join(outDir, "signers.tsv"), []byte(rows), 0666); err != nil {
+		log.Fatal("failed to write output to signers.tsv")
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "keyHistory.tsv"), []byte(keyHistoryTSV(history)), 0666); err != nil {
+		log.Fatal("failed to write output to keyHistory.tsv")
+	}
+	if err := scope.WriteSummary(filepath.Join(outDir, "filterSummary.tsv")); err != nil {
+		log.Fatal("failed to write output to filterSummary.tsv")
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "errors.tsv"), []byte(errorsTSV(results)), 0666); err != nil {
+		log.Fatal("failed to write output to errors.tsv")
+	}
 }
 
-// goroutine processes 1 pst
-func processPST(file string, c chan string) {
-	pst.ExtendCharsets(func(name string, enc encoding.Encoding) {
-		charsets.RegisterEncoding(name, enc)
-	})
-
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("Panic: %+v\n", r)
+// errorsTSV is the error report, a row per error or warning with the file it was reading
+func errorsTSV(results []result) string {
+	var b strings.Builder
+	b.WriteString("File\tLevel\tMessage\n")
+	row := func(file, level, msg string) {
+		// keep 1 row per message, multi line errors from go-pst included
+		b.WriteString(file + "\t" + level + "\t" + strings.Join(strings.Fields(msg), " ") + "\n")
+	}
+	for _, res := range results {
+		for _, err := range res.Errs {
+			row(res.File, "error", err.Error())
 		}
-	}()
+		for _, warning := range res.Warnings {
+			row(res.File, "warning", warning)
+		}
+	}
+	return b.String()
+}
+
+// processPST reads 1 pst
+// the signers of all signed messages in the folders selected by opts come back as 1 result
+func processPST(file string, opts Options, scope *filter.Filter) (res result) {
+	res = result{File: file, Signers: []Signer{}}
+	defer res.recoverPanic()
 
 	reader, err := os.Open(file)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to open PST file: %+v\n", err))
+		res.errorf("failed to open PST file: %v", err)
+		return
 	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			res.errorf("failed to close PST file: %v", err)
+		}
+	}()
 
 	pstFile, err := pst.New(reader)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to open PST file: %+v\n", err))
+		res.errorf("failed to open PST file: %v", err)
+		return
 	}
+	defer pstFile.Cleanup()
 
-	defer func() {
-		pstFile.Cleanup()
-
-		if errClosing := reader.Close(); errClosing != nil {
-			log.Printf("Failed to close PST file: %+v\n", err)
+	sentID, hasSentID := outlook.SentFolder(pstFile)
+	isSent := func(folder *pst.Folder) bool {
+		if hasSentID {
+			return folder.Identifier == sentID
 		}
-		c <- ""
-	}()
+		return strings.EqualFold(folder.Name, "Sent Items")
+	}
+	// the sent folder is only looked for by its English name when the message store doesn't say which it is
+	needSent := len(opts.Folders) == 0 || opts.AllFolders
+	if needSent && !hasSentID {
+		res.warnf("the PST doesn't record its sent folder, reading folders named Sent Items")
+	}
+	var owner map[string]bool
+	if opts.AllFolders {
+		if owner, err = ownerOf(pstFile, isSent); err != nil {
+			res.errorf("failed to read sent mail: %v", err)
+			return
+		}
+		if len(owner) == 0 {
+			res.warnf("no sent mail to tell who owns the PST, kept signed messages from every sender")
+			owner = nil
+		}
+	}
 
 	// Walk through folders.
-	if err := pstFile.WalkFolders(func(folder *pst.Folder) error {
-		fmt.Printf("Walking folder: %s\n", folder.Name)
-
-		// Only iterate through messages in Sent Items
-		// if !(folder.Name == "Sent Items" || folder.Name == "sent items") {
-		if folder.Name != "Sent Items" && folder.Name != "sent items" {
+	sentFound := false
+	if err := outlook.WalkMailbox(pstFile, func(folder *pst.Folder, folderPath string) error {
+		sentFolder := isSent(folder)
+		if sentFolder {
+			sentFound = true
+		}
+		if !opts.AllFolders && !selectFolder(folderPath, sentFolder, opts.Folders) {
 			return nil
 		}
+		fmt.Printf("Walking folder: %s in %s\n", folderPath, file)
 
 		messageIterator, err := folder.GetMessageIterator()
 
@@ -129,7 +293,9 @@ func processPST(file string, c chan string) {
 		for messageIterator.Next() {
 			// Only process messages
 			message := messageIterator.Value()
-			switch message.Properties.(type) {
+			var sender string
+			var sent time.Time
+			switch messageProperties := message.Properties.(type) {
 			case *properties.Message:
 				// Check to see if this is a signed message.
 				// Message class will be "IPM.Note.SMIME.MultipartSigned"
@@ -172,6 +338,22 @@ func processPST(file string, c chan string) {
 				if messageClass != "IPM.Note.SMIME.MultipartSigned" {
 					continue
 				}
+				if submitted := messageProperties.GetClientSubmitTime(); submitted != 0 {
+					sent = time.Unix(0, submitted).UTC()
+				}
+				if owner != nil && !sentFolder && !owner[strings.ToLower(messageProperties.GetSenderEmailAddress())] &&
+					!owner[strings.ToLower(messageProperties.GetSenderName())] {
+					continue
+				}
+				if !scope.Keep(filter.Message{
+					Folder:     folderPath,
+					Date:       sent,
+					Sender:     []string{messageProperties.GetSenderName(), messageProperties.GetSenderEmailAddress()},
+					Recipients: []string{messageProperties.GetDisplayTo(), messageProperties.GetDisplayCc(), messageProperties.GetDisplayBcc()},
+				}) {
+					continue
+				}
+				sender = messageProperties.GetSenderEmailAddress()
 			default:
 				continue
 			}
@@ -194,7 +376,6 @@ func processPST(file string, c chan string) {
 				// sigContentType := regexp.MustCompile(`application/x?-?pkcs7-signature`)
 				sigContentType := regexp.MustCompile(`multipart/signed`)
 				if ok := sigContentType.MatchString(attachment.GetAttachMimeTag()); !ok {
-					log.Println("Content-Type not matched")
 					continue
 				}
 				// DEBUG: io.Pipe not working with attachment.WriteTo
@@ -203,88 +384,198 @@ func processPST(file string, c chan string) {
 				w := bufio.NewWriter(buf)
 				_, err := attachment.WriteTo(w)
 				if err != nil {
-					log.Println("Failed to write attachment", err)
-					c <- ""
+					res.errorf("message %d: failed to write attachment: %v", message.Identifier, err)
 					continue
 				}
-				// log.Println("Wrote attachment bytes: ", n)
 				w.Flush()
 				msg, err := mail.ReadMessage(buf)
 				if err != nil {
-					log.Println("Failed to read message", err)
-					c <- ""
-					continue
-				}
-				var bodyBytes []byte
-				if _, err = msg.Body.Read(bodyBytes); err != nil {
-					log.Println("Failed to read msg body", err)
-					c <- ""
+					res.errorf("message %d: failed to read message: %v", message.Identifier, err)
 					continue
 				}
 
-				// Iterate through msg parts until we get to the smime.p7s
-				_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+				signatures, err := signatures(msg)
 				if err != nil {
-					log.Println("Failed to parse media type", err)
-					c <- ""
-					continue
+					res.errorf("message %d: failed to parse signature: %v", message.Identifier, err)
 				}
-				mr := multipart.NewReader(msg.Body, params["boundary"])
-				eof := false
-				for !eof {
-					p, err := mr.NextPart()
-					if err == io.EOF {
-						eof = true
-						continue
-					}
-					if err != nil {
-						log.Println("Failed to get next part", err)
-						c <- ""
-						continue
-					}
-					partEncoding := p.Header["Content-Transfer-Encoding"]
-					if len(partEncoding) == 0 {
-						continue
-					}
-					if partEncoding[0] != "base64" {
-						continue
-					}
-					slurp, err := io.ReadAll(p)
-					if err != nil {
-						log.Println("Failed to read part", err)
-						c <- ""
-						continue
-					}
-					// parse the pkcs7 struct
-					dst := make([]byte, len(slurp))
-					n, err := base64.StdEncoding.Decode(dst, slurp)
-					if err != nil {
-						log.Println("Failed to base64 decode", err)
-						// c <- ""
-						continue
-					}
-					dst = dst[:n]
-					p7m, err := pkcs7.Parse(dst)
-					if err != nil {
-						log.Println("Failed to parse pkcs7 object", err)
-						c <- ""
+				for _, p7 := range signatures {
+					signer, ok := signerOf(p7, sender)
+					if !ok {
 						continue
 					}
-
-					// Get the signer info - this is the main objective!
-					signer := p7m.GetOnlySigner()
-
-					// Common Name is in the form LAST.FIRST.MIDDLE.EDIPI
-					cn := signer.Subject.CommonName
-					c <- cn
+					signer.Source = fmt.Sprintf("%s#%d", file, message.Identifier)
+					signer.Sent = sent
+					res.Signers = append(res.Signers, signer)
 				}
 			}
 		}
 		return messageIterator.Err()
 	}); err != nil {
-		c <- ""
+		res.errorf("failed to walk folders: %v", err)
+	} else if needSent && !sentFound {
+		res.warnf("no sent folder found, pick it by name with folders")
+	}
+	return
+}
+
+// processMbox reads 1 mbox
+// the signers of all signed messages come back as 1 result
+func processMbox(file string, variant mbox.Variant, scope *filter.Filter) (res result) {
+	res = result{File: file, Signers: []Signer{}}
+	defer res.recoverPanic()
+
+	reader, err := os.Open(file)
+	if err != nil {
+		res.errorf("failed to open mbox file: %v", err)
 		return
 	}
+	defer reader.Close()
+
+	mr := mbox.NewReader(reader, variant)
+	for {
+		m, err := mr.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			res.errorf("failed to read mbox file: %v", err)
+			return
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+		if err != nil {
+			res.errorf("message %d: failed to read message: %v", m.Offset, err)
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/signed" {
+			continue
+		}
+		msgScope := mboxScope(msg.Header)
+		if !scope.Keep(msgScope) {
+			continue
+		}
+		signatures, err := signatures(msg)
+		if err != nil {
+			res.errorf("message %d: failed to parse signature: %v", m.Offset, err)
+		}
+		for _, p7 := range signatures {
+			signer, ok := signerOf(p7, msg.Header.Get("From"))
+			if !ok {
+				continue
+			}
+			signer.Source = fmt.Sprintf("%s#%d", file, m.Offset)
+			signer.Sent = msgScope.Date
+			res.Signers = append(res.Signers, signer)
+		}
+	}
+}
+
+// parseMu serializes pkcs7.Parse across the workers, its BER to DER conversion keeps a package level counter
+var parseMu sync.Mutex
 
-	c <- ""
+// signatures iterates through the parts of a multipart/signed msg until we get to the smime.p7s
+// and returns each signature. Parts that fail to decode or parse are skipped and joined into the error,
+// the signatures that did parse are still returned.
+func signatures(msg *mail.Message) ([]*pkcs7.PKCS7, error) {
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	found := []*pkcs7.PKCS7{}
+	var partErrs []error
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return found, errors.Join(partErrs...)
+		}
+		if err != nil {
+			return found, errors.Join(append(partErrs, err)...)
+		}
+		partEncoding := p.Header["Content-Transfer-Encoding"]
+		if len(partEncoding) == 0 {
+			continue
+		}
+		if partEncoding[0] != "base64" {
+			continue
+		}
+		slurp, err := io.ReadAll(p)
+		if err != nil {
+			return found, errors.Join(append(partErrs, err)...)
+		}
+		// parse the pkcs7 struct
+		dst := make([]byte, len(slurp))
+		n, err := base64.StdEncoding.Decode(dst, slurp)
+		if err != nil {
+			partErrs = append(partErrs, fmt.Errorf("failed to base64 decode: %w", err))
+			continue
+		}
+		dst = dst[:n]
+		parseMu.Lock()
+		p7m, err := pkcs7.Parse(dst)
+		parseMu.Unlock()
+		if err != nil {
+			partErrs = append(partErrs, fmt.Errorf("failed to parse pkcs7 object: %w", err))
+			continue
+		}
+
+		// the signer info is the main objective, it is read with the rest of the signed data
+		found = append(found, p7m)
+	}
+}
+
+// mboxScope is what the filters look at in a message header. mbox has no folders.
+func mboxScope(header mail.Header) filter.Message {
+	m := filter.Message{NoFolders: true}
+	if date, err := header.Date(); err == nil {
+		m.Date = date
+	}
+	m.Sender = []string{header.Get("From")}
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		m.Recipients = append(m.Recipients, header.Get(key))
+	}
+	return m
+}
+
+// selectFolder is true when a folder glob matches the folder's name or path,
+// or when there are no globs and the folder is the sent folder
+func selectFolder(folderPath string, sentFolder bool, globs []string) bool {
+	if len(globs) == 0 {
+		return sentFolder
+	}
+	for _, glob := range globs {
+		if filter.MatchFolder(glob, folderPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerOf collects the lowercased sender addresses and names of the messages in the sent folder.
+// Whoever sent those is the owner of the PST.
+func ownerOf(pstFile *pst.File, isSent func(folder *pst.Folder) bool) (map[string]bool, error) {
+	owner := map[string]bool{}
+	err := outlook.WalkMailbox(pstFile, func(folder *pst.Folder, folderPath string) error {
+		if !isSent(folder) {
+			return nil
+		}
+		messageIterator, err := folder.GetMessageIterator()
+		if eris.Is(err, pst.ErrMessagesNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for messageIterator.Next() {
+			messageProperties, ok := messageIterator.Value().Properties.(*properties.Message)
+			if !ok {
+				continue
+			}
+			for _, sender := range []string{messageProperties.GetSenderEmailAddress(), messageProperties.GetSenderName()} {
+				if sender != "" {
+					owner[strings.ToLower(sender)] = true
+				}
+			}
+		}
+		return messageIterator.Err()
+	})
+	return owner, err
 }
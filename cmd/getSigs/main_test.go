@@ -1,16 +1,118 @@
 package getsigs
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
-// TODO test broken after refactor to multithreading
+// The original expectation had Email: sender@local and Principle Name: 12345678@mil. Neither is in the signer cert:
+// sender@local is the address the message was sent from, now in Sender, and 12345678@mil was made up from the EDIPI.
+// The cert carries no UPN, and its own email is the emailAddress in its Subject.
 func TestProcessPST(t *testing.T) {
 	testFile := "../../testdata/pstIn/TEST.pst"
-	c := make(chan string)
-	expected := "Name: LAST, FIRST MIDDLE\nEmail: sender@local\nEDIPI: 12345678\nPrinciple Name: 12345678@mil\nSerial: 12c3905b55296e401270c0ceb18b5ba660db9a1f\nIssuer: CN=LAST.FIRST.MIDDLE.12345678,OU=Forensics,O=USACE,L=Jacksonville,ST=FL,C=US,1.2.840.113549.1.9.1=#0c1d47726164792e432e44656e746f6e4075736163652e61726d792e6d696c\nCertificate Authority: LAST.FIRST.MIDDLE.12345678\nNot Before: 2020-04-17 15:56:38 +0000 UTC\nNot After: 2021-04-17 15:56:38 +0000 UTC"
-	go processPST(testFile, c)
-	actual := <-c
+	expected := "Name: LAST, FIRST MIDDLE\nEmail: Grady.C.Denton@usace.army.mil\nEDIPI: 12345678\nSerial: 12c3905b55296e401270c0ceb18b5ba660db9a1f\nIssuer: CN=LAST.FIRST.MIDDLE.12345678,OU=Forensics,O=USACE,L=Jacksonville,ST=FL,C=US,1.2.840.113549.1.9.1=#0c1d47726164792e432e44656e746f6e4075736163652e61726d792e6d696c\nCertificate Authority: LAST.FIRST.MIDDLE.12345678\nNot Before: 2020-04-17 15:56:38 +0000 UTC\nNot After: 2021-04-17 15:56:38 +0000 UTC"
+	res := processPST(testFile, Options{}, nil)
+	if len(res.Errs) != 0 {
+		t.Errorf("Expected no errors, but got %v", res.Errs)
+	}
+	// TEST.pst has no sent folder entry ID, so Sent Items is found by name
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "reading folders named Sent Items") {
+		t.Errorf("Expected a warning about finding the sent folder by name, but got %v", res.Warnings)
+	}
+	signers := res.Signers
+	if len(signers) != 1 {
+		t.Fatalf("Expected 1 signer, but got %d", len(signers))
+	}
+	actual := signers[0].String()
+	if signers[0].Sender != "sender@local" {
+		t.Errorf("Expected the sender sender@local, but got %s", signers[0].Sender)
+	}
 
 	if actual != expected {
 		t.Errorf("Expected\n%s\n but got\n%s", expected, actual)
 	}
 }
+
+func TestProcessPSTFolders(t *testing.T) {
+	testFile := "../../testdata/pstIn/TEST.pst"
+	for _, test := range []struct {
+		name    string
+		opts    Options
+		signers int
+	}{
+		{"other folder", Options{Folders: []string{"Inbox"}}, 0},
+		{"folder path glob", Options{Folders: []string{"Inbox/*/deep/*", "Sent*"}}, 1},
+		{"all folders sent by the owner", Options{AllFolders: true}, 1},
+	} {
+		if signers := processPST(testFile, test.opts, nil).Signers; len(signers) != test.signers {
+			t.Errorf("%s: expected %d signers, but got %d", test.name, test.signers, len(signers))
+		}
+	}
+}
+
+func TestSelectFolder(t *testing.T) {
+	for _, test := range []struct {
+		folderPath string
+		sent       bool
+		globs      []string
+		expected   bool
+	}{
+		{"Gesendete Elemente", true, nil, true},
+		{"Sent Items", false, nil, false},
+		{"Archive/2020/Sent", false, []string{"Archive/*/Sent"}, true},
+		{"Archive/2020/Sent", false, []string{"Sent"}, true},
+		{"Gesendete Elemente", true, []string{"Inbox"}, false},
+		{"", false, []string{"*"}, false},
+	} {
+		if actual := selectFolder(test.folderPath, test.sent, test.globs); actual != test.expected {
+			t.Errorf("selectFolder(%q, %v, %v): expected %v", test.folderPath, test.sent, test.globs, test.expected)
+		}
+	}
+}
+
+func TestGetSigsErrors(t *testing.T) {
+	in := t.TempDir()
+	out := t.TempDir()
+	pst, err := os.ReadFile("../../testdata/pstIn/TEST.pst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a PST cut short after its header is still recognized as a store, but can't be walked
+	for name, data := range map[string][]byte{"a.pst": pst, "b.pst": pst[:len(pst)/4], "c.pst": pst} {
+		if err := os.WriteFile(filepath.Join(in, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	GetSigs(in, out, Options{Workers: 2})
+
+	report, err := os.ReadFile(filepath.Join(out, "errors.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSuffix(string(report), "\n"), "\n")
+	if rows[0] != "File\tLevel\tMessage" || len(rows) < 2 {
+		t.Fatalf("Expected errors for the truncated PST, but got\n%s", report)
+	}
+	errorRows := 0
+	for _, row := range rows[1:] {
+		if strings.Contains(row, "\twarning\t") {
+			continue
+		}
+		errorRows++
+		if !strings.HasPrefix(row, filepath.Join(in, "b.pst")+"\terror\t") {
+			t.Errorf("Expected only the truncated PST to have errors, but got %q", row)
+		}
+	}
+	if errorRows == 0 {
+		t.Errorf("Expected errors for the truncated PST, but got\n%s", report)
+	}
+	signers, err := os.ReadFile(filepath.Join(out, "signers.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.Count(string(signers), "\n"); rows != 3 {
+		t.Errorf("Expected the signers of both whole PSTs, but got\n%s", signers)
+	}
+}
@@ -0,0 +1,120 @@
+package getsigs
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/McFlip/enigma/cmd/filter"
+	"github.com/McFlip/enigma/cmd/mbox"
+	"github.com/smallstep/pkcs7"
+	"github.com/youmark/pkcs8"
+)
+
+const testSerial = "12c3905b55296e401270c0ceb18b5ba660db9a1f"
+
+// signedMsg returns a multipart/signed message with a detached signature by the testdata cert
+func signedMsg(t *testing.T) string {
+	t.Helper()
+	certBytes, err := os.ReadFile(filepath.Join("../../testdata/certIn", testSerial+".cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := os.ReadFile(filepath.Join("../../testdata/keyIn", testSerial+".key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(keyBytes, []byte("MrGlitter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "Content-Type: text/plain\r\n\r\nsigned body\r\n"
+	sd, err := pkcs7.NewSignedData([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	der, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "From: sender@local\n" +
+		"Date: Fri, 17 Apr 2020 16:00:00 +0000\n" +
+		"Subject: signed\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=\"b1\"\n\n" +
+		"--b1\n" + content +
+		"--b1\nContent-Type: application/pkcs7-signature; name=\"smime.p7s\"\n" +
+		"Content-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(der) + "\n" +
+		"--b1--\n"
+}
+
+func TestProcessMbox(t *testing.T) {
+	in := "From sender@local Fri Apr 17 16:00:00 2020\n" + signedMsg(t) + "\n" +
+		"From sender@local Fri Apr 17 17:00:00 2020\nSubject: unsigned\n\nbody\n"
+	path := filepath.Join(t.TempDir(), "sent.mbox")
+	if err := os.WriteFile(path, []byte(in), 0666); err != nil {
+		t.Fatal(err)
+	}
+	signers := processMbox(path, mbox.MboxRD, nil).Signers
+
+	if len(signers) != 1 {
+		t.Fatalf("Expected 1 signer, but got %d", len(signers))
+	}
+	actual := signers[0]
+	if actual.CommonName != "LAST.FIRST.MIDDLE.12345678" || actual.Email != "Grady.C.Denton@usace.army.mil" || actual.Sender != "sender@local" || actual.Source != path+"#0" {
+		t.Errorf("Expected the signer of %s#0, but got %+v", path, actual)
+	}
+	if !actual.Sent.Equal(time.Date(2020, 4, 17, 16, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the date sent, but got %v", actual.Sent)
+	}
+}
+
+func TestProcessMboxFilter(t *testing.T) {
+	in := "From sender@local Fri Apr 17 16:00:00 2020\n" + signedMsg(t)
+	path := filepath.Join(t.TempDir(), "sent.mbox")
+	if err := os.WriteFile(path, []byte(in), 0666); err != nil {
+		t.Fatal(err)
+	}
+	criteria, err := filter.Parse("", "", "", "^someone@", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := filter.New(criteria)
+	if actual := processMbox(path, mbox.MboxRD, scope).Signers; len(actual) != 0 {
+		t.Errorf("Expected the message from another sender to be left out, but got\n%v", actual)
+	}
+	expected := "Filter\tSetting\tCount\nsender\t^someone@\t1\nkept\t\t0\n"
+	if scope.Summary() != expected {
+		t.Errorf("Expected\n%s\n but got\n%s", expected, scope.Summary())
+	}
+}
+
+func TestProcessMboxBadSignature(t *testing.T) {
+	in := "From sender@local Fri Apr 17 16:00:00 2020\n" +
+		"From: sender@local\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: text/plain\n\nsigned body\n" +
+		"--b1\nContent-Type: application/pkcs7-signature\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte("not a signature")) + "\n" +
+		"--b1--\n"
+	path := filepath.Join(t.TempDir(), "sent.mbox")
+	if err := os.WriteFile(path, []byte(in), 0666); err != nil {
+		t.Fatal(err)
+	}
+	res := processMbox(path, mbox.MboxRD, nil)
+	if len(res.Signers) != 0 || len(res.Errs) != 1 || !strings.Contains(res.Errs[0].Error(), "failed to parse pkcs7 object") {
+		t.Errorf("Expected the signature that doesn't parse in the errors, but got %v", res.Errs)
+	}
+}
@@ -0,0 +1,279 @@
+package getsigs
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Signer is the profile of a signer cert, what is needed to request the custodian's keys from escrow
+type Signer struct {
+	CommonName string
+	// Name is read from a Common Name in the form LAST.FIRST.MIDDLE.EDIPI, ex. LAST, FIRST MIDDLE
+	Name string
+	// Email is the cert's own address, or the sender's when the cert has none
+	Email string
+	EDIPI string
+	// UPN is the user principal name used to log on with the card, ex. 12345678@mil. Empty when the cert has none.
+	UPN                 string
+	Serial              string
+	Issuer              string
+	CA                  string
+	NotBefore, NotAfter time.Time
+	KeyUsage            []string
+	ExtKeyUsage         []string
+	// Source is the message the cert was found in, ex. sent.pst#2097252 or sent.mbox#0
+	Source string
+	// Sent is when that message was sent, zero when unknown
+	Sent time.Time
+	// Sender is the address that message was sent from, which may not be the signer's when it was forwarded or delegated
+	Sender string
+	// EncryptionSerial and EncryptionIssuer name the cert the signer is sent encrypted mail with,
+	// the cert escrow holds the key for. Empty when the signature doesn't say and the signing cert can't encrypt.
+	EncryptionSerial, EncryptionIssuer string
+	// EncryptionNotAfter is zero when the encryption cert wasn't sent with the signature
+	EncryptionNotAfter time.Time
+	// EncryptionFrom is how the encryption cert was found, ex. key preference
+	EncryptionFrom string
+	// Capabilities are the algorithms the signer's mail client can decrypt, in order of preference
+	Capabilities []string
+}
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidUPN            = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+	oidEmailAddress   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+	oidSmartCardLogon = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}
+)
+
+// dodCommonName is LAST.FIRST.MIDDLE.EDIPI. Middle is left out when there is none.
+var dodCommonName = regexp.MustCompile(`^([^.]+)\.([^.]+(?:\.[^.]+)*?)\.(\d+)$`)
+
+// newSigner reads the profile of cert. sender is the address the message was sent from,
+// used as the email only when the cert has none.
+func newSigner(cert *x509.Certificate, sender string) Signer {
+	s := Signer{
+		CommonName: cert.Subject.CommonName,
+		Name:       cert.Subject.CommonName,
+		Serial:     fmt.Sprintf("%x", cert.SerialNumber),
+		Issuer:     distinguishedName(cert.Issuer),
+		CA:         cert.Issuer.CommonName,
+		NotBefore:  cert.NotBefore.UTC(),
+		NotAfter:   cert.NotAfter.UTC(),
+		KeyUsage:   keyUsages(cert.KeyUsage),
+	}
+	if m := dodCommonName.FindStringSubmatch(cert.Subject.CommonName); m != nil {
+		s.Name = m[1] + ", " + strings.ReplaceAll(m[2], ".", " ")
+		s.EDIPI = m[3]
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		name, ok := extKeyUsageNames[usage]
+		if !ok {
+			name = fmt.Sprintf("x509.ExtKeyUsage(%d)", usage)
+		}
+		s.ExtKeyUsage = append(s.ExtKeyUsage, name)
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		name := oid.String()
+		if oid.Equal(oidSmartCardLogon) {
+			name = "Smart Card Logon"
+		}
+		s.ExtKeyUsage = append(s.ExtKeyUsage, name)
+	}
+
+	if addr, err := mail.ParseAddress(sender); err == nil {
+		s.Sender = addr.Address
+	}
+	// the SAN is what mail clients check, then the legacy Subject attribute. The mailbox the message came from
+	// is the last resort, a forwarded or delegated message may not be the signer's.
+	if len(cert.EmailAddresses) > 0 {
+		s.Email = cert.EmailAddresses[0]
+	} else {
+		for _, name := range cert.Subject.Names {
+			if email, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+				s.Email = email
+				break
+			}
+		}
+	}
+	if s.Email == "" {
+		s.Email = s.Sender
+	}
+	s.UPN = upn(cert)
+	return s
+}
+
+// upn reads the Microsoft UPN otherName from the Subject Alternative Name, which Go's x509 skips
+func upn(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return ""
+		}
+		for _, name := range names {
+			// otherName [0] { type-id OBJECT IDENTIFIER, value [0] EXPLICIT ANY }
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var otherName struct {
+				TypeID asn1.ObjectIdentifier
+				Value  asn1.RawValue `asn1:"explicit,tag:0"`
+			}
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &otherName, "tag:0"); err != nil || !otherName.TypeID.Equal(oidUPN) {
+				continue
+			}
+			var value string
+			if _, err := asn1.UnmarshalWithParams(otherName.Value.Bytes, &value, "utf8"); err == nil {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// distinguishedName renders name like pkix.Name.String, but attributes without a short name, ex. emailAddress,
+// are always hex encoded DER. Newer Go releases print those as text, which would change the Issuer between builds.
+func distinguishedName(name pkix.Name) string {
+	var rdns pkix.RDNSequence
+	if name.ExtraNames == nil {
+		// surface the attributes pkix.Name has no field for, as pkix.Name.String does
+		for _, atv := range name.Names {
+			if !namedAttribute(atv.Type) {
+				rdns = append(rdns, pkix.RelativeDistinguishedNameSET{atv})
+			}
+		}
+	}
+	rdns = append(rdns, name.ToRDNSequence()...)
+	for _, rdn := range rdns {
+		for i, atv := range rdn {
+			if namedAttribute(atv.Type) {
+				continue
+			}
+			if der, err := asn1.Marshal(atv.Value); err == nil {
+				rdn[i].Value = asn1.RawValue{FullBytes: der}
+			}
+		}
+	}
+	return rdns.String()
+}
+
+// namedAttribute is true for the attribute types pkix prints by name, ex. CN
+func namedAttribute(t asn1.ObjectIdentifier) bool {
+	if len(t) != 4 || t[0] != 2 || t[1] != 5 || t[2] != 4 {
+		return false
+	}
+	switch t[3] {
+	case 3, 5, 6, 7, 8, 9, 10, 11, 17:
+		return true
+	}
+	return false
+}
+
+var keyUsageNames = []string{
+	"Digital Signature",
+	"Non Repudiation",
+	"Key Encipherment",
+	"Data Encipherment",
+	"Key Agreement",
+	"Certificate Sign",
+	"CRL Sign",
+	"Encipher Only",
+	"Decipher Only",
+}
+
+func keyUsages(usage x509.KeyUsage) []string {
+	names := []string{}
+	for i, name := range keyUsageNames {
+		if usage&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "Server Authentication",
+	x509.ExtKeyUsageClientAuth:      "Client Authentication",
+	x509.ExtKeyUsageCodeSigning:     "Code Signing",
+	x509.ExtKeyUsageEmailProtection: "Email Protection",
+	x509.ExtKeyUsageTimeStamping:    "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSP Signing",
+}
+
+// String is the profile as it is logged, 1 field per line. The UPN and key usages are only listed when the cert
+// has them, and the encryption cert when it isn't the signing cert.
+func (s Signer) String() string {
+	lines := []string{
+		"Name: " + s.Name,
+		"Email: " + s.Email,
+		"EDIPI: " + s.EDIPI,
+	}
+	if s.UPN != "" {
+		lines = append(lines, "Principle Name: "+s.UPN)
+	}
+	lines = append(lines,
+		"Serial: "+s.Serial,
+		"Issuer: "+s.Issuer,
+		"Certificate Authority: "+s.CA,
+		"Not Before: "+s.NotBefore.String(),
+		"Not After: "+s.NotAfter.String(),
+	)
+	if len(s.KeyUsage) > 0 {
+		lines = append(lines, "Key Usage: "+strings.Join(s.KeyUsage, ", "))
+	}
+	if len(s.ExtKeyUsage) > 0 {
+		lines = append(lines, "Extended Key Usage: "+strings.Join(s.ExtKeyUsage, ", "))
+	}
+	if s.EncryptionSerial != "" && s.EncryptionSerial != s.Serial {
+		lines = append(lines,
+			"Encryption Serial: "+s.EncryptionSerial,
+			"Encryption Issuer: "+s.EncryptionIssuer,
+		)
+	}
+	return strings.Join(lines, "\n")
+}
+
+const signersHeader = "Common Name\tName\tEmail\tEDIPI\tUPN\tSerial\tIssuer\tCertificate Authority\tNot Before\tNot After\tKey Usage\tExtended Key Usage\tSource\tSent\tSender\t" +
+	"Encryption Serial\tEncryption Issuer\tEncryption Not After\tEncryption From\tSMIME Capabilities\n"
+
+// row is the profile as a row of signers.tsv
+func (s Signer) row() string {
+	sent, encryptionNotAfter := "", ""
+	if !s.Sent.IsZero() {
+		sent = s.Sent.Format(time.RFC3339)
+	}
+	if !s.EncryptionNotAfter.IsZero() {
+		encryptionNotAfter = s.EncryptionNotAfter.Format(time.RFC3339)
+	}
+	return strings.Join([]string{
+		s.CommonName,
+		s.Name,
+		s.Email,
+		s.EDIPI,
+		s.UPN,
+		s.Serial,
+		s.Issuer,
+		s.CA,
+		s.NotBefore.Format(time.RFC3339),
+		s.NotAfter.Format(time.RFC3339),
+		strings.Join(s.KeyUsage, "; "),
+		strings.Join(s.ExtKeyUsage, "; "),
+		s.Source,
+		sent,
+		s.Sender,
+		s.EncryptionSerial,
+		s.EncryptionIssuer,
+		encryptionNotAfter,
+		s.EncryptionFrom,
+		strings.Join(s.Capabilities, "; "),
+	}, "\t") + "\n"
+}
@@ -0,0 +1,116 @@
+package getsigs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upnSAN is a Subject Alternative Name with an email and a UPN otherName
+func upnSAN(t *testing.T, email, upn string) pkix.Extension {
+	t.Helper()
+	value, err := asn1.MarshalWithParams(upn, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherName, err := asn1.MarshalWithParams(struct {
+		TypeID asn1.ObjectIdentifier
+		Value  asn1.RawValue
+	}{oidUPN, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value}}, "tag:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	san, err := asn1.Marshal([]asn1.RawValue{
+		{FullBytes: otherName},
+		{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte(email)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: oidSubjectAltName, Value: san}
+}
+
+func TestNewSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:       big.NewInt(0xabc),
+		Subject:            pkix.Name{CommonName: "DOE.JANE.1234567890"},
+		NotBefore:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:           time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{oidSmartCardLogon},
+		ExtraExtensions:    []pkix.Extension{upnSAN(t, "jane.doe@mail.mil", "1234567890A@mil")},
+	}
+	ca := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "DOD EMAIL CA-59"}}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSigner(cert, `"Doe, Jane" <jdoe@local>`)
+	expected := Signer{
+		CommonName:  "DOE.JANE.1234567890",
+		Name:        "DOE, JANE",
+		Email:       "jane.doe@mail.mil",
+		EDIPI:       "1234567890",
+		UPN:         "1234567890A@mil",
+		Serial:      "abc",
+		Issuer:      "CN=DOD EMAIL CA-59",
+		CA:          "DOD EMAIL CA-59",
+		NotBefore:   template.NotBefore,
+		NotAfter:    template.NotAfter,
+		KeyUsage:    []string{"Digital Signature", "Non Repudiation"},
+		ExtKeyUsage: []string{"Email Protection", "Smart Card Logon"},
+		Sender:      "jdoe@local",
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected\n%+v\n but got\n%+v", expected, s)
+	}
+	if !strings.HasSuffix(s.String(), "\nKey Usage: Digital Signature, Non Repudiation\nExtended Key Usage: Email Protection, Smart Card Logon") {
+		t.Errorf("Expected key usages at the end of\n%s", s)
+	}
+	if row := s.row(); len(strings.Split(row, "\t")) != len(strings.Split(signersHeader, "\t")) {
+		t.Errorf("Expected a column for each header in %q", row)
+	}
+
+	// without a SAN the Subject email is the cert's, the sender is only a fallback, and no UPN is made up
+	template.ExtraExtensions = nil
+	template.Subject.ExtraNames = []pkix.AttributeTypeAndValue{{Type: oidEmailAddress, Value: "jane.doe@subject.mil"}}
+	der, err = x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	if s := newSigner(cert, `"Doe, Jane" <jdoe@local>`); s.Email != "jane.doe@subject.mil" || s.UPN != "" || s.Sender != "jdoe@local" {
+		t.Errorf("Expected the Subject email, the sender and no UPN, but got %+v", s)
+	}
+	template.Subject.ExtraNames = nil
+	der, err = x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	if s := newSigner(cert, `"Doe, Jane" <jdoe@local>`); s.Email != "jdoe@local" {
+		t.Errorf("Expected the sender when the cert has no email, but got %q", s.Email)
+	}
+}
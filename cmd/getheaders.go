@@ -21,25 +21,13 @@ THE SOFTWARE.
 */package cmd
 
 import (
-	"errors"
-	"fmt"
-	"io/fs"
 	"log"
-	"os"
-	"path/filepath"
-	"strings"
-	"time"
-	"unicode"
 
-	pst "github.com/mooijtech/go-pst/v6/pkg"
-	"github.com/mooijtech/go-pst/v6/pkg/properties"
-	"github.com/rotisserie/eris"
-	"golang.org/x/text/encoding"
+	getheaders "github.com/McFlip/enigma/cmd/getHeaders"
+	"github.com/McFlip/enigma/cmd/mbox"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-
-	charsets "github.com/emersion/go-message/charset"
 )
 
 // getheadersCmd represents the getheaders command
@@ -48,228 +36,87 @@ var getheadersCmd = &cobra.Command{
 	Short: "Get metadata from email headers",
 	Long: `Get metadata from email headers
 
-  Place input PST files in header_in
+  Place input PST, OST, Outlook .msg or mbox files in header_in.
+  OST offline caches are read like PSTs, except the compressed 4K page OST
+  of Outlook 2013 and later, which has to be exported to a PST first.
   Tab delimited csv file will output in header_out
-
-  *NOTE* This only looks at email headers 1 level deep.
-  It will not examine emails attached to other emails`,
+  mbox messages are listed in the PstFile column as name#offset,
+  where offset is the byte offset of the message's From line.
+
+  Emails attached to other emails get a row of their own, to any depth.
+  The ID column locates each message, ParentID is the ID of the email
+  it is attached to and Depth counts the levels down from the top.
+
+  The SMTP From/To/Cc addresses, Received chain, Return-Path,
+  X-Originating-IP and Content-Type are broken out of the transport
+  headers. Set 'rawHeaders' to also write each message's whole header
+  block to transportHeaders.jsonl, keyed by ID.
+
+  To, CC and BCC are display names. The Recipients column lists every
+  recipient as Type: Name <address>, read from the recipient table, with
+  Exchange recipients resolved to their SMTP address where the PST has it.
+
+  SMIMEType is encrypted, clear-signed, opaque-signed or none, worked out
+  from the message class and the MIME types of the attachments. Messages
+  where these are missing or disagree are flagged unknown for review.
+
+  Files are read in parallel, 'workers' at a time (default one per CPU).
+  Rows still come out in the same order as a single worker would write them.
+  A file that can't be read, ex. a corrupt PST, doesn't stop the run. It is
+  listed in the custodian's errors.tsv, with whatever rows were read before it.
+  A message whose recipients can't be read is written without them and its
+  error is listed in errors.tsv too, as is an mbox message that can't be parsed.
+
+  The shared filters (from-date, to-date, folder, sender, recipient) scope
+  the report. Emails attached to a message are in or out with it, and
+  filterSummary.tsv counts the messages each filter left out.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		viper.SetDefault("header.header_in", "header_in")
 		*header_in = viper.GetString("header.header_in")
 		viper.SetDefault("header.header_out", "header_out")
 		*header_out = viper.GetString("header.header_out")
+		viper.SetDefault("header.mboxVariant", string(mbox.MboxRD))
+		*headerMboxVariant = viper.GetString("header.mboxVariant")
+		if *headerMboxVariant != string(mbox.MboxRD) && *headerMboxVariant != string(mbox.MboxO) {
+			log.Fatal("mboxVariant must be one of: mboxrd, mboxo")
+		}
 
-		var outDir string
-		var logFile *os.File
-
-		pst.ExtendCharsets(func(name string, enc encoding.Encoding) {
-			charsets.RegisterEncoding(name, enc)
-		})
-
-		// Walk PST files
-		filepath.Walk(*header_in, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			if info.IsDir() {
-				// Processing custodian folder
-				// close previous custodian's log
-				if logFile != nil {
-					logFile.Sync()
-					logFile.Close()
-				}
-
-				// for custodian input dir create custodian output dir
-				base := filepath.Base(path)
-				if base == *header_in {
-					return nil
-				}
-				outDir = filepath.Join(*header_out, base)
-				err := os.Mkdir(outDir, 0755)
-				if err != nil {
-					log.Fatal(
-						"Error making custodian subfolder in header_out outpath ",
-						outDir,
-						" err: ",
-						err,
-					)
-				}
-
-				// open log
-				logPath := filepath.Join(outDir, "headerMetaData.tsv")
-				if _, err := os.Stat(logPath); err != nil {
-					if errors.Is(err, os.ErrNotExist) {
-						logFile, err = os.OpenFile(
-							logPath,
-							os.O_WRONLY|os.O_CREATE|os.O_APPEND,
-							0644,
-						)
-						if err != nil {
-							log.Fatalf("Can't open log file %s to write results", logPath)
-						}
-						// TSV header
-						logFile.WriteString(
-							"PstFile\tFolder\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tHasAttachments\tIsEncrypted\tAttachmentFileNames\n",
-						)
-					}
-				} else {
-					logFile, err = os.OpenFile(
-						logPath,
-						os.O_WRONLY|os.O_CREATE|os.O_APPEND,
-						0644,
-					)
-					if err != nil {
-						log.Fatalf("Can't open log file %s to write results", logPath)
-					}
-				}
-			} else {
-
-				// Processing custodian PST files
-
-				// open file; create reader
-				if filepath.Ext(info.Name()) != ".pst" {
-					log.Fatal("getheaders input must be pst files")
-				}
-				reader, err := os.Open(path)
-				if err != nil {
-					panic(fmt.Sprintf("Failed to open PST file: %+v\n", err))
-				}
-				pstFile, err := pst.New(reader)
-				if err != nil {
-					panic(fmt.Sprintf("Failed to open PST file: %+v\n", err))
-				}
-				defer func() {
-					pstFile.Cleanup()
-
-					if errClosing := reader.Close(); errClosing != nil {
-						panic(fmt.Sprintf("Failed to close PST file: %+v\n", err))
-					}
-				}()
-
-				// Walk through folders inside PST.
-				if err := pstFile.WalkFolders(func(folder *pst.Folder) error {
-					fmt.Printf("Walking folder: %s\n", folder.Name)
-
-					messageIterator, err := folder.GetMessageIterator()
-
-					if eris.Is(err, pst.ErrMessagesNotFound) {
-						// Folder has no messages.
-						return nil
-					} else if err != nil {
-						return err
-					}
-
-					// Iterate through messages.
-					for messageIterator.Next() {
-						message := messageIterator.Value()
-						var b strings.Builder
-
-						// We only care about messages, not calendar items etc.
-						switch messageProperties := message.Properties.(type) {
-						case *properties.Message:
-							b.Write([]byte(info.Name()))
-							b.WriteRune('\t')
-							b.Write([]byte(folder.Name))
-							b.WriteRune('\t')
-							b.Write([]byte(messageProperties.GetSenderName()))
-							b.WriteRune('\t')
-							b.Write([]byte(messageProperties.GetDisplayTo()))
-							b.WriteRune('\t')
-							b.Write([]byte(messageProperties.GetDisplayCc()))
-							b.WriteRune('\t')
-							b.Write([]byte(messageProperties.GetDisplayBcc()))
-							b.WriteRune('\t')
-							// subject string has non-printable characters causing problems in Excel when opening csv
-							subject := messageProperties.GetSubject()
-							subject = strings.Map(func(r rune) rune {
-								if unicode.IsPrint(r) {
-									return r
-								}
-								return -1
-							}, subject)
-							b.Write([]byte(subject))
-							b.WriteRune('\t')
-							// Date is encoded as Unix nanosecond timestamp
-							timestamp := time.Unix(0, messageProperties.GetClientSubmitTime()).UTC()
-							b.Write([]byte(timestamp.Format(time.UnixDate)))
-							b.WriteRune('\t')
-							b.Write([]byte(messageProperties.GetInternetMessageId()))
-							b.WriteRune('\t')
-							hasAttach, _ := message.HasAttachments()
-							b.WriteString(fmt.Sprintf("%t\t", hasAttach))
-
-							localdescriptors := message.LocalDescriptors
-							messageClassPropertyReader, err := message.PropertyContext.GetPropertyReader(26, localdescriptors)
-							if err != nil {
-								return err
-							}
-							messageClass, err := messageClassPropertyReader.GetString()
-							if err != nil {
-								return err
-							}
-							// is this encrypted?
-							b.WriteString(fmt.Sprintf("%t\t", messageClass == "IPM.Note.SMIME"))
-
-						default:
-							// anything not a message
-							continue
-						}
-
-						attachmentIterator, err := message.GetAttachmentIterator()
-
-						if eris.Is(err, pst.ErrAttachmentsNotFound) {
-							// This message has no attachments.
-							logFile.WriteString(b.String())
-							continue
-						} else if err != nil {
-							return err
-						}
-
-						for attachmentIterator.Next() {
-							attachment := attachmentIterator.Value()
-
-							// var attachmentName string
-							attachmentName := attachment.GetAttachLongFilename()
-
-							if attachmentName == "" {
-								attachmentName = fmt.Sprintf("UNKNOWN_%d", attachment.Identifier)
-							}
-							b.Write([]byte(attachmentName))
-							b.WriteRune(';')
-
-							if attachmentIterator.Err() != nil {
-								return attachmentIterator.Err()
-							}
-						}
-						b.WriteRune('\n')
-						logFile.WriteString(b.String())
-					}
+		viper.SetDefault("header.rawHeaders", false)
+		*headerRawHeaders = viper.GetBool("header.rawHeaders")
+		viper.SetDefault("header.workers", 0)
+		*headerWorkers = viper.GetInt("header.workers")
 
-					return messageIterator.Err()
-				}); err != nil {
-					panic(fmt.Sprintf("Failed to walk folders: %+v\n", err))
-				}
-			}
-			return nil
+		getheaders.GetHeaders(*header_in, *header_out, getheaders.Options{
+			MboxVariant: mbox.Variant(*headerMboxVariant),
+			RawHeaders:  *headerRawHeaders,
+			Workers:     *headerWorkers,
+			Filter:      scopeFilter(cmd),
 		})
-		if logFile != nil {
-			logFile.Sync()
-			logFile.Close()
-		}
 		log.Println("DONE!")
 	},
 }
 
-var header_in, header_out *string
+var header_in, header_out, headerMboxVariant *string
+var headerRawHeaders *bool
+var headerWorkers *int
 
 func init() {
 	rootCmd.AddCommand(getheadersCmd)
 
 	header_in = getheadersCmd.PersistentFlags().
-		String("header_in", "", "Dir containing pst files where you want to parse headers. Make a subfolder for each custodian under this.")
+		String("header_in", "", "Dir containing pst, ost, msg or mbox files where you want to parse headers. Make a subfolder for each custodian under this.")
 	viper.BindPFlag("header.header_in", getheadersCmd.PersistentFlags().Lookup("header_in"))
 	header_out = getheadersCmd.PersistentFlags().
 		String("header_out", "", "Dir for output logs. There will be a subfolder for each custodian.")
 	viper.BindPFlag("header.header_out", getheadersCmd.PersistentFlags().Lookup("header_out"))
+	headerMboxVariant = getheadersCmd.PersistentFlags().
+		String("mboxVariant", "", "how From lines are escaped in mbox input: 'mboxrd' or 'mboxo'")
+	viper.BindPFlag("header.mboxVariant", getheadersCmd.PersistentFlags().Lookup("mboxVariant"))
+	headerRawHeaders = getheadersCmd.PersistentFlags().
+		Bool("rawHeaders", false, "write the transport header block of each message to transportHeaders.jsonl")
+	viper.BindPFlag("header.rawHeaders", getheadersCmd.PersistentFlags().Lookup("rawHeaders"))
+	headerWorkers = getheadersCmd.PersistentFlags().
+		Int("workers", 0, "how many files to read at once, 0 for one per CPU")
+	viper.BindPFlag("header.workers", getheadersCmd.PersistentFlags().Lookup("workers"))
+	addFilterFlags(getheadersCmd)
 }
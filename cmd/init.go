@@ -74,6 +74,13 @@ decipher:
   pt: "pt" #Dir for output plaintext. There will be a subfolder for each custodian and a log folder under that.
   parallel: true # use multithreading in readpst when unpacking PST files
   eml: true # CT input will be loose .eml files instead of PST archives
+  sidecar: "" # keep the original ciphertext next to each output .eml. "p7m" for the DER smime.p7m, "source" for the whole source message
+  provenance: false # prepend X-Enigma-* headers recording the source, its hash, key serial, time and layers to each output .eml
+  metadata: false # write a JSON sidecar per output .eml with headers, decryption layers, attachments, hashes, source and custodian
+  mboxVariant: "mboxrd" # how mbox input escapes From lines in message bodies. "mboxrd" or "mboxo"
+  output: "eml" # "eml" for numbered .eml files, "mbox" for 1 mboxrd file per custodian. export and produce need eml.
+  dedup: false # list messages deciphered more than once across custodians, by Message-ID and body hash, in duplicates.tsv
+  suppressDuplicates: false # with dedup, write only the first copy of each message and log later copies as duplicates
 keys:
   p12Dir: "p12" #Drop the p12 files you got from the Registration Authority here
   keysDir: "keys" #Output of GetKeys, Input of Decipher. The actual keys extracted from the p12 containers.
@@ -86,10 +93,49 @@ keys:
       password: "S3cr3tSquirel" #password for 2nd p12 file
 signed:
   pstDir: "signedPSTs" #Dir containing signed emails from custodians
-  custodianInfoDir: "custodianInfo" #Output of getSigs. A txt file will be written with custodian IDs.
+  custodianInfoDir: "custodianInfo" #Output of getSigs. signers.tsv has the signer cert profiles, keyHistory.tsv each custodian's certs in order, commonName.txt the custodian IDs.
+  mboxVariant: "mboxrd" #How mbox input escapes From lines in message bodies. "mboxrd" or "mboxo"
+  folders: [] #PST folders to read, globs on the folder name or path ex. ["Gesendete*", "Archive/*/Sent"]. Empty reads the PST's sent folder.
+  allFolders: false #Read every PST folder, keeping only messages sent by the PST's owner, the sender of its sent mail
+  workers: 0 #How many files to read at once, 0 for one per CPU
 header:
-  header_in: "header_in" #Dir for input pst files for getheaders. Make a subfolder for each custodian under this.
+  header_in: "header_in" #Dir for input pst or mbox files for getheaders. Make a subfolder for each custodian under this.
   header_out: "header_out" #Dir for for getheaders output logs. There will be a subfolder for each custodian.
+  mboxVariant: "mboxrd" #How mbox input escapes From lines in message bodies. "mboxrd" or "mboxo"
+  rawHeaders: false #Also write each message's transport header block to transportHeaders.jsonl
+  workers: 0 #How many files to read at once, 0 for one per CPU
+filter: #Scope getheaders, getSigs and decipher to a discovery request. Each writes a filterSummary.tsv counting what was left out.
+  fromDate: "" #Only messages sent on or after this date, YYYY-MM-DD
+  toDate: "" #Only messages sent on or before this date, YYYY-MM-DD
+  folder: "" #Only messages in folders matching this glob, ex. "Sent*" or "Inbox/*"
+  sender: "" #Only messages whose sender name or address matches this regex
+  recipient: "" #Only messages with a recipient name or address matching this regex
+reconcile:
+  header_out: "header_out" #Dir of getheaders output to reconcile. Defaults to header.header_out.
+  pt: "pt" #Dir of deciphered output to reconcile. Defaults to decipher.pt.
+  out: "reconcile" #Dir for the per custodian reconciliation reports and summary.tsv
+export:
+  pt: "pt" #Dir of deciphered output to export. Defaults to decipher.pt.
+  quote: "þ" #DAT text qualifier
+  delimiter: "\x14" #DAT column delimiter. ASCII 20 shows as ¶ in Concordance.
+  newline: "®" #Stands in for line breaks inside a DAT value
+  fields: [] #DAT columns in order. Leave empty for the default email fields. See enigma export loadfile --help
+  # fields:
+  #   - name: "BEGDOC" #column header
+  #     field: "DocID" #enigma field
+produce:
+  pt: "pt" #Dir of deciphered output to produce. Defaults to decipher.pt.
+  out: "production" #Dir for the production volumes and manifest. Must not exist yet.
+  prefix: "" #Bates prefix, ex. ABC
+  start: 1 #First Bates number
+  end: 0 #Last Bates number of the range assigned to this production. 0 for no limit.
+  digits: 7 #Bates number zero padding, ex. ABC0000001
+  volumePrefix: "VOL" #Volume folder names, ex. VOL001
+  maxVolumeBytes: 0 #Size cap per volume in bytes. 0 for no limit.
+  maxVolumeDocs: 0 #Document cap per volume. 0 for no limit.
+  fields: [] #DAT columns in order. Leave empty for the default production fields. See enigma produce --help
+topst:
+  pt: "pt" #Dir of deciphered output to write back into PSTs. Defaults to decipher.pt.
 `
 		if err := os.WriteFile("config.example.yaml", []byte(exampleCfg), 0664); err != nil {
 			log.Fatal("unable to create config file: ", err)
@@ -0,0 +1,154 @@
+// Splits mbox files into RFC822 messages, and appends deciphered messages to mboxrd output.
+// Supports mboxrd, where every quoted "From " line gains a '>', and mboxo, where only "From " itself is quoted.
+// A "From " line only starts a new message at the top of the file or after a blank line.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Variant string
+
+const (
+	MboxRD Variant = "mboxrd"
+	MboxO  Variant = "mboxo"
+)
+
+var ErrNotMbox = errors.New("mbox: input does not start with a From line")
+
+// Message is one message split out of an mbox.
+// Offset is the byte offset of its "From " line in the mbox and identifies the message within the file.
+type Message struct {
+	Offset int64
+	Data   []byte
+}
+
+type Reader struct {
+	r       *bufio.Reader
+	variant Variant
+	offset  int64  // bytes consumed from r
+	next    []byte // the From line that starts the next message, nil at EOF
+	nextOff int64
+	started bool
+}
+
+func NewReader(r io.Reader, variant Variant) *Reader {
+	if variant == "" {
+		variant = MboxRD
+	}
+	return &Reader{r: bufio.NewReaderSize(r, 64*1024), variant: variant}
+}
+
+// readLine returns the next line including its line ending, or io.EOF
+func (mr *Reader) readLine() ([]byte, error) {
+	line, err := mr.r.ReadBytes('\n')
+	mr.offset += int64(len(line))
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+	return line, err
+}
+
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+func isBlank(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// unescape removes the quoting the variant adds to body lines that look like From lines
+func (mr *Reader) unescape(line []byte) []byte {
+	if len(line) == 0 || line[0] != '>' {
+		return line
+	}
+	switch mr.variant {
+	case MboxO:
+		if bytes.HasPrefix(line, []byte(">From ")) {
+			return line[1:]
+		}
+	default:
+		if isFromLine(bytes.TrimLeft(line, ">")) {
+			return line[1:]
+		}
+	}
+	return line
+}
+
+// Next returns the next message, or io.EOF when the mbox is exhausted
+func (mr *Reader) Next() (*Message, error) {
+	if !mr.started {
+		mr.started = true
+		line, err := mr.readLine()
+		if err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		if !isFromLine(line) {
+			return nil, ErrNotMbox
+		}
+		mr.next, mr.nextOff = line, 0
+	}
+	if mr.next == nil {
+		return nil, io.EOF
+	}
+	msg := &Message{Offset: mr.nextOff}
+	mr.next = nil
+	var data bytes.Buffer
+	prevBlank := false
+	for {
+		lineOff := mr.offset
+		line, err := mr.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if prevBlank && isFromLine(line) {
+			mr.next, mr.nextOff = line, lineOff
+			break
+		}
+		prevBlank = isBlank(line)
+		data.Write(mr.unescape(line))
+	}
+	msg.Data = trimSeparator(data.Bytes())
+	return msg, nil
+}
+
+// trimSeparator drops the blank line that separates a message from the next From line
+func trimSeparator(data []byte) []byte {
+	for _, sep := range []string{"\r\n", "\n"} {
+		if bytes.HasSuffix(data, []byte(sep+sep)) {
+			return data[:len(data)-len(sep)]
+		}
+	}
+	return data
+}
+
+// IsMbox reports whether path looks like an mbox, either by extension or by starting with a From line
+func IsMbox(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mbox", ".mbx":
+		return true
+	case "":
+	default:
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return isFromLine(head)
+}
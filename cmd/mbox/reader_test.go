@@ -0,0 +1,117 @@
+package mbox
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readAll(t *testing.T, in string, variant Variant) []*Message {
+	t.Helper()
+	mr := NewReader(strings.NewReader(in), variant)
+	msgs := []*Message{}
+	for {
+		m, err := mr.Next()
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func TestReader(t *testing.T) {
+	first := "From a@local Fri Apr 17 16:00:00 2020\n"
+	second := "From b@local Fri Apr 17 17:00:00 2020\n"
+	in := first +
+		"Subject: one\n\n" +
+		">From the top\n" +
+		">>From quoted\n" +
+		"not a From line\n\n" +
+		second +
+		"Subject: two\n\nbody\n"
+	tests := []struct {
+		variant  Variant
+		expected []string
+	}{
+		{MboxRD, []string{
+			"Subject: one\n\nFrom the top\n>From quoted\nnot a From line\n",
+			"Subject: two\n\nbody\n",
+		}},
+		{MboxO, []string{
+			"Subject: one\n\nFrom the top\n>>From quoted\nnot a From line\n",
+			"Subject: two\n\nbody\n",
+		}},
+	}
+	for _, tc := range tests {
+		msgs := readAll(t, in, tc.variant)
+		if len(msgs) != len(tc.expected) {
+			t.Fatalf("%s: expected %d messages, but got %d", tc.variant, len(tc.expected), len(msgs))
+		}
+		for i, m := range msgs {
+			if string(m.Data) != tc.expected[i] {
+				t.Errorf("%s: expected message %d\n%q\n but got\n%q", tc.variant, i, tc.expected[i], m.Data)
+			}
+		}
+		if msgs[0].Offset != 0 || msgs[1].Offset != int64(strings.Index(in, second)) {
+			t.Errorf("%s: unexpected offsets %d, %d", tc.variant, msgs[0].Offset, msgs[1].Offset)
+		}
+	}
+}
+
+func TestReaderCRLF(t *testing.T) {
+	in := "From a@local\r\nSubject: one\r\n\r\nbody\r\n\r\nFrom b@local\r\nSubject: two\r\n\r\nbody\r\n"
+	msgs := readAll(t, in, MboxRD)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, but got %d", len(msgs))
+	}
+	if string(msgs[0].Data) != "Subject: one\r\n\r\nbody\r\n" {
+		t.Errorf("Unexpected message %q", msgs[0].Data)
+	}
+}
+
+func TestReaderNotMbox(t *testing.T) {
+	_, err := NewReader(strings.NewReader("Subject: eml\n\nbody\n"), MboxRD).Next()
+	if !errors.Is(err, ErrNotMbox) {
+		t.Errorf("Expected ErrNotMbox, but got %v", err)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	msgs := []string{
+		"From: Alice <a@local>\nDate: Fri, 17 Apr 2020 12:00:00 -0400\nSubject: one\n\nFrom the top\n>From quoted\n",
+		"Subject: two\n\nno trailing newline",
+	}
+	var b strings.Builder
+	mw := NewWriter(&b, 0)
+	offsets := []int64{}
+	for _, msg := range msgs {
+		offset, err := mw.Write([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, offset)
+	}
+	if !strings.HasPrefix(b.String(), "From a@local Fri Apr 17 16:00:00 2020\n") {
+		t.Errorf("Unexpected From line in\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), "\n>From the top\n>>From quoted\n") {
+		t.Errorf("Expected From lines to be escaped in\n%s", b.String())
+	}
+	actual := readAll(t, b.String(), MboxRD)
+	if len(actual) != len(msgs) {
+		t.Fatalf("Expected %d messages back, but got %d", len(msgs), len(actual))
+	}
+	for i, m := range actual {
+		if m.Offset != offsets[i] {
+			t.Errorf("Expected offset %d, but got %d", offsets[i], m.Offset)
+		}
+		expected := strings.TrimSuffix(msgs[i], "\n") + "\n"
+		if string(m.Data) != expected {
+			t.Errorf("Expected round trip\n%q\n but got\n%q", expected, m.Data)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package mbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"time"
+)
+
+// Writer appends messages to an mboxrd file.
+// Every body line that looks like a From line, quoted or not, gains a '>' so Reader can restore it exactly.
+type Writer struct {
+	w      io.Writer
+	offset int64
+}
+
+// NewWriter writes to w, which already holds offset bytes, ex. an existing mbox opened for append
+func NewWriter(w io.Writer, offset int64) *Writer {
+	return &Writer{w: w, offset: offset}
+}
+
+var quotedFrom = regexp.MustCompile(`(?m)^(>*From )`)
+
+// Write appends msg and returns the offset of its From line
+func (mw *Writer) Write(msg []byte) (int64, error) {
+	eol := "\n"
+	if bytes.Contains(msg, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	var b bytes.Buffer
+	b.WriteString(fromLine(msg) + eol)
+	b.Write(quotedFrom.ReplaceAll(msg, []byte(">$1")))
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		b.WriteString(eol)
+	}
+	// blank line separating this message from the next From line
+	b.WriteString(eol)
+
+	offset := mw.offset
+	n, err := mw.w.Write(b.Bytes())
+	mw.offset += int64(n)
+	return offset, err
+}
+
+// fromLine builds "From sender date" from the message headers, falling back to MAILER-DAEMON and the current time
+func fromLine(msg []byte) string {
+	sender := "MAILER-DAEMON"
+	date := time.Now()
+	if m, err := mail.ReadMessage(bytes.NewReader(msg)); err == nil {
+		if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil && addr.Address != "" {
+			sender = addr.Address
+		}
+		if d, err := m.Header.Date(); err == nil {
+			date = d
+		}
+	}
+	return fmt.Sprintf("From %s %s", sender, date.UTC().Format(time.ANSIC))
+}
@@ -0,0 +1,291 @@
+package outlook
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	cfbSector    = 512
+	cfbMini      = 64
+	cfbCutoff    = 4096
+	cfbFree      = 0xFFFFFFFF
+	cfbEnd       = 0xFFFFFFFE
+	cfbFATSector = 0xFFFFFFFD
+)
+
+type cfbEntry struct {
+	name     string
+	dir      bool
+	data     []byte
+	children []int
+	child    uint32
+	right    uint32
+	start    uint32
+}
+
+// writeCFB builds a version 3 compound file holding streams keyed by slash separated path.
+// Storages are implied by the paths. Siblings are linked as a chain of right siblings, which readers accept.
+func writeCFB(streams map[string][]byte) []byte {
+	entries := []*cfbEntry{{name: "Root Entry", dir: true}}
+	dirs := map[string]int{"": 0}
+	var mkdir func(p string) int
+	mkdir = func(p string) int {
+		if i, ok := dirs[p]; ok {
+			return i
+		}
+		parent, name := "", p
+		if i := strings.LastIndex(p, "/"); i >= 0 {
+			parent, name = p[:i], p[i+1:]
+		}
+		pi := mkdir(parent)
+		entries = append(entries, &cfbEntry{name: name, dir: true})
+		dirs[p] = len(entries) - 1
+		entries[pi].children = append(entries[pi].children, len(entries)-1)
+		return len(entries) - 1
+	}
+	paths := []string{}
+	for p := range streams {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		parent, name := "", p
+		if i := strings.LastIndex(p, "/"); i >= 0 {
+			parent, name = p[:i], p[i+1:]
+		}
+		pi := mkdir(parent)
+		entries = append(entries, &cfbEntry{name: name, data: streams[p]})
+		entries[pi].children = append(entries[pi].children, len(entries)-1)
+	}
+	for _, e := range entries {
+		e.child, e.right, e.start = cfbFree, cfbFree, cfbEnd
+	}
+	for _, e := range entries {
+		sort.Slice(e.children, func(i, j int) bool {
+			a, b := entries[e.children[i]].name, entries[e.children[j]].name
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return strings.ToUpper(a) < strings.ToUpper(b)
+		})
+		for i, c := range e.children {
+			if i == 0 {
+				e.child = uint32(c)
+			} else {
+				entries[e.children[i-1]].right = uint32(c)
+			}
+		}
+	}
+
+	// mini stream for small streams
+	ministream := []byte{}
+	miniFAT := []uint32{}
+	bigStreams := []*cfbEntry{}
+	for _, e := range entries {
+		if e.dir || len(e.data) == 0 {
+			continue
+		}
+		if len(e.data) >= cfbCutoff {
+			bigStreams = append(bigStreams, e)
+			continue
+		}
+		e.start = uint32(len(miniFAT))
+		n := (len(e.data) + cfbMini - 1) / cfbMini
+		for i := 0; i < n; i++ {
+			if i == n-1 {
+				miniFAT = append(miniFAT, cfbEnd)
+			} else {
+				miniFAT = append(miniFAT, uint32(len(miniFAT)+1))
+			}
+		}
+		padded := make([]byte, n*cfbMini)
+		copy(padded, e.data)
+		ministream = append(ministream, padded...)
+	}
+
+	sectors := func(n int) int { return (n + cfbSector - 1) / cfbSector }
+	nDir := sectors(len(entries) * 128)
+	nMiniFAT := sectors(len(miniFAT) * 4)
+	nMiniStream := sectors(len(ministream))
+	nBig := 0
+	for _, e := range bigStreams {
+		nBig += sectors(len(e.data))
+	}
+	nFAT := 1
+	for (nFAT+nDir+nMiniFAT+nMiniStream+nBig)*4 > nFAT*cfbSector {
+		nFAT++
+	}
+	fat := []uint32{}
+	chain := func(n int) uint32 {
+		if n == 0 {
+			return cfbEnd
+		}
+		start := uint32(len(fat))
+		for i := 0; i < n; i++ {
+			if i == n-1 {
+				fat = append(fat, cfbEnd)
+			} else {
+				fat = append(fat, uint32(len(fat)+1))
+			}
+		}
+		return start
+	}
+	for i := 0; i < nFAT; i++ {
+		fat = append(fat, cfbFATSector)
+	}
+	dirStart := chain(nDir)
+	miniFATStart := chain(nMiniFAT)
+	entries[0].start = chain(nMiniStream)
+	entries[0].data = ministream
+	for _, e := range bigStreams {
+		e.start = chain(sectors(len(e.data)))
+	}
+
+	body := []byte{}
+	pad := func(b []byte) []byte {
+		return append(b, make([]byte, sectors(len(b))*cfbSector-len(b))...)
+	}
+	fatBytes := make([]byte, nFAT*cfbSector)
+	for i := range fatBytes {
+		fatBytes[i] = 0xFF
+	}
+	for i, v := range fat {
+		binary.LittleEndian.PutUint32(fatBytes[i*4:], v)
+	}
+	body = append(body, fatBytes...)
+	dirBytes := make([]byte, 0, nDir*cfbSector)
+	for _, e := range entries {
+		dirBytes = append(dirBytes, e.dirEntry()...)
+	}
+	for len(dirBytes) < nDir*cfbSector {
+		empty := (&cfbEntry{child: cfbFree, right: cfbFree}).dirEntry()
+		empty[66] = 0 // unused entry
+		dirBytes = append(dirBytes, empty...)
+	}
+	body = append(body, dirBytes...)
+	miniFATBytes := make([]byte, nMiniFAT*cfbSector)
+	for i := range miniFATBytes {
+		miniFATBytes[i] = 0xFF
+	}
+	for i, v := range miniFAT {
+		binary.LittleEndian.PutUint32(miniFATBytes[i*4:], v)
+	}
+	body = append(body, miniFATBytes...)
+	body = append(body, pad(ministream)...)
+	for _, e := range bigStreams {
+		body = append(body, pad(append([]byte{}, e.data...))...)
+	}
+
+	header := make([]byte, cfbSector)
+	copy(header, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
+	binary.LittleEndian.PutUint16(header[24:], 0x003E)
+	binary.LittleEndian.PutUint16(header[26:], 3)
+	binary.LittleEndian.PutUint16(header[28:], 0xFFFE)
+	binary.LittleEndian.PutUint16(header[30:], 9)
+	binary.LittleEndian.PutUint16(header[32:], 6)
+	binary.LittleEndian.PutUint32(header[44:], uint32(nFAT))
+	binary.LittleEndian.PutUint32(header[48:], dirStart)
+	binary.LittleEndian.PutUint32(header[56:], cfbCutoff)
+	binary.LittleEndian.PutUint32(header[60:], miniFATStart)
+	binary.LittleEndian.PutUint32(header[64:], uint32(nMiniFAT))
+	binary.LittleEndian.PutUint32(header[68:], cfbEnd)
+	for i := 0; i < 109; i++ {
+		v := uint32(cfbFree)
+		if i < nFAT {
+			v = uint32(i)
+		}
+		binary.LittleEndian.PutUint32(header[76+i*4:], v)
+	}
+	return append(header, body...)
+}
+
+func (e *cfbEntry) dirEntry() []byte {
+	b := make([]byte, 128)
+	name := utf16.Encode([]rune(e.name))
+	for i, c := range name {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	if e.name != "" {
+		binary.LittleEndian.PutUint16(b[64:], uint16((len(name)+1)*2))
+	}
+	switch {
+	case e.name == "Root Entry":
+		b[66] = 5
+	case e.dir:
+		b[66] = 1
+	default:
+		b[66] = 2
+	}
+	b[67] = 1 // black
+	binary.LittleEndian.PutUint32(b[68:], cfbFree)
+	binary.LittleEndian.PutUint32(b[72:], e.right)
+	binary.LittleEndian.PutUint32(b[76:], e.child)
+	binary.LittleEndian.PutUint32(b[116:], e.start)
+	binary.LittleEndian.PutUint32(b[120:], uint32(len(e.data)))
+	return b
+}
+
+// msgProps collects the streams of one storage of a .msg
+type msgProps struct {
+	streams map[string][]byte
+	dir     string
+	fixed   []byte
+}
+
+func newMsgProps(streams map[string][]byte, dir string, headerSize int) *msgProps {
+	return &msgProps{streams: streams, dir: dir, fixed: make([]byte, headerSize)}
+}
+
+func (p *msgProps) key(name string) string {
+	if p.dir == "" {
+		return name
+	}
+	return p.dir + "/" + name
+}
+
+func (p *msgProps) unicode(id uint16, s string) *msgProps {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2+2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	p.streams[p.key(substgPrefix+hex4(id)+hex4(typeUnicode))] = b
+	return p
+}
+
+func (p *msgProps) binary(id uint16, b []byte) *msgProps {
+	p.streams[p.key(substgPrefix+hex4(id)+hex4(typeBinary))] = b
+	return p
+}
+
+func (p *msgProps) int32(id uint16, v int) *msgProps {
+	entry := make([]byte, 16)
+	binary.LittleEndian.PutUint16(entry[0:], typeInt32)
+	binary.LittleEndian.PutUint16(entry[2:], id)
+	binary.LittleEndian.PutUint32(entry[8:], uint32(v))
+	p.fixed = append(p.fixed, entry...)
+	return p
+}
+
+func (p *msgProps) time(id uint16, t time.Time) *msgProps {
+	entry := make([]byte, 16)
+	binary.LittleEndian.PutUint16(entry[0:], typeSysTime)
+	binary.LittleEndian.PutUint16(entry[2:], id)
+	binary.LittleEndian.PutUint64(entry[8:], uint64(t.UnixNano()/100+116444736000000000))
+	p.fixed = append(p.fixed, entry...)
+	return p
+}
+
+// done writes the properties stream
+func (p *msgProps) done() {
+	p.streams[p.key(propertiesStream)] = p.fixed
+}
+
+func hex4(v uint16) string {
+	const digits = "0123456789ABCDEF"
+	return string([]byte{digits[v>>12], digits[v>>8&0xF], digits[v>>4&0xF], digits[v&0xF]})
+}
@@ -0,0 +1,89 @@
+package outlook
+
+import (
+	"encoding/binary"
+	"errors"
+	"path"
+
+	pst "github.com/mooijtech/go-pst/v6/pkg"
+)
+
+// Message store properties holding the entry IDs of special folders, see MS-OXOSFLD
+const (
+	propIpmSubtreeEntry  = 0x35e0
+	propIpmSentMailEntry = 0x35e4
+)
+
+// WalkMailbox calls fn for the top of the mailbox, ex. Top of Outlook data file, and every folder below it,
+// with the folder's / separated path from the top, ex. Inbox/Project. The top has an empty path.
+// The search folders beside the top are skipped, as readpst skips them.
+func WalkMailbox(pstFile *pst.File, fn func(folder *pst.Folder, folderPath string) error) error {
+	top, err := topOfMailbox(pstFile)
+	if err != nil {
+		return err
+	}
+	var walk func(folder pst.Folder, folderPath string) error
+	walk = func(folder pst.Folder, folderPath string) error {
+		if err := fn(&folder, folderPath); err != nil {
+			return err
+		}
+		subFolders, err := folder.GetSubFolders()
+		if err != nil {
+			return err
+		}
+		for _, subFolder := range subFolders {
+			if err := walk(subFolder, path.Join(folderPath, subFolder.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(top, "")
+}
+
+// topOfMailbox finds the folder Outlook shows as the top of the mailbox, from the message store or else
+// as the first folder under the root
+func topOfMailbox(pstFile *pst.File) (pst.Folder, error) {
+	root, err := pstFile.GetRootFolder()
+	if err != nil {
+		return pst.Folder{}, err
+	}
+	subFolders, err := root.GetSubFolders()
+	if err != nil {
+		return pst.Folder{}, err
+	}
+	if id, ok := storeFolder(pstFile, propIpmSubtreeEntry); ok {
+		for _, folder := range subFolders {
+			if folder.Identifier == id {
+				return folder, nil
+			}
+		}
+	}
+	if len(subFolders) == 0 {
+		return pst.Folder{}, errors.New("outlook: PST has no folders")
+	}
+	return subFolders[0], nil
+}
+
+// SentFolder is the node ID of the folder Outlook files sent mail in, whatever it is called, ex. Gesendete Elemente.
+// ok is false when the message store doesn't say.
+func SentFolder(pstFile *pst.File) (id pst.Identifier, ok bool) {
+	return storeFolder(pstFile, propIpmSentMailEntry)
+}
+
+// storeFolder reads a folder entry ID from the message store. An entry ID ends with the folder's node ID.
+func storeFolder(pstFile *pst.File, prop uint16) (pst.Identifier, bool) {
+	store, err := pstFile.GetMessageStore()
+	if err != nil {
+		return 0, false
+	}
+	entryReader, err := store.GetPropertyReader(prop, nil)
+	if err != nil || entryReader.Size() < 4 {
+		return 0, false
+	}
+	nid := make([]byte, 4)
+	if _, err := entryReader.ReadAt(nid, entryReader.Size()-4); err != nil {
+		return 0, false
+	}
+	return pst.Identifier(binary.LittleEndian.Uint32(nid)), true
+}
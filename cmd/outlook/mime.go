@@ -0,0 +1,157 @@
+package outlook
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+
+	charsets "github.com/emersion/go-message/charset"
+)
+
+// FromRFC822 maps a MIME message onto message properties, the reverse of RFC822.
+// The first text/plain and text/html parts are the bodies, every other part is an attachment.
+// Attached emails are kept whole as .eml attachments rather than walked into.
+func FromRFC822(b []byte) (*Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	dec := &mime.WordDecoder{CharsetReader: charsets.Reader}
+	decode := func(s string) string {
+		if decoded, err := dec.DecodeHeader(s); err == nil {
+			return decoded
+		}
+		return s
+	}
+	m := &Message{
+		Class:            "IPM.Note",
+		Subject:          decode(msg.Header.Get("Subject")),
+		MessageID:        msg.Header.Get("Message-Id"),
+		TransportHeaders: rawHeaders(b),
+	}
+	if date, err := mail.ParseDate(msg.Header.Get("Date")); err == nil {
+		m.Submitted = date.UTC()
+	}
+	parser := mail.AddressParser{WordDecoder: dec}
+	if from := msg.Header.Get("From"); from != "" {
+		if addr, err := parser.Parse(from); err == nil {
+			m.SenderName, m.SenderEmail = addr.Name, addr.Address
+		} else {
+			m.SenderName = decode(from)
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		rType int
+	}{{"To", RecipientTo}, {"Cc", RecipientCc}, {"Bcc", RecipientBcc}} {
+		value := msg.Header.Get(field.name)
+		if value == "" {
+			continue
+		}
+		addrs, err := parser.ParseList(value)
+		if err != nil {
+			// keep an unparseable list as a single recipient so it still shows
+			m.Recipients = append(m.Recipients, Recipient{Type: field.rType, Name: decode(value)})
+			continue
+		}
+		for _, a := range addrs {
+			m.Recipients = append(m.Recipients, Recipient{Type: field.rType, Name: a.Name, Address: a.Address})
+		}
+	}
+	if err := m.walkParts(msg.Header, msg.Body); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// rawHeaders is the header block of a message as written, up to the blank line
+func rawHeaders(b []byte) string {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(b, []byte(sep)); i >= 0 {
+			return string(b[:i+len(sep)/2])
+		}
+	}
+	return string(b)
+}
+
+func (m *Message) walkParts(header mail.Header, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// no or broken Content-Type is a plain text body
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.walkParts(mail.Header(p.Header), p); err != nil {
+				return err
+			}
+		}
+	}
+	content, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+	filename := params["name"]
+	disposition, dParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if dParams["filename"] != "" {
+		filename = dParams["filename"]
+	}
+	if filename == "" && disposition != "attachment" {
+		switch {
+		case mediaType == "text/plain" && m.Body == "":
+			m.Body = string(toUTF8(content, params["charset"]))
+			return nil
+		case mediaType == "text/html" && len(m.HTML) == 0:
+			m.HTML = toUTF8(content, params["charset"])
+			return nil
+		}
+	}
+	if filename == "" && mediaType == "message/rfc822" {
+		filename = "message.eml"
+	}
+	if filename == "" {
+		filename = fmt.Sprintf("UNKNOWN_%d", len(m.Attachments))
+	}
+	m.Attachments = append(m.Attachments, Attachment{Filename: filename, MimeTag: mediaType, Data: content})
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// toUTF8 converts text in charset, leaving it as is when the charset is unknown
+func toUTF8(content []byte, charset string) []byte {
+	if charset == "" || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "us-ascii") {
+		return content
+	}
+	r, err := charsets.Reader(charset, bytes.NewReader(content))
+	if err != nil {
+		return content
+	}
+	converted, err := io.ReadAll(r)
+	if err != nil {
+		return content
+	}
+	return converted
+}
@@ -0,0 +1,468 @@
+// Reads Outlook .msg files (MS-OXMSG, stored in an OLE compound file) and rebuilds them as RFC 822
+// in the layout readpst writes, so they can go through the same pipelines as unpacked PSTs.
+package outlook
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/richardlehane/mscfb"
+)
+
+// Message is the subset of an Outlook message needed to report on it and rebuild it as RFC 822
+type Message struct {
+	Class            string
+	Subject          string
+	SenderName       string
+	SenderEmail      string
+	DisplayTo        string
+	DisplayCc        string
+	DisplayBcc       string
+	MessageID        string
+	TransportHeaders string
+	Body             string
+	HTML             []byte
+	Submitted        time.Time
+	Recipients       []Recipient
+	Attachments      []Attachment
+}
+
+// Recipient type as stored in PR_RECIPIENT_TYPE
+const (
+	RecipientTo  = 1
+	RecipientCc  = 2
+	RecipientBcc = 3
+)
+
+type Recipient struct {
+	Type    int
+	Name    string
+	Address string
+}
+
+// Attachment is either file data or, when Embedded is set, an attached Outlook message
+type Attachment struct {
+	Filename string
+	MimeTag  string
+	Data     []byte
+	Embedded *Message
+}
+
+var ErrNotMsg = errors.New("outlook: not an Outlook .msg file")
+
+// property IDs, see MS-OXPROPS
+const (
+	propMessageClass     = 0x001A
+	propSubject          = 0x0037
+	propClientSubmitTime = 0x0039
+	propTransportHeaders = 0x007D
+	propSenderName       = 0x0C1A
+	propSenderEmail      = 0x0C1F
+	propRecipientType    = 0x0C15
+	propDisplayBcc       = 0x0E02
+	propDisplayCc        = 0x0E03
+	propDisplayTo        = 0x0E04
+	propDeliveryTime     = 0x0E06
+	propBody             = 0x1000
+	propHTML             = 0x1013
+	propMessageID        = 0x1035
+	propDisplayName      = 0x3001
+	propEmailAddress     = 0x3003
+	propAttachData       = 0x3701
+	propAttachFilename   = 0x3704
+	propAttachLongName   = 0x3707
+	propAttachMimeTag    = 0x370E
+	propSmtpAddress      = 0x39FE
+	propSenderSmtp       = 0x5D01
+)
+
+// property types
+const (
+	typeInt16    = 0x0002
+	typeInt32    = 0x0003
+	typeFloat32  = 0x0004
+	typeFloat64  = 0x0005
+	typeCurrency = 0x0006
+	typeAppTime  = 0x0007
+	typeError    = 0x000A
+	typeBoolean  = 0x000B
+	typeObject   = 0x000D
+	typeInt64    = 0x0014
+	typeString8  = 0x001E
+	typeUnicode  = 0x001F
+	typeSysTime  = 0x0040
+	typeBinary   = 0x0102
+)
+
+const (
+	substgPrefix     = "__substg1.0_"
+	propertiesStream = "__properties_version1.0"
+	attachPrefix     = "__attach_version1.0_#"
+	recipPrefix      = "__recip_version1.0_#"
+	embeddedStorage  = "__substg1.0_3701000D"
+)
+
+// Open reads the .msg file at path
+func Open(path string) (*Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read parses a .msg from ra
+func Read(ra io.ReaderAt) (*Message, error) {
+	doc, err := mscfb.New(ra)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotMsg, err)
+	}
+	// slurp every stream keyed by its path inside the compound file
+	streams := map[string][]byte{}
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		content, err := io.ReadAll(entry)
+		if err != nil {
+			return nil, err
+		}
+		streams[path.Join(append(append([]string{}, entry.Path...), entry.Name)...)] = content
+	}
+	if _, ok := streams[propertiesStream]; !ok {
+		return nil, ErrNotMsg
+	}
+	return readStorage(streams, "", 32), nil
+}
+
+// storage is the properties of one message, attachment or recipient storage
+type storage struct {
+	variable map[uint16][]byte // substg streams by property ID
+	types    map[uint16]uint16
+	fixed    map[uint16][8]byte // fixed size values from the properties stream
+}
+
+// newStorage gathers the streams directly under dir.
+// headerSize is the length of the properties stream header: 32 for the top message, 24 for embedded messages and 8 otherwise.
+func newStorage(streams map[string][]byte, dir string, headerSize int) storage {
+	s := storage{variable: map[uint16][]byte{}, types: map[uint16]uint16{}, fixed: map[uint16][8]byte{}}
+	for name, content := range streams {
+		if path.Dir(name) != dir && !(dir == "" && path.Dir(name) == ".") {
+			continue
+		}
+		base := path.Base(name)
+		if !strings.HasPrefix(base, substgPrefix) || len(base) != len(substgPrefix)+8 {
+			continue
+		}
+		tag, err := strconv.ParseUint(strings.TrimPrefix(base, substgPrefix), 16, 32)
+		if err != nil {
+			continue
+		}
+		s.variable[uint16(tag>>16)] = content
+		s.types[uint16(tag>>16)] = uint16(tag)
+	}
+	props := streams[path.Join(dir, propertiesStream)]
+	for i := headerSize; i+16 <= len(props); i += 16 {
+		var value [8]byte
+		copy(value[:], props[i+8:i+16])
+		s.fixed[binary.LittleEndian.Uint16(props[i+2:i+4])] = value
+	}
+	return s
+}
+
+func (s storage) string(id uint16) string {
+	content, ok := s.variable[id]
+	if !ok {
+		return ""
+	}
+	if s.types[id] == typeUnicode {
+		u := make([]uint16, len(content)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(content[i*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+	}
+	return strings.TrimRight(string(content), "\x00")
+}
+
+func (s storage) int32(id uint16) int {
+	value := s.fixed[id]
+	return int(int32(binary.LittleEndian.Uint32(value[:4])))
+}
+
+// time converts a FILETIME, 100ns ticks since 1601
+func (s storage) time(id uint16) time.Time {
+	value, ok := s.fixed[id]
+	if !ok {
+		return time.Time{}
+	}
+	ticks := int64(binary.LittleEndian.Uint64(value[:]))
+	if ticks == 0 {
+		return time.Time{}
+	}
+	const epochDiff = 116444736000000000 // 1601 to 1970 in 100ns ticks
+	return time.Unix(0, (ticks-epochDiff)*100).UTC()
+}
+
+// subStorages lists the storages under dir whose name starts with prefix, in order
+func subStorages(streams map[string][]byte, dir, prefix string) []string {
+	seen := map[string]bool{}
+	for name := range streams {
+		rel := name
+		if dir != "" {
+			if !strings.HasPrefix(name, dir+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(name, dir+"/")
+		}
+		first := strings.SplitN(rel, "/", 2)[0]
+		if strings.HasPrefix(first, prefix) && first != rel {
+			seen[path.Join(dir, first)] = true
+		}
+	}
+	dirs := []string{}
+	for d := range seen {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+func readStorage(streams map[string][]byte, dir string, headerSize int) *Message {
+	s := newStorage(streams, dir, headerSize)
+	m := &Message{
+		Class:            s.string(propMessageClass),
+		Subject:          s.string(propSubject),
+		SenderName:       s.string(propSenderName),
+		SenderEmail:      s.string(propSenderSmtp),
+		DisplayTo:        s.string(propDisplayTo),
+		DisplayCc:        s.string(propDisplayCc),
+		DisplayBcc:       s.string(propDisplayBcc),
+		MessageID:        s.string(propMessageID),
+		TransportHeaders: s.string(propTransportHeaders),
+		Body:             s.string(propBody),
+		HTML:             s.variable[propHTML],
+		Submitted:        s.time(propClientSubmitTime),
+	}
+	if m.SenderEmail == "" {
+		m.SenderEmail = s.string(propSenderEmail)
+	}
+	if m.Submitted.IsZero() {
+		m.Submitted = s.time(propDeliveryTime)
+	}
+	for _, recipDir := range subStorages(streams, dir, recipPrefix) {
+		r := newStorage(streams, recipDir, 8)
+		recipient := Recipient{
+			Type:    r.int32(propRecipientType),
+			Name:    r.string(propDisplayName),
+			Address: r.string(propSmtpAddress),
+		}
+		if recipient.Address == "" {
+			recipient.Address = r.string(propEmailAddress)
+		}
+		m.Recipients = append(m.Recipients, recipient)
+	}
+	for _, attachDir := range subStorages(streams, dir, attachPrefix) {
+		a := newStorage(streams, attachDir, 8)
+		attachment := Attachment{
+			Filename: a.string(propAttachLongName),
+			MimeTag:  a.string(propAttachMimeTag),
+			Data:     a.variable[propAttachData],
+		}
+		if attachment.Filename == "" {
+			attachment.Filename = a.string(propAttachFilename)
+		}
+		if len(subStorages(streams, attachDir, embeddedStorage)) > 0 {
+			attachment.Embedded = readStorage(streams, path.Join(attachDir, embeddedStorage), 24)
+			if attachment.Filename == "" {
+				attachment.Filename = a.string(propDisplayName)
+			}
+		}
+		m.Attachments = append(m.Attachments, attachment)
+	}
+	return m
+}
+
+// IsEncrypted reports whether this is an opaque S/MIME message by its class, encrypted or opaque signed
+func (m *Message) IsEncrypted() bool {
+	return m.Class == "IPM.Note.SMIME"
+}
+
+// contentHeaders are rebuilt from the attachments rather than copied from the transport headers
+var contentHeaders = map[string]bool{
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"content-disposition":       true,
+	"mime-version":              true,
+}
+
+// RFC822 rebuilds the message as multipart/mixed with the body and each attachment as a part,
+// the way readpst writes messages. The transport headers are kept when the message went over SMTP,
+// otherwise headers are made from the message properties.
+func (m *Message) RFC822() []byte {
+	var b bytes.Buffer
+	if m.TransportHeaders != "" {
+		b.WriteString(filterHeaders(m.TransportHeaders))
+	} else {
+		m.writeHeaders(&b)
+	}
+	boundary := m.boundary()
+	b.WriteString("MIME-Version: 1.0\n")
+	b.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\n\n", boundary))
+
+	encrypted := false
+	for _, a := range m.Attachments {
+		if strings.Contains(a.MimeTag, "pkcs7-mime") {
+			encrypted = true
+		}
+	}
+	// an encrypted message carries its body inside the envelope, Outlook's body is only a placeholder
+	if !encrypted {
+		if m.Body != "" {
+			b.WriteString("--" + boundary + "\n")
+			writeText(&b, "text/plain", []byte(m.Body))
+		} else if len(m.HTML) > 0 {
+			b.WriteString("--" + boundary + "\n")
+			writeText(&b, "text/html", m.HTML)
+		}
+	}
+	for i, a := range m.Attachments {
+		b.WriteString("--" + boundary + "\n")
+		filename := a.Filename
+		if filename == "" {
+			filename = fmt.Sprintf("UNKNOWN_%d", i)
+		}
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+		if a.Embedded != nil {
+			b.WriteString("Content-Type: message/rfc822\n")
+			b.WriteString("Content-Disposition: " + disposition + "\n\n")
+			b.Write(a.Embedded.RFC822())
+			b.WriteString("\n")
+			continue
+		}
+		mimeTag := a.MimeTag
+		if mimeTag == "" {
+			mimeTag = "application/octet-stream"
+		}
+		params := map[string]string{"name": filename}
+		if strings.Contains(mimeTag, "pkcs7-mime") && m.IsEncrypted() {
+			params["smime-type"] = "enveloped-data"
+		}
+		b.WriteString("Content-Type: " + mime.FormatMediaType(mimeTag, params) + "\n")
+		b.WriteString("Content-Transfer-Encoding: base64\n")
+		b.WriteString("Content-Disposition: " + disposition + "\n\n")
+		writeBase64(&b, a.Data)
+	}
+	b.WriteString("--" + boundary + "--\n")
+	return b.Bytes()
+}
+
+// writeHeaders makes RFC 822 headers from the message properties for messages that never went over SMTP
+func (m *Message) writeHeaders(b *bytes.Buffer) {
+	encode := func(s string) string {
+		return mime.QEncoding.Encode("utf-8", s)
+	}
+	from := encode(m.SenderName)
+	if strings.Contains(m.SenderEmail, "@") {
+		from = (&mail.Address{Name: m.SenderName, Address: m.SenderEmail}).String()
+	}
+	b.WriteString("From: " + from + "\n")
+	for _, field := range []struct {
+		name    string
+		rType   int
+		display string
+	}{
+		{"To", RecipientTo, m.DisplayTo},
+		{"Cc", RecipientCc, m.DisplayCc},
+		{"Bcc", RecipientBcc, m.DisplayBcc},
+	} {
+		addresses := []string{}
+		for _, r := range m.Recipients {
+			if r.Type != field.rType {
+				continue
+			}
+			if strings.Contains(r.Address, "@") {
+				addresses = append(addresses, (&mail.Address{Name: r.Name, Address: r.Address}).String())
+			} else {
+				addresses = append(addresses, encode(r.Name))
+			}
+		}
+		value := strings.Join(addresses, ", ")
+		if value == "" {
+			value = encode(field.display)
+		}
+		if value != "" {
+			b.WriteString(field.name + ": " + value + "\n")
+		}
+	}
+	b.WriteString("Subject: " + encode(m.Subject) + "\n")
+	if !m.Submitted.IsZero() {
+		b.WriteString("Date: " + m.Submitted.Format(time.RFC1123Z) + "\n")
+	}
+	if m.MessageID != "" {
+		b.WriteString("Message-ID: " + m.MessageID + "\n")
+	}
+}
+
+// filterHeaders drops the content headers, including their folded lines, and normalizes line endings
+func filterHeaders(raw string) string {
+	var b strings.Builder
+	skip := false
+	for _, line := range strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := strings.ToLower(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+			skip = contentHeaders[name]
+		}
+		if !skip {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// boundary is derived from the content so rebuilding the same .msg gives the same bytes
+func (m *Message) boundary() string {
+	h := sha256.New()
+	h.Write([]byte(m.TransportHeaders + m.Subject + m.Body))
+	for _, a := range m.Attachments {
+		h.Write(a.Data)
+	}
+	return fmt.Sprintf("--boundary-enigma-%x", h.Sum(nil)[:12])
+}
+
+func writeText(b *bytes.Buffer, mediaType string, text []byte) {
+	b.WriteString("Content-Type: " + mediaType + "; charset=utf-8\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\n\n")
+	qp := quotedprintable.NewWriter(b)
+	qp.Write(text)
+	qp.Close()
+	b.WriteString("\n")
+}
+
+func writeBase64(b *bytes.Buffer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\n")
+}
@@ -0,0 +1,189 @@
+package outlook
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSent = time.Date(2020, 4, 17, 16, 0, 0, 0, time.UTC)
+
+// encryptedStreams lays out an opaque S/MIME message the way Outlook saves it
+func encryptedStreams(envelope []byte) map[string][]byte {
+	streams := map[string][]byte{}
+	root := newMsgProps(streams, "", 32).
+		unicode(propMessageClass, "IPM.Note.SMIME").
+		unicode(propSubject, "secret").
+		unicode(propSenderName, "Sender").
+		unicode(propSenderSmtp, "sender@local").
+		unicode(propDisplayTo, "Rcpt").
+		unicode(propMessageID, "<1@local>").
+		unicode(propTransportHeaders, "From: Sender <sender@local>\r\n"+
+			"To: Rcpt <rcpt@local>\r\n"+
+			"Subject: secret\r\n"+
+			"Message-ID: <1@local>\r\n"+
+			"MIME-Version: 1.0\r\n"+
+			"Content-Type: application/pkcs7-mime; smime-type=enveloped-data;\r\n"+
+			"\tname=\"smime.p7m\"\r\n"+
+			"Content-Transfer-Encoding: base64\r\n\r\n").
+		time(propClientSubmitTime, testSent)
+	root.done()
+	newMsgProps(streams, recipPrefix+"00000000", 8).
+		int32(propRecipientType, RecipientTo).
+		unicode(propDisplayName, "Rcpt").
+		unicode(propSmtpAddress, "rcpt@local").
+		done()
+	newMsgProps(streams, attachPrefix+"00000000", 8).
+		unicode(propAttachLongName, "smime.p7m").
+		unicode(propAttachMimeTag, "application/pkcs7-mime").
+		binary(propAttachData, envelope).
+		done()
+	return streams
+}
+
+func TestRead(t *testing.T) {
+	// larger than the mini stream cutoff so both stream layouts are read
+	envelope := bytes.Repeat([]byte{0x30, 0x82}, 3000)
+	m, err := Read(bytes.NewReader(writeCFB(encryptedStreams(envelope))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Class != "IPM.Note.SMIME" || m.Subject != "secret" || m.SenderEmail != "sender@local" ||
+		!m.Submitted.Equal(testSent) || !m.IsEncrypted() {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	if len(m.Recipients) != 1 || m.Recipients[0] != (Recipient{RecipientTo, "Rcpt", "rcpt@local"}) {
+		t.Errorf("Unexpected recipients %+v", m.Recipients)
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0].Filename != "smime.p7m" ||
+		!bytes.Equal(m.Attachments[0].Data, envelope) {
+		t.Fatalf("Unexpected attachments %+v", m.Attachments)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(m.RFC822()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Message-Id") != "<1@local>" || msg.Header.Get("Content-Transfer-Encoding") != "" {
+		t.Errorf("Expected transport headers without their content headers, but got %v", msg.Header)
+	}
+	parts := readParts(t, msg)
+	if len(parts) != 1 {
+		t.Fatalf("Expected only the envelope, but got %d parts", len(parts))
+	}
+	if ct := parts[0].header.Get("Content-Type"); !strings.Contains(ct, "smime-type=enveloped-data") {
+		t.Errorf("Expected an enveloped-data part, but got %q", ct)
+	}
+	if !bytes.Equal(parts[0].body, envelope) {
+		t.Error("Envelope did not survive the rebuild")
+	}
+}
+
+func TestRFC822FromProperties(t *testing.T) {
+	streams := map[string][]byte{}
+	newMsgProps(streams, "", 32).
+		unicode(propMessageClass, "IPM.Note").
+		unicode(propSubject, "Café").
+		unicode(propSenderName, "Sender").
+		unicode(propSenderSmtp, "sender@local").
+		unicode(propBody, "see attached").
+		time(propClientSubmitTime, testSent).
+		done()
+	newMsgProps(streams, recipPrefix+"00000000", 8).
+		int32(propRecipientType, RecipientCc).
+		unicode(propDisplayName, "Rcpt").
+		unicode(propSmtpAddress, "rcpt@local").
+		done()
+	attach := attachPrefix + "00000000"
+	newMsgProps(streams, attach, 8).
+		unicode(propDisplayName, "forwarded").
+		done()
+	newMsgProps(streams, attach+"/"+embeddedStorage, 24).
+		unicode(propMessageClass, "IPM.Note").
+		unicode(propSubject, "inner").
+		unicode(propBody, "inner body").
+		done()
+
+	m, err := Read(bytes.NewReader(writeCFB(streams)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(m.RFC822()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if msg.Header.Get("From") != "\"Sender\" <sender@local>" || msg.Header.Get("Cc") != "\"Rcpt\" <rcpt@local>" ||
+		subject != "Café" || msg.Header.Get("Date") != testSent.Format(time.RFC1123Z) {
+		t.Errorf("Unexpected headers %v", msg.Header)
+	}
+	parts := readParts(t, msg)
+	if len(parts) != 2 {
+		t.Fatalf("Expected body and attached message, but got %d parts", len(parts))
+	}
+	if string(parts[0].body) != "see attached" {
+		t.Errorf("Unexpected body %q", parts[0].body)
+	}
+	if parts[1].header.Get("Content-Type") != "message/rfc822" ||
+		!strings.Contains(parts[1].header.Get("Content-Disposition"), "forwarded") {
+		t.Errorf("Unexpected attached message headers %v", parts[1].header)
+	}
+	inner, err := mail.ReadMessage(bytes.NewReader(parts[1].body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.Header.Get("Subject") != "inner" {
+		t.Errorf("Unexpected attached message %v", inner.Header)
+	}
+}
+
+func TestReadNotMsg(t *testing.T) {
+	if _, err := Read(strings.NewReader("From: eml\n\nbody\n")); err == nil {
+		t.Error("Expected an error for a non compound file")
+	}
+}
+
+type part struct {
+	header mail.Header
+	body   []byte
+}
+
+// readParts returns the decoded parts of a multipart message
+func readParts(t *testing.T, msg *mail.Message) []part {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := []part{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body []byte
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			body, err = io.ReadAll(base64Reader(p))
+		} else {
+			body, err = io.ReadAll(p)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part{mail.Header(p.Header), bytes.TrimRight(body, "\n")})
+	}
+}
+
+func base64Reader(r io.Reader) io.Reader {
+	return base64.NewDecoder(base64.StdEncoding, r)
+}
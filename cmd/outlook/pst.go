@@ -0,0 +1,771 @@
+package outlook
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Messaging layer of a PST, see MS-PST 2.4. A new PST gets the nodes Outlook makes for an empty data file,
+// then a folder under "Top of Outlook data file" for each folder path messages are added to.
+
+// node types, the low 5 bits of a NID
+const (
+	nidTypeFolder        = 0x02
+	nidTypeSearchFolder  = 0x03
+	nidTypeMessage       = 0x04
+	nidTypeAttachment    = 0x05
+	nidTypeAssocMessage  = 0x08
+	nidTypeHierarchy     = 0x0D
+	nidTypeContents      = 0x0E
+	nidTypeAssocContents = 0x0F
+	nidTypeLTP           = 0x1F
+)
+
+// fixed NIDs of an empty PST
+const (
+	nidMessageStore     = 0x21
+	nidNameToIDMap      = 0x61
+	nidRootFolder       = 0x122
+	nidSearchManagement = 0x1E1
+	nidSearchActivity   = 0x201
+	nidSearchDomain     = 0x261
+	nidHierarchyTmpl    = 0x60D
+	nidContentsTmpl     = 0x60E
+	nidAssocTmpl        = 0x60F
+	nidSearchTmpl       = 0x610
+	nidReceiveFolders   = 0x62B
+	nidOutgoingQueue    = 0x64C
+	nidAttachmentTmpl   = 0x671
+	nidRecipientTmpl    = 0x692
+	nidChangeHistory    = 0x6B6
+	nidTombstones       = 0x6D7
+	nidTombstonesSearch = 0x6F8
+	nidSpamFolder       = 0x2223
+	nidSpamCriteria     = 0x2226
+	nidSpamUpdates      = 0x2227
+	nidSpamContents     = 0x2230
+	nidRecipientTable   = 0x692
+	nidAttachmentTable  = 0x671
+)
+
+// more property IDs, see MS-OXPROPS
+const (
+	propImportance          = 0x0017
+	propSensitivity         = 0x0036
+	propSentRepName         = 0x0042
+	propSearchKey           = 0x300B
+	propMessageToMe         = 0x0057
+	propMessageCcMe         = 0x0058
+	propSentRepAddrType     = 0x0064
+	propSentRepEmail        = 0x0065
+	propConversationTopic   = 0x0070
+	propConversationIndex   = 0x0071
+	propSenderAddrType      = 0x0C1E
+	propResponsibility      = 0x0E0F
+	propMessageFlags        = 0x0E07
+	propMessageSize         = 0x0E08
+	propMessageStatus       = 0x0E17
+	propAttachSize          = 0x0E20
+	propRecordKey           = 0x0FF9
+	propObjectType          = 0x0FFE
+	propEntryID             = 0x0FFF
+	propAddrType            = 0x3002
+	propCreationTime        = 0x3007
+	propLastModified        = 0x3008
+	propComment             = 0x3004
+	propDisplayType         = 0x3900
+	propTransmittableName   = 0x39FF
+	propSendRichInfo        = 0x3A40
+	propAttachMethod        = 0x3705
+	propRenderingPosition   = 0x370B
+	propInternetCodepage    = 0x3FDE
+	propIPMSubtree          = 0x35E0
+	propWastebasket         = 0x35E3
+	propFinder              = 0x35E7
+	propValidFolderMask     = 0x35DF
+	propContentCount        = 0x3602
+	propContentUnread       = 0x3603
+	propSubfolders          = 0x360A
+	propContainerClass      = 0x3613
+	propHiddenCount         = 0x6635
+	propHiddenUnread        = 0x6636
+	propReceiveFolder       = 0x6605
+	propPstPassword         = 0x67FF
+	propSearchUpdates       = 0x660B
+	propSenderSmtpRep       = 0x5D02
+	propNameidBucketCount   = 0x0001
+	propNameidStreamGUID    = 0x0002
+	propNameidStreamEntry   = 0x0003
+	propNameidStreamString  = 0x0004
+	propNameidBucketBase    = 0x1000
+	propNamedContentType    = 0x8000 // content-type in PS_INTERNET_HEADERS, the only entry in the name to ID map
+	propReplItemID          = 0x0E30
+	propReplChangenum       = 0x0E33
+	propReplVersionHistory  = 0x0E34
+	propReplFlags           = 0x0E38
+	propReplCopiedFromVer   = 0x0E3C
+	propReplCopiedFromItem  = 0x0E3D
+	propItemTemporaryFlags  = 0x1097
+	propChangeKey           = 0x3013
+	propSecureSubmitFlags   = 0x65C6
+	propAssocMessageClass   = 0x6800
+	propAssocShowInFolders  = 0x6803
+	propAssocFolderType     = 0x6805
+	propAssocFolderName     = 0x682F
+	propViewDescriptorFlags = 0x7003
+	propViewDescriptorLink  = 0x7004
+	propViewDescriptorStrs  = 0x7005
+	propViewDescriptorName  = 0x7006
+	propViewDescriptorVer   = 0x7007
+	propSearchFolderID      = 0x67F1
+	propDisplayCcSearch     = 0x0E05
+	propHasAttachSearch     = 0x0E2A
+	propReplSourceKey       = 0x0E31
+	propReplParentSourceKey = 0x0E3E
+)
+
+// attachment and recipient constants, see MS-OXCMSG
+const (
+	msgFlagRead      = 0x01
+	msgFlagHasAttach = 0x10
+	attachByValue    = 1
+	attachEmbedded   = 5
+	objectMailUser   = 6
+)
+
+func tag(id, ptype uint16) uint32 { return uint32(id)<<16 | uint32(ptype) }
+
+// column sets Outlook gives the template tables, which new tables copy
+var (
+	hierarchyColumns = []uint32{
+		tag(propReplItemID, typeBinary), tag(propReplChangenum, typeInt64), tag(propReplVersionHistory, typeBinary),
+		tag(propReplFlags, typeInt32), tag(propDisplayName, typeUnicode), tag(propContentCount, typeInt32),
+		tag(propContentUnread, typeInt32), tag(propSubfolders, typeBoolean), tag(propContainerClass, typeUnicode),
+		tag(propHiddenCount, typeInt32), tag(propHiddenUnread, typeInt32),
+	}
+	contentsColumns = []uint32{
+		tag(propImportance, typeInt32), tag(propMessageClass, typeUnicode), tag(propSensitivity, typeInt32),
+		tag(propSubject, typeUnicode), tag(propClientSubmitTime, typeSysTime), tag(propSentRepName, typeUnicode),
+		tag(propMessageToMe, typeBoolean), tag(propMessageCcMe, typeBoolean), tag(propConversationTopic, typeUnicode),
+		tag(propConversationIndex, typeBinary), tag(propDisplayCc, typeUnicode), tag(propDisplayTo, typeUnicode),
+		tag(propDeliveryTime, typeSysTime), tag(propMessageFlags, typeInt32), tag(propMessageSize, typeInt32),
+		tag(propMessageStatus, typeInt32), tag(propReplItemID, typeBinary), tag(propReplChangenum, typeInt64),
+		tag(propReplVersionHistory, typeBinary), tag(propReplFlags, typeInt32), tag(propReplCopiedFromVer, typeBinary),
+		tag(propReplCopiedFromItem, typeBinary), tag(propItemTemporaryFlags, typeInt32), tag(propLastModified, typeSysTime),
+		tag(propChangeKey, typeBinary), tag(propSecureSubmitFlags, typeInt32),
+	}
+	assocColumns = []uint32{
+		tag(propMessageClass, typeUnicode), tag(propMessageFlags, typeInt32), tag(propMessageStatus, typeInt32),
+		tag(propDisplayName, typeUnicode), tag(propAssocMessageClass, typeUnicode), tag(propAssocShowInFolders, typeBoolean),
+		tag(propAssocFolderType, 0x1003), tag(propAssocFolderName, typeUnicode), tag(propViewDescriptorFlags, typeInt32),
+		tag(propViewDescriptorLink, typeBinary), tag(propViewDescriptorStrs, typeBinary), tag(propViewDescriptorName, typeUnicode),
+		tag(propViewDescriptorVer, typeInt32),
+	}
+	searchColumns = []uint32{
+		tag(propImportance, typeInt32), tag(propMessageClass, typeUnicode), tag(propSensitivity, typeInt32),
+		tag(propSubject, typeUnicode), tag(propSentRepName, typeUnicode), tag(propMessageToMe, typeBoolean),
+		tag(propMessageCcMe, typeBoolean), tag(propDisplayCc, typeUnicode), tag(propDisplayTo, typeUnicode),
+		tag(propDisplayCcSearch, typeUnicode), tag(propDeliveryTime, typeSysTime), tag(propMessageFlags, typeInt32),
+		tag(propMessageSize, typeInt32), tag(propMessageStatus, typeInt32), tag(propHasAttachSearch, typeBoolean),
+		tag(propLastModified, typeSysTime), tag(propSearchFolderID, typeInt32),
+	}
+	attachmentColumns = []uint32{
+		tag(propAttachSize, typeInt32), tag(propAttachFilename, typeUnicode), tag(propAttachMethod, typeInt32),
+		tag(propRenderingPosition, typeInt32),
+	}
+	recipientColumns = []uint32{
+		tag(propRecipientType, typeInt32), tag(propResponsibility, typeBoolean), tag(propRecordKey, typeBinary),
+		tag(propObjectType, typeInt32), tag(propEntryID, typeBinary), tag(propDisplayName, typeUnicode),
+		tag(propAddrType, typeUnicode), tag(propEmailAddress, typeUnicode), tag(propSearchKey, typeBinary),
+		tag(propDisplayType, typeInt32), tag(propTransmittableName, typeUnicode), tag(propSendRichInfo, typeBoolean),
+		tag(propSmtpAddress, typeUnicode),
+	}
+	changeHistoryColumns = []uint32{
+		tag(propReplChangenum, typeInt64), tag(0x0E37, typeBinary), tag(propReplFlags, typeInt32),
+	}
+	receiveFolderColumns = []uint32{tag(propMessageClass, typeUnicode), tag(propReceiveFolder, typeInt32)}
+	outgoingQueueColumns = []uint32{
+		tag(propClientSubmitTime, typeSysTime), tag(0x0E10, typeInt32), tag(0x0E14, typeInt32),
+	}
+	tombstoneColumns = []uint32{
+		tag(propMessageClass, typeUnicode), tag(propReplItemID, typeBinary), tag(propReplSourceKey, typeBinary),
+		tag(propReplChangenum, typeInt64), tag(propReplVersionHistory, typeBinary), tag(propReplFlags, typeInt32),
+		tag(propReplParentSourceKey, typeBinary),
+	}
+	tombstoneSearchColumns = []uint32{tag(propReplChangenum, typeInt64), tag(propCreationTime, typeSysTime)}
+)
+
+// psetidInternetHeaders is the property set of named properties holding internet headers
+var psetidInternetHeaders = []byte{0x86, 0x03, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0xC0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x46}
+
+// oneOffProvider marks a recipient entry ID that carries the address itself rather than pointing to an address book
+var oneOffProvider = []byte{0x81, 0x2B, 0x1F, 0xA4, 0xBE, 0xA3, 0x10, 0x19, 0x9D, 0x6E, 0x00, 0xDD, 0x01, 0x0F, 0x54, 0x02}
+
+func unicodeProp(id uint16, s string) property {
+	return property{tag(id, typeUnicode), utf16le(s)}
+}
+
+func binaryProp(id uint16, b []byte) property {
+	return property{tag(id, typeBinary), b}
+}
+
+func int32Prop(id uint16, v int) property {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return property{tag(id, typeInt32), b}
+}
+
+func boolProp(id uint16, v bool) property {
+	if v {
+		return property{tag(id, typeBoolean), []byte{1}}
+	}
+	return property{tag(id, typeBoolean), []byte{0}}
+}
+
+// timeProp stores t as a FILETIME, 100ns ticks since 1601
+func timeProp(id uint16, t time.Time) property {
+	const epochDiff = 116444736000000000
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/100+epochDiff))
+	return property{tag(id, typeSysTime), b}
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// rowValues keys props by tag for a table row
+func rowValues(props []property) map[uint32][]byte {
+	values := map[uint32][]byte{}
+	for _, p := range props {
+		values[p.tag] = p.value
+	}
+	return values
+}
+
+// pstFolder is a folder under the IPM subtree. Its messages are written as they are added,
+// the folder itself and its tables are written on close.
+type pstFolder struct {
+	nid      uint32
+	name     string
+	children []*pstFolder
+	rows     []tableRow // contents table
+}
+
+// PSTWriter writes messages into a new Unicode PST
+type PSTWriter struct {
+	db        *ndb
+	name      string
+	recordKey []byte
+	top       *pstFolder
+	deleted   *pstFolder
+	finder    *pstFolder
+}
+
+// NewPSTWriter starts an empty PST, named displayName in Outlook, on w.
+// Nothing is readable until Close writes the B-trees and header.
+func NewPSTWriter(w io.WriterAt, displayName string) (*PSTWriter, error) {
+	p := &PSTWriter{db: newNDB(w), name: displayName, recordKey: make([]byte, 16)}
+	if _, err := rand.Read(p.recordKey); err != nil {
+		return nil, err
+	}
+	p.top = &pstFolder{nid: p.db.newNID(nidTypeFolder), name: "Top of Outlook data file"}
+	p.finder = &pstFolder{nid: p.db.newNID(nidTypeFolder), name: "Search Root"}
+	p.deleted = &pstFolder{nid: p.db.newNID(nidTypeFolder), name: "Deleted Items"}
+	p.top.children = append(p.top.children, p.deleted)
+	return p, nil
+}
+
+// folder finds or makes the folder at path under the top of the PST
+func (p *PSTWriter) folder(path []string) *pstFolder {
+	f := p.top
+	for _, name := range path {
+		var next *pstFolder
+		for _, c := range f.children {
+			if c.name == name {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			next = &pstFolder{nid: p.db.newNID(nidTypeFolder), name: name}
+			f.children = append(f.children, next)
+		}
+		f = next
+	}
+	return f
+}
+
+// AddMessage writes m into the folder at path, making the folders as needed
+func (p *PSTWriter) AddMessage(path []string, m *Message) error {
+	f := p.folder(path)
+	nid := p.db.newNID(nidTypeMessage)
+	node, props, err := p.messageNode(m)
+	if err != nil {
+		return err
+	}
+	bidData, bidSub, err := node.write()
+	if err != nil {
+		return err
+	}
+	p.db.addNode(nid, bidData, bidSub, f.nid)
+	f.rows = append(f.rows, tableRow{id: nid, values: rowValues(props)})
+	return nil
+}
+
+// messageNode builds the property context of m with its recipient and attachment tables as subnodes.
+// Embedded messages become subnodes of their attachment, built the same way.
+func (p *PSTWriter) messageNode(m *Message) (*ltpNode, []property, error) {
+	node := newLTPNode(p.db, clientPC)
+	props := messageProps(m)
+
+	recipients := newLTPNode(p.db, clientTC)
+	rows := []tableRow{}
+	for i, r := range m.Recipients {
+		rows = append(rows, tableRow{id: uint32(i), values: rowValues(recipientProps(r))})
+	}
+	if err := recipients.tableContext(recipientColumns, rows); err != nil {
+		return nil, nil, err
+	}
+	if err := node.addSubnode(nidRecipientTable, recipients); err != nil {
+		return nil, nil, err
+	}
+
+	if len(m.Attachments) > 0 {
+		rows := []tableRow{}
+		for _, a := range m.Attachments {
+			attachment := newLTPNode(p.db, clientPC)
+			attachProps := attachmentProps(a)
+			if a.Embedded != nil {
+				embedded, childProps, err := p.messageNode(a.Embedded)
+				if err != nil {
+					return nil, nil, err
+				}
+				embeddedNID := p.db.newNID(nidTypeAttachment)
+				if err := attachment.addSubnode(embeddedNID, embedded); err != nil {
+					return nil, nil, err
+				}
+				attachProps = embeddedProps(a, embeddedNID, childProps)
+			}
+			if err := attachment.propertyContext(attachProps); err != nil {
+				return nil, nil, err
+			}
+			attachNID := p.db.newNID(nidTypeAttachment)
+			if err := node.addSubnode(attachNID, attachment); err != nil {
+				return nil, nil, err
+			}
+			rows = append(rows, tableRow{id: attachNID, values: rowValues(attachProps)})
+		}
+		attachments := newLTPNode(p.db, clientTC)
+		if err := attachments.tableContext(attachmentColumns, rows); err != nil {
+			return nil, nil, err
+		}
+		if err := node.addSubnode(nidAttachmentTable, attachments); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := node.propertyContext(props); err != nil {
+		return nil, nil, err
+	}
+	return node, props, nil
+}
+
+// messageProps maps a message onto the properties Outlook shows for received mail
+func messageProps(m *Message) []property {
+	class := m.Class
+	if class == "" {
+		class = "IPM.Note"
+	}
+	flags := msgFlagRead
+	size := len(m.TransportHeaders) + len(m.Body) + len(m.HTML)
+	for _, a := range m.Attachments {
+		flags |= msgFlagHasAttach
+		size += len(a.Data)
+	}
+	props := []property{
+		unicodeProp(propMessageClass, class),
+		unicodeProp(propSubject, m.Subject),
+		unicodeProp(propConversationTopic, conversationTopic(m.Subject)),
+		int32Prop(propImportance, 1),
+		int32Prop(propSensitivity, 0),
+		int32Prop(propMessageFlags, flags),
+		int32Prop(propMessageSize, size),
+		int32Prop(propMessageStatus, 0),
+		boolProp(propMessageToMe, false),
+		boolProp(propMessageCcMe, false),
+		unicodeProp(propDisplayTo, displayList(m, RecipientTo, m.DisplayTo)),
+		unicodeProp(propDisplayCc, displayList(m, RecipientCc, m.DisplayCc)),
+		unicodeProp(propDisplayBcc, displayList(m, RecipientBcc, m.DisplayBcc)),
+	}
+	senderName := m.SenderName
+	if senderName == "" {
+		senderName = m.SenderEmail
+	}
+	if senderName != "" {
+		props = append(props,
+			unicodeProp(propSenderName, senderName),
+			unicodeProp(propSentRepName, senderName),
+		)
+	}
+	if m.SenderEmail != "" {
+		props = append(props,
+			unicodeProp(propSenderEmail, m.SenderEmail),
+			unicodeProp(propSenderAddrType, "SMTP"),
+			unicodeProp(propSenderSmtp, m.SenderEmail),
+			unicodeProp(propSentRepEmail, m.SenderEmail),
+			unicodeProp(propSentRepAddrType, "SMTP"),
+			unicodeProp(propSenderSmtpRep, m.SenderEmail),
+		)
+	}
+	if !m.Submitted.IsZero() {
+		props = append(props,
+			timeProp(propClientSubmitTime, m.Submitted),
+			timeProp(propDeliveryTime, m.Submitted),
+			timeProp(propCreationTime, m.Submitted),
+			timeProp(propLastModified, m.Submitted),
+		)
+	}
+	if m.MessageID != "" {
+		props = append(props, unicodeProp(propMessageID, m.MessageID))
+	}
+	if m.TransportHeaders != "" {
+		props = append(props, unicodeProp(propTransportHeaders, m.TransportHeaders))
+		if contentType := headerValue(m.TransportHeaders, "Content-Type"); contentType != "" {
+			props = append(props, unicodeProp(propNamedContentType, contentType))
+		}
+	}
+	if m.Body != "" {
+		props = append(props, unicodeProp(propBody, m.Body))
+	}
+	if len(m.HTML) > 0 {
+		props = append(props, binaryProp(propHTML, m.HTML), int32Prop(propInternetCodepage, 65001))
+	}
+	return props
+}
+
+// displayList is the recipient names of one type joined the way Outlook shows them
+func displayList(m *Message, rType int, fallback string) string {
+	names := []string{}
+	for _, r := range m.Recipients {
+		if r.Type != rType {
+			continue
+		}
+		if r.Name != "" {
+			names = append(names, r.Name)
+		} else {
+			names = append(names, r.Address)
+		}
+	}
+	if len(names) == 0 {
+		return fallback
+	}
+	return strings.Join(names, "; ")
+}
+
+// conversationTopic is the subject without reply and forward prefixes
+func conversationTopic(subject string) string {
+	for {
+		trimmed := strings.TrimSpace(subject)
+		upper := strings.ToUpper(trimmed)
+		found := false
+		for _, prefix := range []string{"RE:", "FW:", "FWD:"} {
+			if strings.HasPrefix(upper, prefix) {
+				subject = trimmed[len(prefix):]
+				found = true
+			}
+		}
+		if !found {
+			return trimmed
+		}
+	}
+}
+
+// headerValue finds a header, unfolded, in a raw header block
+func headerValue(raw, name string) string {
+	value, in := "", false
+	for _, line := range strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n") {
+		if in && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			value += " " + strings.TrimSpace(line)
+			continue
+		}
+		if in {
+			break
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			value, in = strings.TrimSpace(v), true
+		}
+	}
+	return value
+}
+
+func recipientProps(r Recipient) []property {
+	name := r.Name
+	if name == "" {
+		name = r.Address
+	}
+	entryID := append(make([]byte, 4), oneOffProvider...)
+	entryID = append(entryID, 0x00, 0x00, 0x01, 0x80) // version 0, unicode and no rich text
+	for _, s := range []string{name, "SMTP", r.Address} {
+		entryID = append(entryID, utf16le(s)...)
+		entryID = append(entryID, 0, 0)
+	}
+	return []property{
+		int32Prop(propRecipientType, r.Type),
+		boolProp(propResponsibility, true),
+		int32Prop(propObjectType, objectMailUser),
+		binaryProp(propEntryID, entryID),
+		binaryProp(propRecordKey, entryID),
+		unicodeProp(propDisplayName, name),
+		unicodeProp(propTransmittableName, name),
+		unicodeProp(propAddrType, "SMTP"),
+		unicodeProp(propEmailAddress, r.Address),
+		unicodeProp(propSmtpAddress, r.Address),
+		binaryProp(propSearchKey, []byte("SMTP:"+strings.ToUpper(r.Address))),
+		int32Prop(propDisplayType, 0),
+		boolProp(propSendRichInfo, false),
+	}
+}
+
+func attachmentProps(a Attachment) []property {
+	props := []property{
+		int32Prop(propAttachSize, len(a.Data)),
+		int32Prop(propAttachMethod, attachByValue),
+		int32Prop(propRenderingPosition, -1),
+		binaryProp(propAttachData, a.Data),
+	}
+	if a.Filename != "" {
+		props = append(props,
+			unicodeProp(propAttachFilename, a.Filename),
+			unicodeProp(propAttachLongName, a.Filename),
+			unicodeProp(propDisplayName, a.Filename),
+		)
+	}
+	if a.MimeTag != "" {
+		props = append(props, unicodeProp(propAttachMimeTag, a.MimeTag))
+	}
+	return props
+}
+
+// embeddedProps is an attachment holding an Outlook message, stored in the attachment's subnode nid.
+// The object value is the subnode NID and the size of the message.
+func embeddedProps(a Attachment, nid uint32, messageProps []property) []property {
+	size := 0
+	for _, p := range messageProps {
+		size += len(p.value)
+	}
+	object := make([]byte, 8)
+	binary.LittleEndian.PutUint32(object, nid)
+	binary.LittleEndian.PutUint32(object[4:], uint32(size))
+	name := a.Filename
+	if name == "" {
+		name = a.Embedded.Subject
+	}
+	return []property{
+		int32Prop(propAttachSize, size),
+		int32Prop(propAttachMethod, attachEmbedded),
+		int32Prop(propRenderingPosition, -1),
+		{tag: tag(propAttachData, typeObject), value: object},
+		unicodeProp(propDisplayName, name),
+	}
+}
+
+// writeFolder writes f and its subfolders, depth first, under parent
+func (p *PSTWriter) writeFolder(f *pstFolder, parent uint32) error {
+	subfolders := []tableRow{}
+	for _, c := range f.children {
+		if err := p.writeFolder(c, f.nid); err != nil {
+			return err
+		}
+		subfolders = append(subfolders, tableRow{id: c.nid, values: rowValues(folderProps(c))})
+	}
+	props := folderProps(f)
+	if f == p.deleted {
+		props = append(props, unicodeProp(propComment, "Deleted Items folder"))
+	}
+	return p.writeFolderNodes(f.nid, parent, props, subfolders, f.rows)
+}
+
+func folderProps(f *pstFolder) []property {
+	return []property{
+		unicodeProp(propDisplayName, f.name),
+		int32Prop(propContentCount, len(f.rows)),
+		int32Prop(propContentUnread, 0),
+		boolProp(propSubfolders, len(f.children) > 0),
+		unicodeProp(propContainerClass, "IPF.Note"),
+		int32Prop(propHiddenCount, 0),
+		int32Prop(propHiddenUnread, 0),
+	}
+}
+
+// writeFolderNodes writes a folder's property context and its hierarchy, contents and associated contents tables
+func (p *PSTWriter) writeFolderNodes(nid, parent uint32, props []property, subfolders, contents []tableRow) error {
+	if err := p.writePC(nid, parent, props); err != nil {
+		return err
+	}
+	index := nid &^ 0x1F
+	if err := p.writeTC(index|nidTypeHierarchy, hierarchyColumns, subfolders); err != nil {
+		return err
+	}
+	if err := p.writeTC(index|nidTypeContents, contentsColumns, contents); err != nil {
+		return err
+	}
+	return p.writeTC(index|nidTypeAssocContents, assocColumns, nil)
+}
+
+func (p *PSTWriter) writePC(nid, parent uint32, props []property) error {
+	node := newLTPNode(p.db, clientPC)
+	if err := node.propertyContext(props); err != nil {
+		return err
+	}
+	bidData, bidSub, err := node.write()
+	if err != nil {
+		return err
+	}
+	p.db.addNode(nid, bidData, bidSub, parent)
+	return nil
+}
+
+func (p *PSTWriter) writeTC(nid uint32, cols []uint32, rows []tableRow) error {
+	node := newLTPNode(p.db, clientTC)
+	if err := node.tableContext(cols, rows); err != nil {
+		return err
+	}
+	bidData, bidSub, err := node.write()
+	if err != nil {
+		return err
+	}
+	p.db.addNode(nid, bidData, bidSub, 0)
+	return nil
+}
+
+// entryID points at a folder in this store
+func (p *PSTWriter) entryID(nid uint32) []byte {
+	b := append(make([]byte, 4), p.recordKey...)
+	return binary.LittleEndian.AppendUint32(b, nid)
+}
+
+// nameToIDMap registers the one named property messages use, content-type in PS_INTERNET_HEADERS
+func nameToIDMap() []property {
+	const buckets = 251
+	name := utf16le("content-type")
+	strs := binary.LittleEndian.AppendUint32(nil, uint32(len(name)))
+	strs = append(strs, name...)
+	// GUID index 3 is the first GUID in the stream, 1 and 2 being the implied PS_MAPI and PS_PUBLIC_STRINGS
+	const guidAndKind = 3<<1 | 1
+	entry := make([]byte, 8)
+	binary.LittleEndian.PutUint16(entry[4:], guidAndKind)
+	bucket := make([]byte, 8)
+	hash := pstCRC(name)
+	binary.LittleEndian.PutUint32(bucket, hash)
+	binary.LittleEndian.PutUint16(bucket[4:], guidAndKind)
+	return []property{
+		int32Prop(propNameidBucketCount, buckets),
+		binaryProp(propNameidStreamGUID, psetidInternetHeaders),
+		binaryProp(propNameidStreamEntry, entry),
+		binaryProp(propNameidStreamString, strs),
+		binaryProp(propNameidBucketBase+uint16((hash^guidAndKind)%buckets), bucket),
+	}
+}
+
+// Close writes the folders, the nodes every PST has and the B-trees and header. The PST is complete afterwards.
+func (p *PSTWriter) Close() error {
+	if p.db.written {
+		return nil
+	}
+	store := []property{
+		binaryProp(propRecordKey, p.recordKey),
+		unicodeProp(propDisplayName, p.name),
+		int32Prop(propValidFolderMask, 0x89),
+		binaryProp(propIPMSubtree, p.entryID(p.top.nid)),
+		binaryProp(propWastebasket, p.entryID(p.deleted.nid)),
+		binaryProp(propFinder, p.entryID(p.finder.nid)),
+		int32Prop(propReplFlags, 0),
+		boolProp(0x6633, true),
+		int32Prop(propPstPassword, 0),
+	}
+	if err := p.writePC(nidMessageStore, 0, store); err != nil {
+		return err
+	}
+	if err := p.writePC(nidNameToIDMap, 0, nameToIDMap()); err != nil {
+		return err
+	}
+
+	for _, t := range []struct {
+		nid  uint32
+		cols []uint32
+		rows []tableRow
+	}{
+		{nidHierarchyTmpl, hierarchyColumns, nil},
+		{nidContentsTmpl, contentsColumns, nil},
+		{nidAssocTmpl, assocColumns, nil},
+		{nidSearchTmpl, searchColumns, nil},
+		{nidReceiveFolders, receiveFolderColumns, []tableRow{{id: 1, values: rowValues([]property{
+			int32Prop(propReceiveFolder, nidRootFolder),
+		})}}},
+		{nidOutgoingQueue, outgoingQueueColumns, nil},
+		{nidAttachmentTmpl, attachmentColumns, nil},
+		{nidRecipientTmpl, recipientColumns, nil},
+		{nidChangeHistory, changeHistoryColumns, nil},
+		{nidTombstones, tombstoneColumns, nil},
+		{nidTombstonesSearch, tombstoneSearchColumns, nil},
+		{nidSpamContents, searchColumns, nil},
+	} {
+		if err := p.writeTC(t.nid, t.cols, t.rows); err != nil {
+			return err
+		}
+	}
+
+	// the spam search folder sits in the root next to the IPM subtree and search root
+	spam := []property{
+		unicodeProp(propDisplayName, "SPAM Search Folder 2"),
+		int32Prop(propContentCount, 0),
+		int32Prop(propContentUnread, 0),
+		boolProp(propSubfolders, false),
+	}
+	if err := p.writePC(nidSpamFolder, nidRootFolder, spam); err != nil {
+		return err
+	}
+	if err := p.writePC(nidSpamUpdates, 0, []property{int32Prop(propSearchUpdates, 0)}); err != nil {
+		return err
+	}
+	p.db.addNode(nidSpamCriteria, 0, 0, 0)
+	p.db.addNode(nidSearchManagement, 0, 0, 0)
+	activity, err := p.db.writeBlock(binary.LittleEndian.AppendUint32(nil, nidSpamFolder), false)
+	if err != nil {
+		return err
+	}
+	p.db.addNode(nidSearchActivity, activity, 0, 0)
+	p.db.addNode(nidSearchDomain, 0, 0, 0)
+
+	if err := p.writeFolder(p.top, nidRootFolder); err != nil {
+		return err
+	}
+	if err := p.writeFolder(p.finder, nidRootFolder); err != nil {
+		return err
+	}
+	root := []property{
+		unicodeProp(propDisplayName, ""),
+		int32Prop(propContentCount, 0),
+		int32Prop(propContentUnread, 0),
+		boolProp(propSubfolders, true),
+	}
+	rootFolders := []tableRow{
+		{id: p.top.nid, values: rowValues(folderProps(p.top))},
+		{id: p.finder.nid, values: rowValues(folderProps(p.finder))},
+		{id: nidSpamFolder, values: rowValues(spam)},
+	}
+	if err := p.writeFolderNodes(nidRootFolder, nidRootFolder, root, rootFolders, nil); err != nil {
+		return err
+	}
+	return p.db.close()
+}
@@ -0,0 +1,162 @@
+package outlook
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pst "github.com/mooijtech/go-pst/v6/pkg"
+	"github.com/mooijtech/go-pst/v6/pkg/properties"
+	"github.com/rotisserie/eris"
+)
+
+// plainMIME is a deciphered message with a body over the heap allocation limit and an attachment over one block
+func plainMIME(i int) []byte {
+	var b bytes.Buffer
+	b.WriteString("From: \"Sender\" <sender@local>\r\n")
+	b.WriteString("To: \"Rcpt One\" <one@local>, two@local\r\n")
+	b.WriteString("Cc: =?utf-8?q?Caf=C3=A9?= <cafe@local>\r\n")
+	b.WriteString(fmt.Sprintf("Subject: message %d\r\n", i))
+	b.WriteString("Date: Fri, 17 Apr 2020 16:00:00 +0000\r\n")
+	b.WriteString(fmt.Sprintf("Message-ID: <%d@local>\r\n", i))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n")
+	b.WriteString("--b1\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Repeat("plain text body ", 300) + "\r\n")
+	b.WriteString("--b1\r\nContent-Type: application/octet-stream\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"data.bin\"\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	b.WriteString(base64Lines(bytes.Repeat([]byte{byte(i)}, 20000)))
+	b.WriteString("--b1--\r\n")
+	return b.Bytes()
+}
+
+func base64Lines(data []byte) string {
+	var b bytes.Buffer
+	writeBase64(&b, data)
+	return strings.ReplaceAll(b.String(), "\n", "\r\n")
+}
+
+func TestFromRFC822(t *testing.T) {
+	m, err := FromRFC822(plainMIME(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "message 7" || m.SenderName != "Sender" || m.SenderEmail != "sender@local" ||
+		m.MessageID != "<7@local>" || !m.Submitted.Equal(testSent) {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	if len(m.Recipients) != 3 || m.Recipients[2].Name != "Café" || m.Recipients[2].Type != RecipientCc {
+		t.Errorf("Unexpected recipients %+v", m.Recipients)
+	}
+	if !strings.HasPrefix(m.Body, "plain text body") {
+		t.Errorf("Unexpected body %.40q", m.Body)
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0].Filename != "data.bin" || len(m.Attachments[0].Data) != 20000 {
+		t.Errorf("Unexpected attachments %+v", m.Attachments)
+	}
+	if !strings.HasPrefix(m.TransportHeaders, "From:") || !strings.HasSuffix(m.TransportHeaders, "\r\n") {
+		t.Errorf("Unexpected transport headers %q", m.TransportHeaders)
+	}
+}
+
+func TestPSTWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alice.pst")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewPSTWriter(f, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough messages that the contents table spills out of its heap
+	const inboxCount = 200
+	for i := 0; i < inboxCount; i++ {
+		m, err := FromRFC822(plainMIME(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddMessage([]string{"mail.pst", "Inbox"}, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := FromRFC822([]byte("From: a@local\r\nSubject: loose\r\n\r\nhi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddMessage([]string{"loose"}, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	pstFile, err := pst.New(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pstFile.Cleanup()
+	counts := map[string]int{}
+	err = pstFile.WalkFolders(func(folder *pst.Folder) error {
+		it, err := folder.GetMessageIterator()
+		if eris.Is(err, pst.ErrMessagesNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for it.Next() {
+			message := it.Value()
+			props, ok := message.Properties.(*properties.Message)
+			if !ok {
+				t.Errorf("%s: not a message", folder.Name)
+				continue
+			}
+			counts[folder.Name]++
+			if folder.Name != "Inbox" {
+				continue
+			}
+			i := 0
+			fmt.Sscanf(props.GetSubject(), "message %d", &i)
+			if props.GetSenderName() != "Sender" || props.GetInternetMessageId() != fmt.Sprintf("<%d@local>", i) ||
+				props.GetDisplayTo() != "Rcpt One; two@local" || props.GetDisplayCc() != "Café" ||
+				!strings.HasPrefix(props.GetBody(), "plain text body") ||
+				!strings.Contains(props.GetTransportMessageHeaders(), "Message-ID:") {
+				t.Errorf("Unexpected message %q from %q to %q", props.GetSubject(), props.GetSenderName(), props.GetDisplayTo())
+			}
+			attachments, err := message.GetAttachmentIterator()
+			if err != nil {
+				return err
+			}
+			for attachments.Next() {
+				a := attachments.Value()
+				var data bytes.Buffer
+				if _, err := a.WriteTo(&data); err != nil {
+					return err
+				}
+				if a.GetAttachLongFilename() != "data.bin" || !bytes.Equal(data.Bytes(), bytes.Repeat([]byte{byte(i)}, 20000)) {
+					t.Errorf("Unexpected attachment %q of %d bytes on message %d", a.GetAttachLongFilename(), data.Len(), i)
+				}
+			}
+			if attachments.Err() != nil {
+				return attachments.Err()
+			}
+		}
+		return it.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["Inbox"] != inboxCount || counts["loose"] != 1 {
+		t.Errorf("Unexpected message counts %v", counts)
+	}
+}
@@ -0,0 +1,409 @@
+package outlook
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Lists, tables and properties (LTP) layer of a PST, see MS-PST 2.3.
+// Every node is a heap holding either a property context or a table context.
+// Values too big for the heap spill into subnodes of the node.
+
+const (
+	hnSig          = 0xEC
+	clientPC       = 0xBC
+	clientTC       = 0x7C
+	bthSig         = 0xB5
+	hnMaxAlloc     = 3580
+	hnMaxAllocs    = 2047
+	hnHeaderSize   = 12
+	hnPageHdrSize  = 2
+	hnBitmapHdrLen = 66
+)
+
+var errHeapFull = errors.New("outlook: PST heap is full")
+
+// property is a tagged value in the layout it is stored in, ex. UTF-16LE for strings
+type property struct {
+	tag   uint32 // property ID << 16 | property type
+	value []byte
+}
+
+func (p property) id() uint16    { return uint16(p.tag >> 16) }
+func (p property) ptype() uint16 { return uint16(p.tag) }
+
+// inline property types fit in the 4 byte value of a property context record
+func inline(ptype uint16) bool {
+	switch ptype {
+	case typeInt16, typeInt32, typeFloat32, typeError, typeBoolean:
+		return true
+	}
+	return false
+}
+
+// fixedSize is the length of a fixed size type in a table row, 0 for variable size types stored as an HNID
+func fixedSize(ptype uint16) int {
+	switch ptype {
+	case typeBoolean:
+		return 1
+	case typeInt16:
+		return 2
+	case typeInt32, typeFloat32, typeError:
+		return 4
+	case typeFloat64, typeCurrency, typeAppTime, typeInt64, typeSysTime:
+		return 8
+	}
+	return 0
+}
+
+// heap is a heap-on-node being built. Allocations are packed into pages of one block each.
+type heap struct {
+	client byte
+	root   uint32
+	pages  [][]byte // allocations, without the page header
+	allocs [][]int  // start of each allocation in a page, after the page header
+}
+
+func hnPageHeader(i int) int {
+	switch {
+	case i == 0:
+		return hnHeaderSize
+	case (i-8)%128 == 0:
+		return hnBitmapHdrLen
+	}
+	return hnPageHdrSize
+}
+
+// alloc stores b in the heap and returns its HID
+func (h *heap) alloc(b []byte) (uint32, error) {
+	if len(b) > hnMaxAlloc {
+		return 0, errHeapFull
+	}
+	i := len(h.pages) - 1
+	if i < 0 || len(h.allocs[i]) == hnMaxAllocs ||
+		hnPageHeader(i)+len(h.pages[i])+len(b)+1+4+2*(len(h.allocs[i])+2) > pstMaxBlockData {
+		if len(h.pages) == 0xFFFF {
+			return 0, errHeapFull
+		}
+		h.pages = append(h.pages, []byte{})
+		h.allocs = append(h.allocs, []int{})
+		i++
+	}
+	h.allocs[i] = append(h.allocs[i], len(h.pages[i]))
+	h.pages[i] = append(h.pages[i], b...)
+	return uint32(i)<<16 | uint32(len(h.allocs[i]))<<5, nil
+}
+
+// set overwrites an allocation with a value of the same length
+func (h *heap) set(hid uint32, b []byte) {
+	i := hid >> 16
+	copy(h.pages[i][h.allocs[i][(hid&0xFFFF)>>5-1]:], b)
+}
+
+// fillLevel is the free space bucket of a page as kept in rgbFillLevel
+func fillLevel(free int) byte {
+	for level, min := range []int{3584, 2560, 2048, 1792, 1536, 1280, 1024, 768, 512, 256, 128, 64, 32, 16, 8} {
+		if free >= min {
+			return byte(level)
+		}
+	}
+	return 0xF
+}
+
+// blocks lays out each heap page with its header and page map
+func (h *heap) blocks() [][]byte {
+	if len(h.pages) == 0 {
+		h.pages, h.allocs = [][]byte{{}}, [][]int{{}}
+	}
+	out := [][]byte{}
+	levels := make([]byte, len(h.pages))
+	for i, data := range h.pages {
+		hdr := hnPageHeader(i)
+		b := make([]byte, hdr, hdr+len(data)+4+2*(len(h.allocs[i])+1)+1)
+		b = append(b, data...)
+		if len(b)%2 == 1 {
+			b = append(b, 0)
+		}
+		ibHnpm := len(b)
+		binary.LittleEndian.PutUint16(b, uint16(ibHnpm))
+		pm := make([]byte, 4+2*(len(h.allocs[i])+1))
+		binary.LittleEndian.PutUint16(pm, uint16(len(h.allocs[i])))
+		for j, start := range h.allocs[i] {
+			binary.LittleEndian.PutUint16(pm[4+2*j:], uint16(hdr+start))
+		}
+		binary.LittleEndian.PutUint16(pm[4+2*len(h.allocs[i]):], uint16(hdr+len(data)))
+		b = append(b, pm...)
+		levels[i] = fillLevel(pstMaxBlockData - len(b))
+		out = append(out, b)
+	}
+	out[0][2] = hnSig
+	out[0][3] = h.client
+	binary.LittleEndian.PutUint32(out[0][4:], h.root)
+	// the header and each bitmap page keep the fill levels of the pages that follow it
+	fill := func(dst []byte, levels []byte) {
+		for j, l := range levels {
+			if j/2 < len(dst) {
+				dst[j/2] |= l << (4 * (j % 2))
+			}
+		}
+	}
+	fill(out[0][8:12], levels[:min(len(levels), 8)])
+	for i := 8; i < len(out); i += 128 {
+		fill(out[i][2:hnBitmapHdrLen], levels[i:min(len(levels), i+128)])
+	}
+	return out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ltpNode is a node, or subnode, being built: its heap and the subnodes its values spill into
+type ltpNode struct {
+	db   *ndb
+	heap heap
+	subs []subnode
+}
+
+func newLTPNode(db *ndb, client byte) *ltpNode {
+	return &ltpNode{db: db, heap: heap{client: client}}
+}
+
+// value stores a variable size value and returns its HNID, a HID in the heap or the NID of a subnode
+func (n *ltpNode) value(b []byte) (uint32, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(b) <= hnMaxAlloc {
+		hid, err := n.heap.alloc(b)
+		if err != errHeapFull {
+			return hid, err
+		}
+	}
+	bid, err := n.db.writeData(b)
+	if err != nil {
+		return 0, err
+	}
+	nid := n.db.newNID(nidTypeLTP)
+	n.subs = append(n.subs, subnode{nid: nid, bidData: bid})
+	return nid, nil
+}
+
+// addSubnode attaches a finished node, ex. an attachment, as a subnode with the given NID
+func (n *ltpNode) addSubnode(nid uint32, child *ltpNode) error {
+	bidData, bidSub, err := child.write()
+	if err != nil {
+		return err
+	}
+	n.subs = append(n.subs, subnode{nid: nid, bidData: bidData, bidSub: bidSub})
+	return nil
+}
+
+// write stores the heap and the subnode B-tree and returns their BIDs
+func (n *ltpNode) write() (uint64, uint64, error) {
+	bidData, err := n.db.writeBlocks(n.heap.blocks())
+	if err != nil {
+		return 0, 0, err
+	}
+	bidSub, err := n.db.writeSubnodes(n.subs)
+	return bidData, bidSub, err
+}
+
+// bth builds a B-tree-on-heap from records sorted by key and returns the HID of its header
+func (n *ltpNode) bth(records [][]byte, cbKey, cbEnt int) (uint32, error) {
+	header := []byte{bthSig, byte(cbKey), byte(cbEnt), 0, 0, 0, 0, 0}
+	hid, err := n.heap.alloc(header)
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return hid, nil
+	}
+	size := cbKey + cbEnt
+	for level := 0; ; level++ {
+		per := hnMaxAlloc / size
+		index := [][]byte{}
+		for start := 0; start < len(records); start += per {
+			end := min(start+per, len(records))
+			b := make([]byte, 0, (end-start)*size)
+			for _, r := range records[start:end] {
+				b = append(b, r...)
+			}
+			child, err := n.heap.alloc(b)
+			if err != nil {
+				return 0, err
+			}
+			key := make([]byte, cbKey+4)
+			copy(key, records[start][:cbKey])
+			binary.LittleEndian.PutUint32(key[cbKey:], child)
+			index = append(index, key)
+		}
+		if len(index) == 1 {
+			header[3] = byte(level)
+			copy(header[4:], index[0][cbKey:])
+			n.heap.set(hid, header)
+			return hid, nil
+		}
+		records, size = index, cbKey+4
+	}
+}
+
+// propertyContext fills the node as a property context holding props
+func (n *ltpNode) propertyContext(props []property) error {
+	sort.SliceStable(props, func(i, j int) bool { return props[i].id() < props[j].id() })
+	records := [][]byte{}
+	for i, p := range props {
+		if i > 0 && props[i-1].id() == p.id() {
+			continue
+		}
+		r := make([]byte, 8)
+		binary.LittleEndian.PutUint16(r, p.id())
+		binary.LittleEndian.PutUint16(r[2:], p.ptype())
+		if inline(p.ptype()) {
+			copy(r[4:], p.value)
+		} else {
+			hnid, err := n.value(p.value)
+			if err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(r[4:], hnid)
+		}
+		records = append(records, r)
+	}
+	root, err := n.bth(records, 2, 6)
+	n.heap.root = root
+	return err
+}
+
+// tableRow is one row of a table context, values keyed by property tag
+type tableRow struct {
+	id     uint32
+	values map[uint32][]byte
+}
+
+const (
+	tagRowID  = 0x67F20003
+	tagRowVer = 0x67F30003
+)
+
+// tableContext fills the node as a table context with columns cols, which exclude the row ID and version
+func (n *ltpNode) tableContext(cols []uint32, rows []tableRow) error {
+	type column struct {
+		tag  uint32
+		ib   int
+		cb   int
+		iBit int
+	}
+	all := []column{{tag: tagRowID, cb: 4}, {tag: tagRowVer, ib: 4, cb: 4, iBit: 1}}
+	for i, tag := range cols {
+		cb := fixedSize(uint16(tag))
+		if cb == 0 {
+			cb = 4
+		}
+		all = append(all, column{tag: tag, cb: cb, iBit: i + 2})
+	}
+	// 8 and 4 byte columns come first, then 2 byte and then 1 byte ones, with the cell existence bitmap last
+	ib := 8
+	var rgib [4]int
+	for g, sizes := range [][]int{{8, 4}, {2}, {1}} {
+		for _, size := range sizes {
+			for i := range all[2:] {
+				if all[i+2].cb == size {
+					all[i+2].ib = ib
+					ib += size
+				}
+			}
+		}
+		rgib[g] = ib
+	}
+	rgib[3] = ib + (len(all)+7)/8
+	rowSize := rgib[3]
+
+	matrix := make([]byte, 0, len(rows)*rowSize)
+	index := [][]byte{}
+	for i, r := range rows {
+		row := make([]byte, rowSize)
+		binary.LittleEndian.PutUint32(row, r.id)
+		binary.LittleEndian.PutUint32(row[4:], 1)
+		row[rgib[2]] |= 0xC0
+		for _, c := range all[2:] {
+			v, ok := r.values[c.tag]
+			if !ok || len(v) == 0 {
+				continue
+			}
+			if fixedSize(uint16(c.tag)) == 0 {
+				hnid, err := n.value(v)
+				if err != nil {
+					return err
+				}
+				binary.LittleEndian.PutUint32(row[c.ib:], hnid)
+			} else {
+				copy(row[c.ib:c.ib+c.cb], v)
+			}
+			row[rgib[2]+c.iBit/8] |= 0x80 >> (c.iBit % 8)
+		}
+		matrix = append(matrix, row...)
+		rec := make([]byte, 8)
+		binary.LittleEndian.PutUint32(rec, r.id)
+		binary.LittleEndian.PutUint32(rec[4:], uint32(i))
+		index = append(index, rec)
+	}
+	sort.Slice(index, func(i, j int) bool {
+		return binary.LittleEndian.Uint32(index[i]) < binary.LittleEndian.Uint32(index[j])
+	})
+
+	info := make([]byte, 22+8*len(all))
+	info[0] = clientTC
+	info[1] = byte(len(all))
+	for i, v := range rgib {
+		binary.LittleEndian.PutUint16(info[2+2*i:], uint16(v))
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].tag < all[j].tag })
+	for i, c := range all {
+		d := info[22+8*i:]
+		binary.LittleEndian.PutUint32(d, c.tag)
+		binary.LittleEndian.PutUint16(d[4:], uint16(c.ib))
+		d[6] = byte(c.cb)
+		d[7] = byte(c.iBit)
+	}
+	infoHID, err := n.heap.alloc(info)
+	if err != nil {
+		return err
+	}
+	rowIndex, err := n.bth(index, 4, 4)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(info[10:], rowIndex)
+
+	var hnidRows uint32
+	if len(matrix) > 0 && len(matrix) <= hnMaxAlloc {
+		if hnidRows, err = n.heap.alloc(matrix); err != nil {
+			return err
+		}
+	} else if len(matrix) > 0 {
+		// rows never straddle blocks, so every block but the last is padded out to the full block size
+		perBlock := pstMaxBlockData / rowSize
+		chunks := [][]byte{}
+		for len(matrix) > perBlock*rowSize {
+			chunk := make([]byte, pstMaxBlockData)
+			copy(chunk, matrix[:perBlock*rowSize])
+			chunks = append(chunks, chunk)
+			matrix = matrix[perBlock*rowSize:]
+		}
+		bid, err := n.db.writeBlocks(append(chunks, matrix))
+		if err != nil {
+			return err
+		}
+		hnidRows = n.db.newNID(nidTypeLTP)
+		n.subs = append(n.subs, subnode{nid: hnidRows, bidData: bid})
+	}
+	binary.LittleEndian.PutUint32(info[14:], hnidRows)
+	n.heap.set(infoHID, info)
+	n.heap.root = infoHID
+	return nil
+}
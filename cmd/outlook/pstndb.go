@@ -0,0 +1,468 @@
+package outlook
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Node database (NDB) layer of a Unicode PST, see MS-PST 2.2.
+// Blocks are appended to the file as they are written, the B-trees, allocation maps and header are written on close.
+
+const (
+	pstPageSize     = 512
+	pstTrailerSize  = 16
+	pstMaxBlockData = 8192 - pstTrailerSize
+	pstHeaderSize   = 564
+
+	amapFirst   = 0x4400
+	amapRange   = 0x3E000 // bytes covered by one AMap page
+	amapSlot    = 64      // bytes per AMap bit
+	pmapEvery   = 8       // a PMap follows every 8th AMap
+	fmapFirst   = 128     // the header holds the FMap bytes for the first 128 AMaps
+	fmapEvery   = 496
+	fpmapFirst  = 8192 // the header holds the FPMap bits for the first 8192 AMaps
+	fpmapEvery  = 31744
+	pageTrailer = pstPageSize - pstTrailerSize
+
+	ptypeBBT   = 0x80
+	ptypeNBT   = 0x81
+	ptypeFMap  = 0x82
+	ptypePMap  = 0x83
+	ptypeAMap  = 0x84
+	ptypeFPMap = 0x85
+
+	bidInternal = 0x2
+
+	nbtEntrySize = 32
+	bbtEntrySize = 24
+	btBranchSize = 24
+)
+
+// ErrPSTTooLarge is returned when a node has more subnodes than one level of subnode index can hold
+var ErrPSTTooLarge = errors.New("outlook: too many subnodes for one PST node")
+
+type bbtEntry struct {
+	bid uint64
+	ib  uint64
+	cb  uint16
+}
+
+type nbtEntry struct {
+	nid     uint32
+	bidData uint64
+	bidSub  uint64
+	parent  uint32
+}
+
+// ndb lays out blocks and pages in the file. Space is handed out from the front, skipping the map pages
+// at the start of each AMap range, and every allocation is recorded in the AMap bits.
+type ndb struct {
+	w       io.WriterAt
+	eof     uint64
+	amaps   [][]byte // bits of each AMap range, MSB first
+	nextB   uint64
+	nextP   uint64
+	rgnid   [32]uint32
+	bbt     []bbtEntry
+	nbt     []nbtEntry
+	written bool
+}
+
+func newNDB(w io.WriterAt) *ndb {
+	d := &ndb{w: w, eof: amapFirst, nextB: 4, nextP: 1}
+	for i := range d.rgnid {
+		d.rgnid[i] = 0x400
+	}
+	d.rgnid[nidTypeSearchFolder] = 0x4000
+	d.rgnid[nidTypeMessage] = 0x10000
+	d.rgnid[nidTypeAssocMessage] = 0x8000
+	return d
+}
+
+// pstCRC is the CRC-32 the PST format uses for blocks, pages and the header
+func pstCRC(b []byte) uint32 {
+	return ^crc32.Update(0xFFFFFFFF, crc32.IEEETable, b)
+}
+
+// blockSig ties a block or page to its BID and position
+func blockSig(ib, bid uint64) uint16 {
+	ib ^= bid
+	return uint16(uint32(ib)>>16) ^ uint16(uint32(ib))
+}
+
+// newNID hands out the next unused node ID of type t
+func (d *ndb) newNID(t uint32) uint32 {
+	d.rgnid[t]++
+	return d.rgnid[t]<<5 | t
+}
+
+// mapPages is how many map pages start AMap range k
+func mapPages(k uint64) uint64 {
+	n := uint64(1)
+	if k%pmapEvery == 0 {
+		n++
+	}
+	if k >= fmapFirst && (k-fmapFirst)%fmapEvery == 0 {
+		n++
+	}
+	if k >= fpmapFirst && (k-fpmapFirst)%fpmapEvery == 0 {
+		n++
+	}
+	return n
+}
+
+// alloc reserves size bytes aligned to align, never straddling two AMap ranges
+func (d *ndb) alloc(size, align uint64) uint64 {
+	for {
+		k := (d.eof - amapFirst) / amapRange
+		base := amapFirst + k*amapRange
+		if int(k) == len(d.amaps) {
+			d.amaps = append(d.amaps, make([]byte, pageTrailer))
+			d.mark(base, mapPages(k)*pstPageSize)
+			d.eof = base + mapPages(k)*pstPageSize
+		}
+		ib := (d.eof + align - 1) / align * align
+		if ib+size <= base+amapRange {
+			d.eof = ib + size
+			d.mark(ib, size)
+			return ib
+		}
+		d.eof = base + amapRange
+	}
+}
+
+func (d *ndb) mark(ib, size uint64) {
+	k := (ib - amapFirst) / amapRange
+	first := (ib - amapFirst - k*amapRange) / amapSlot
+	for i := first; i < first+(size+amapSlot-1)/amapSlot; i++ {
+		d.amaps[k][i/8] |= 0x80 >> (i % 8)
+	}
+}
+
+// writeBlock stores data as one block and returns its BID
+func (d *ndb) writeBlock(data []byte, internal bool) (uint64, error) {
+	bid := d.nextB
+	d.nextB += 4
+	if internal {
+		bid |= bidInternal
+	}
+	size := (uint64(len(data)) + pstTrailerSize + amapSlot - 1) / amapSlot * amapSlot
+	ib := d.alloc(size, amapSlot)
+	b := make([]byte, size)
+	copy(b, data)
+	t := b[size-pstTrailerSize:]
+	binary.LittleEndian.PutUint16(t, uint16(len(data)))
+	binary.LittleEndian.PutUint16(t[2:], blockSig(ib, bid))
+	binary.LittleEndian.PutUint32(t[4:], pstCRC(data))
+	binary.LittleEndian.PutUint64(t[8:], bid)
+	if _, err := d.w.WriteAt(b, int64(ib)); err != nil {
+		return 0, err
+	}
+	d.bbt = append(d.bbt, bbtEntry{bid: bid, ib: ib, cb: uint16(len(data))})
+	return bid, nil
+}
+
+// writeData stores data of any size, splitting it over an XBLOCK or XXBLOCK when it doesn't fit in one block
+func (d *ndb) writeData(data []byte) (uint64, error) {
+	chunks := [][]byte{}
+	for len(data) > pstMaxBlockData {
+		chunks = append(chunks, data[:pstMaxBlockData])
+		data = data[pstMaxBlockData:]
+	}
+	return d.writeBlocks(append(chunks, data))
+}
+
+// writeBlocks stores each chunk as a data block and returns the BID of the block,
+// or of the XBLOCK or XXBLOCK listing them when there is more than one
+func (d *ndb) writeBlocks(chunks [][]byte) (uint64, error) {
+	if len(chunks) == 1 {
+		return d.writeBlock(chunks[0], false)
+	}
+	type ref struct {
+		bid  uint64
+		size int
+	}
+	refs := []ref{}
+	for _, c := range chunks {
+		bid, err := d.writeBlock(c, false)
+		if err != nil {
+			return 0, err
+		}
+		refs = append(refs, ref{bid, len(c)})
+	}
+	const perX = (pstMaxBlockData - 8) / 8
+	for level := byte(1); ; level++ {
+		next := []ref{}
+		for len(refs) > 0 {
+			n := len(refs)
+			if n > perX {
+				n = perX
+			}
+			x := make([]byte, 8+8*n)
+			x[0] = 1
+			x[1] = level
+			binary.LittleEndian.PutUint16(x[2:], uint16(n))
+			total := 0
+			for i, r := range refs[:n] {
+				binary.LittleEndian.PutUint64(x[8+8*i:], r.bid)
+				total += r.size
+			}
+			binary.LittleEndian.PutUint32(x[4:], uint32(total))
+			bid, err := d.writeBlock(x, true)
+			if err != nil {
+				return 0, err
+			}
+			next = append(next, ref{bid, total})
+			refs = refs[n:]
+		}
+		if len(next) == 1 {
+			return next[0].bid, nil
+		}
+		if level == 2 {
+			return 0, ErrPSTTooLarge
+		}
+		refs = next
+	}
+}
+
+// subnode is one entry of a node's subnode B-tree
+type subnode struct {
+	nid     uint32
+	bidData uint64
+	bidSub  uint64
+}
+
+// writeSubnodes stores a subnode B-tree as an SLBLOCK, or SLBLOCKs under an SIBLOCK, and returns its BID
+func (d *ndb) writeSubnodes(subs []subnode) (uint64, error) {
+	if len(subs) == 0 {
+		return 0, nil
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].nid < subs[j].nid })
+	const perSL = (pstMaxBlockData - 8) / 24
+	const perSI = (pstMaxBlockData - 8) / 16
+	type ref struct {
+		nid uint32
+		bid uint64
+	}
+	refs := []ref{}
+	for start := 0; start < len(subs); start += perSL {
+		end := start + perSL
+		if end > len(subs) {
+			end = len(subs)
+		}
+		sl := make([]byte, 8+24*(end-start))
+		sl[0] = 2
+		binary.LittleEndian.PutUint16(sl[2:], uint16(end-start))
+		for i, s := range subs[start:end] {
+			e := sl[8+24*i:]
+			binary.LittleEndian.PutUint64(e, uint64(s.nid))
+			binary.LittleEndian.PutUint64(e[8:], s.bidData)
+			binary.LittleEndian.PutUint64(e[16:], s.bidSub)
+		}
+		bid, err := d.writeBlock(sl, true)
+		if err != nil {
+			return 0, err
+		}
+		refs = append(refs, ref{subs[start].nid, bid})
+	}
+	if len(refs) == 1 {
+		return refs[0].bid, nil
+	}
+	if len(refs) > perSI {
+		return 0, ErrPSTTooLarge
+	}
+	si := make([]byte, 8+16*len(refs))
+	si[0] = 2
+	si[1] = 1
+	binary.LittleEndian.PutUint16(si[2:], uint16(len(refs)))
+	for i, r := range refs {
+		binary.LittleEndian.PutUint64(si[8+16*i:], uint64(r.nid))
+		binary.LittleEndian.PutUint64(si[16+16*i:], r.bid)
+	}
+	return d.writeBlock(si, true)
+}
+
+// addNode records a node in the node B-tree
+func (d *ndb) addNode(nid uint32, bidData, bidSub uint64, parent uint32) {
+	d.nbt = append(d.nbt, nbtEntry{nid: nid, bidData: bidData, bidSub: bidSub, parent: parent})
+}
+
+// writePage fills in the page trailer and writes the page at ib
+func (d *ndb) writePage(page []byte, ptype byte, ib, bid uint64) error {
+	page[pageTrailer] = ptype
+	page[pageTrailer+1] = ptype
+	if ptype == ptypeBBT || ptype == ptypeNBT {
+		binary.LittleEndian.PutUint16(page[pageTrailer+2:], blockSig(ib, bid))
+	}
+	binary.LittleEndian.PutUint32(page[pageTrailer+4:], pstCRC(page[:pageTrailer]))
+	binary.LittleEndian.PutUint64(page[pageTrailer+8:], bid)
+	_, err := d.w.WriteAt(page, int64(ib))
+	return err
+}
+
+// btEntry is a key and its leaf entry bytes
+type btEntry struct {
+	key  uint64
+	data []byte
+}
+
+// writeBTree builds the pages of a BBT or NBT bottom up and returns the BID and offset of the root page
+func (d *ndb) writeBTree(ptype byte, entries []btEntry, cbEnt int) (uint64, uint64, error) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	for level := byte(0); ; level++ {
+		// cEntMax as Outlook sets it, which leaves the tail of an NBT leaf page unused
+		perPage := 20
+		if ptype == ptypeNBT && level == 0 {
+			perPage = 15
+		}
+		next := []btEntry{}
+		for start := 0; start == 0 || start < len(entries); start += perPage {
+			end := start + perPage
+			if end > len(entries) {
+				end = len(entries)
+			}
+			page := make([]byte, pstPageSize)
+			for i, e := range entries[start:end] {
+				copy(page[i*cbEnt:], e.data)
+			}
+			page[488] = byte(end - start)
+			page[489] = byte(perPage)
+			page[490] = byte(cbEnt)
+			page[491] = level
+			bid := d.nextP
+			d.nextP++
+			ib := d.alloc(pstPageSize, pstPageSize)
+			if err := d.writePage(page, ptype, ib, bid); err != nil {
+				return 0, 0, err
+			}
+			var key uint64
+			if start < len(entries) {
+				key = entries[start].key
+			}
+			branch := make([]byte, btBranchSize)
+			binary.LittleEndian.PutUint64(branch, key)
+			binary.LittleEndian.PutUint64(branch[8:], bid)
+			binary.LittleEndian.PutUint64(branch[16:], ib)
+			next = append(next, btEntry{key: key, data: branch})
+		}
+		if len(next) == 1 {
+			return binary.LittleEndian.Uint64(next[0].data[8:]), binary.LittleEndian.Uint64(next[0].data[16:]), nil
+		}
+		entries = next
+		cbEnt = btBranchSize
+	}
+}
+
+// close writes the B-trees, the allocation maps and finally the header
+func (d *ndb) close() error {
+	if d.written {
+		return nil
+	}
+	d.written = true
+	nbt := []btEntry{}
+	for _, n := range d.nbt {
+		e := make([]byte, nbtEntrySize)
+		binary.LittleEndian.PutUint64(e, uint64(n.nid))
+		binary.LittleEndian.PutUint64(e[8:], n.bidData)
+		binary.LittleEndian.PutUint64(e[16:], n.bidSub)
+		binary.LittleEndian.PutUint32(e[24:], n.parent)
+		nbt = append(nbt, btEntry{key: uint64(n.nid), data: e})
+	}
+	nbtBID, nbtIB, err := d.writeBTree(ptypeNBT, nbt, nbtEntrySize)
+	if err != nil {
+		return err
+	}
+	// the BBT pages are not blocks themselves, so the BBT is complete before its pages are placed
+	bbt := []btEntry{}
+	for _, b := range d.bbt {
+		e := make([]byte, bbtEntrySize)
+		binary.LittleEndian.PutUint64(e, b.bid)
+		binary.LittleEndian.PutUint64(e[8:], b.ib)
+		binary.LittleEndian.PutUint16(e[16:], b.cb)
+		binary.LittleEndian.PutUint16(e[18:], 2)
+		bbt = append(bbt, btEntry{key: b.bid, data: e})
+	}
+	bbtBID, bbtIB, err := d.writeBTree(ptypeBBT, bbt, bbtEntrySize)
+	if err != nil {
+		return err
+	}
+
+	var free uint64
+	for k, bits := range d.amaps {
+		base := amapFirst + uint64(k)*amapRange
+		page := make([]byte, pstPageSize)
+		copy(page, bits)
+		for _, b := range bits {
+			for i := 0; i < 8; i++ {
+				if b&(0x80>>i) == 0 {
+					free += amapSlot
+				}
+			}
+		}
+		if err := d.writePage(page, ptypeAMap, base, base); err != nil {
+			return err
+		}
+		ib := base + pstPageSize
+		for _, extra := range []struct {
+			ptype byte
+			ok    bool
+		}{
+			{ptypePMap, uint64(k)%pmapEvery == 0},
+			{ptypeFMap, k >= fmapFirst && (k-fmapFirst)%fmapEvery == 0},
+			{ptypeFPMap, k >= fpmapFirst && (k-fpmapFirst)%fpmapEvery == 0},
+		} {
+			if !extra.ok {
+				continue
+			}
+			// these maps are deprecated, filling them marks every page as free which readers ignore
+			page := make([]byte, pstPageSize)
+			for i := range page[:pageTrailer] {
+				page[i] = 0xFF
+			}
+			if err := d.writePage(page, extra.ptype, ib, ib); err != nil {
+				return err
+			}
+			ib += pstPageSize
+		}
+	}
+	lastAMap := amapFirst + uint64(len(d.amaps)-1)*amapRange
+	eof := lastAMap + amapRange
+	// extend the file to the end of the last AMap range
+	if _, err := d.w.WriteAt([]byte{0}, int64(eof-1)); err != nil {
+		return err
+	}
+
+	h := make([]byte, pstHeaderSize)
+	copy(h, "!BDN")
+	copy(h[8:], "SM")
+	binary.LittleEndian.PutUint16(h[10:], 23) // Unicode
+	binary.LittleEndian.PutUint16(h[12:], 19)
+	h[14] = 1
+	h[15] = 1
+	binary.LittleEndian.PutUint64(h[32:], d.nextP)
+	binary.LittleEndian.PutUint32(h[40:], 1)
+	for i, n := range d.rgnid {
+		binary.LittleEndian.PutUint32(h[44+4*i:], n)
+	}
+	binary.LittleEndian.PutUint64(h[184:], eof)
+	binary.LittleEndian.PutUint64(h[192:], lastAMap)
+	binary.LittleEndian.PutUint64(h[200:], free)
+	binary.LittleEndian.PutUint64(h[216:], nbtBID)
+	binary.LittleEndian.PutUint64(h[224:], nbtIB)
+	binary.LittleEndian.PutUint64(h[232:], bbtBID)
+	binary.LittleEndian.PutUint64(h[240:], bbtIB)
+	h[248] = 2 // fAMapValid
+	for i := 256; i < 512; i++ {
+		h[i] = 0xFF
+	}
+	h[512] = 0x80 // bSentinel
+	h[513] = 0    // bCryptMethod, stored unencoded
+	binary.LittleEndian.PutUint64(h[516:], d.nextB)
+	binary.LittleEndian.PutUint32(h[4:], pstCRC(h[8:8+471]))
+	binary.LittleEndian.PutUint32(h[524:], pstCRC(h[8:8+516]))
+	_, err = d.w.WriteAt(h, 0)
+	return err
+}
@@ -0,0 +1,81 @@
+package outlook
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	ErrNotStore         = errors.New("outlook: not a PST or OST file")
+	ErrUnsupportedStore = errors.New("outlook: unsupported PST or OST variant")
+)
+
+// Store is what the header of an Outlook data file says it is, whatever its extension.
+// PST and OST files share a format, an OST is the offline cache Outlook keeps for an Exchange mailbox.
+type Store struct {
+	OST     bool
+	Version uint16 // wVer, 14 or 15 for ANSI, 21 or 23 for Unicode, 36 for Unicode with 4K pages
+}
+
+func (s Store) Unicode() bool {
+	return s.Version >= 21
+}
+
+func (s Store) String() string {
+	kind := "PST"
+	if s.OST {
+		kind = "OST"
+	}
+	switch {
+	case s.Version == 36:
+		return "4K page Unicode " + kind
+	case s.Unicode():
+		return "Unicode " + kind
+	}
+	return "ANSI " + kind
+}
+
+// ReadStore identifies a PST or OST from its header and checks that it can be read.
+// A file that is not one returns ErrNotStore. Variants that go-pst and readpst can't read,
+// such as the compressed 4K page OST written by Outlook 2013 and later, return an error wrapping ErrUnsupportedStore.
+func ReadStore(r io.ReaderAt) (Store, error) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return Store{}, ErrNotStore
+	}
+	if !bytes.Equal(header[:4], []byte("!BDN")) {
+		return Store{}, ErrNotStore
+	}
+	var s Store
+	switch string(header[8:10]) {
+	case "SM":
+	case "SO":
+		s.OST = true
+	case "AB":
+		return Store{}, fmt.Errorf("%w: personal address book (.pab)", ErrUnsupportedStore)
+	default:
+		return Store{}, ErrNotStore
+	}
+	s.Version = binary.LittleEndian.Uint16(header[10:12])
+	switch s.Version {
+	case 14, 15, 21, 23:
+		return s, nil
+	case 36:
+		return s, fmt.Errorf("%w: %s, its blocks are compressed; export the mailbox to a PST from Outlook instead", ErrUnsupportedStore, s)
+	}
+	return s, fmt.Errorf("%w: unknown format version %d", ErrUnsupportedStore, s.Version)
+}
+
+// OpenStore is ReadStore on the file at path
+func OpenStore(path string) (Store, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Store{}, err
+	}
+	defer f.Close()
+	return ReadStore(f)
+}
@@ -0,0 +1,44 @@
+package outlook
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestReadStore(t *testing.T) {
+	pst, err := os.ReadFile("../../testdata/pstIn/TEST.pst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withHeader := func(client string, version uint16) []byte {
+		b := bytes.Clone(pst[:512])
+		copy(b[8:10], client)
+		binary.LittleEndian.PutUint16(b[10:12], version)
+		return b
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want Store
+		err  error
+	}{
+		{"pst", pst[:512], Store{Version: 23}, nil},
+		{"ost", withHeader("SO", 23), Store{OST: true, Version: 23}, nil},
+		{"ansi", withHeader("SM", 14), Store{Version: 14}, nil},
+		{"4k ost", withHeader("SO", 36), Store{OST: true, Version: 36}, ErrUnsupportedStore},
+		{"pab", withHeader("AB", 23), Store{}, ErrUnsupportedStore},
+		{"mbox", []byte("From sender@local Fri Apr 17 16:00:00 2020\n"), Store{}, ErrNotStore},
+		{"empty", nil, Store{}, ErrNotStore},
+	} {
+		s, err := ReadStore(bytes.NewReader(tc.data))
+		if s != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v %v, but got %v %v", tc.name, tc.want, tc.err, s, err)
+		}
+	}
+	if s := (Store{OST: true, Version: 36}); s.String() != "4K page Unicode OST" {
+		t.Errorf("Unexpected name %q", s)
+	}
+}
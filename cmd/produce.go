@@ -0,0 +1,152 @@
+/*
+Copyright © 2024 McFlip <grady.c.denton@yahoo.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/package cmd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/McFlip/enigma/cmd/export"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// produceCmd represents the produce command
+var produceCmd = &cobra.Command{
+	Use:   "produce",
+	Short: "Bates number deciphered output and package it into production volumes",
+	Long: `Bates number deciphered output and package it into production volumes.
+
+  Run after decipher. Every custodian under pt is produced in name order,
+  each email followed by its extracted attachments.
+  Output layout:
+    production/VOL001/NATIVES/ABC0000001.eml
+    production/VOL001/DATA/VOL001.dat & VOL001.opt
+    production/manifest.tsv
+  Volumes are capped by produce.maxVolumeBytes and produce.maxVolumeDocs.
+  Families are never split across volumes.
+  Nothing is written if a Bates number would need more than produce.digits
+  digits or run past produce.end, the last number of the assigned range.
+  DAT columns default to Bates, family and email fields; configure produce.fields to change them.
+  See enigma export loadfile --help for the available fields, plus BegBates, EndBates, OriginalDocID and Volume.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		viper.SetDefault("decipher.pt", "pt")
+		viper.SetDefault("produce.pt", viper.GetString("decipher.pt"))
+		*producePt = viper.GetString("produce.pt")
+		viper.SetDefault("produce.out", "production")
+		*produceOut = viper.GetString("produce.out")
+		*batesPrefix = viper.GetString("produce.prefix")
+		viper.SetDefault("produce.start", 1)
+		*batesStart = viper.GetInt("produce.start")
+		viper.SetDefault("produce.end", 0)
+		*batesEnd = viper.GetInt("produce.end")
+		viper.SetDefault("produce.digits", 7)
+		viper.SetDefault("produce.volumePrefix", "VOL")
+		production := export.Production{
+			Prefix:         *batesPrefix,
+			Start:          *batesStart,
+			End:            *batesEnd,
+			Digits:         viper.GetInt("produce.digits"),
+			VolumePrefix:   viper.GetString("produce.volumePrefix"),
+			MaxVolumeBytes: viper.GetInt64("produce.maxVolumeBytes"),
+			MaxVolumeDocs:  viper.GetInt("produce.maxVolumeDocs"),
+		}
+		if production.Prefix == "" {
+			log.Fatal("Bates prefix not configured!")
+		}
+		fields := []export.FieldMap{}
+		if err := viper.UnmarshalKey("produce.fields", &fields); err != nil {
+			log.Fatal("Failed to unmarshall produce fields: ", err)
+		}
+		if len(fields) == 0 {
+			fields = export.ProductionFields
+		}
+
+		custodians, err := os.ReadDir(*producePt)
+		if err != nil {
+			log.Fatal("Failed to read pt dir: ", err)
+		}
+		docs := []export.Document{}
+		for _, custodian := range custodians {
+			if !custodian.IsDir() {
+				continue
+			}
+			log.Println("Loading ", custodian.Name())
+			custodianDocs, err := export.LoadCustodian(filepath.Join(*producePt, custodian.Name()))
+			if err != nil {
+				log.Fatal("Failed to load deciphered output of ", custodian.Name(), ": ", err)
+			}
+			docs = append(docs, custodianDocs...)
+		}
+		if len(docs) == 0 {
+			log.Fatal("Error: nothing to produce")
+		}
+		volumes, err := export.Plan(docs, production)
+		if err != nil {
+			log.Fatal("Failed to plan production: ", err)
+		}
+		if err := os.Mkdir(*produceOut, 0755); err != nil {
+			log.Fatal("Error making production outpath ", *produceOut, " err: ", err)
+		}
+		for _, vol := range volumes {
+			log.Printf("Writing %s: %d documents, %d bytes\n", vol.Name, len(vol.Docs), vol.Size)
+			err := export.WriteVolume(*producePt, *produceOut, vol, fields, export.DefaultDelimiters)
+			if err != nil {
+				log.Fatal("Failed to write volume ", vol.Name, ": ", err)
+			}
+		}
+		manifest, err := os.Create(filepath.Join(*produceOut, "manifest.tsv"))
+		if err != nil {
+			log.Fatal("Failed to create manifest: ", err)
+		}
+		defer manifest.Close()
+		if err := export.WriteManifest(manifest, volumes); err != nil {
+			log.Fatal("Failed to write manifest: ", err)
+		}
+		last := volumes[len(volumes)-1].Docs
+		log.Println("Produced ", volumes[0].Docs[0].DocID, " - ", last[len(last)-1].DocID)
+		log.Println("DONE!")
+	},
+}
+
+var producePt, produceOut, batesPrefix *string
+var batesStart, batesEnd *int
+
+func init() {
+	rootCmd.AddCommand(produceCmd)
+
+	producePt = produceCmd.PersistentFlags().
+		String("pt", "", "Dir of deciphered output to produce. Defaults to decipher.pt.")
+	viper.BindPFlag("produce.pt", produceCmd.PersistentFlags().Lookup("pt"))
+	produceOut = produceCmd.PersistentFlags().
+		String("out", "", "Dir for the production volumes and manifest")
+	viper.BindPFlag("produce.out", produceCmd.PersistentFlags().Lookup("out"))
+	batesPrefix = produceCmd.PersistentFlags().
+		String("prefix", "", "Bates prefix, ex. ABC")
+	viper.BindPFlag("produce.prefix", produceCmd.PersistentFlags().Lookup("prefix"))
+	batesStart = produceCmd.PersistentFlags().
+		Int("start", 1, "First Bates number")
+	viper.BindPFlag("produce.start", produceCmd.PersistentFlags().Lookup("start"))
+	batesEnd = produceCmd.PersistentFlags().
+		Int("end", 0, "Last Bates number of the range, 0 for no limit")
+	viper.BindPFlag("produce.end", produceCmd.PersistentFlags().Lookup("end"))
+}
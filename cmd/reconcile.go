@@ -0,0 +1,85 @@
+/*
+Copyright © 2024 McFlip <grady.c.denton@yahoo.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/McFlip/enigma/cmd/reconcile"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// reconcileCmd represents the reconcile command
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Show every encrypted message was deciphered or explained",
+	Long: `Show every encrypted message was deciphered or explained.
+
+  Run after getheaders and decipher. The encrypted messages getheaders found for each custodian
+  are matched with the decipher logs by PST, folder path and Message-ID.
+  Each message is deciphered, a duplicate, a decipher exception, plaintext, corrupt or a gap.
+  Writes out/custodianName.tsv, one row per encrypted message with its outcome,
+  and out/summary.tsv with the counts for every custodian.
+  Gaps are messages decipher never logged. Messages left out by the shared filters show up as gaps,
+  so the summary also counts how many decipher filtered out.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		viper.SetDefault("header.header_out", "header_out")
+		viper.SetDefault("reconcile.header_out", viper.GetString("header.header_out"))
+		*reconcileHeaders = viper.GetString("reconcile.header_out")
+		viper.SetDefault("decipher.pt", "pt")
+		viper.SetDefault("reconcile.pt", viper.GetString("decipher.pt"))
+		*reconcilePt = viper.GetString("reconcile.pt")
+		viper.SetDefault("reconcile.out", "reconcile")
+		*reconcileOut = viper.GetString("reconcile.out")
+
+		if err := os.MkdirAll(*reconcileOut, 0755); err != nil {
+			log.Fatal("Failed to create reconcile output dir: ", err)
+		}
+		custodians, err := reconcile.Reconcile(*reconcileHeaders, *reconcilePt, *reconcileOut)
+		if err != nil {
+			log.Fatal("Failed to reconcile: ", err)
+		}
+		for _, c := range custodians {
+			if gaps := c.Counts()[reconcile.Gap]; gaps > 0 {
+				log.Printf("%s has %d of %d encrypted messages unaccounted for", c.Name, gaps, len(c.Messages))
+			}
+		}
+		log.Println("DONE!")
+	},
+}
+
+var reconcileHeaders, reconcilePt, reconcileOut *string
+
+func init() {
+	rootCmd.AddCommand(reconcileCmd)
+
+	reconcileHeaders = reconcileCmd.PersistentFlags().
+		String("header_out", "", "Dir of getheaders output. There is a subfolder for each custodian.")
+	viper.BindPFlag("reconcile.header_out", reconcileCmd.PersistentFlags().Lookup("header_out"))
+	reconcilePt = reconcileCmd.PersistentFlags().
+		String("pt", "", "Dir of deciphered output from decipher. There is a subfolder for each custodian.")
+	viper.BindPFlag("reconcile.pt", reconcileCmd.PersistentFlags().Lookup("pt"))
+	reconcileOut = reconcileCmd.PersistentFlags().
+		String("out", "", "Dir for the reconciliation reports")
+	viper.BindPFlag("reconcile.out", reconcileCmd.PersistentFlags().Lookup("out"))
+}
@@ -0,0 +1,257 @@
+// Shows that every encrypted message getheaders found was either deciphered or explained.
+// The encrypted rows of each custodian's headerMetaData.tsv are joined with the decipher logs
+// by PST, folder and Message-ID. Whatever is left over is a gap.
+package reconcile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/McFlip/enigma/cmd/export"
+	"github.com/McFlip/enigma/cmd/filter"
+)
+
+// Outcomes, in the order decipher logs are matched
+const (
+	Deciphered = "deciphered"
+	Duplicate  = "duplicate"
+	Exception  = "decipher exception"
+	Plaintext  = "plaintext"
+	Corrupt    = "corrupt"
+	Gap        = "gap"
+)
+
+// Outcomes lists every outcome in report order
+var Outcomes = []string{Deciphered, Duplicate, Exception, Plaintext, Corrupt, Gap}
+
+// Message is an encrypted message found by getheaders and what became of it
+type Message struct {
+	ID, PstFile, Folder, From, Subject, Date, MessageID string
+	Outcome                                             string
+	Detail                                              string // the decipher status or error
+	Target                                              string // where decipher logged it
+}
+
+// Custodian is the reconciliation of one custodian
+type Custodian struct {
+	Name     string
+	Messages []Message
+	// Filtered is how many messages the decipher filters left out, which can show up as gaps
+	Filtered int
+}
+
+// Counts tallies the messages by outcome
+func (c Custodian) Counts() map[string]int {
+	counts := map[string]int{}
+	for _, m := range c.Messages {
+		counts[m.Outcome]++
+	}
+	return counts
+}
+
+// location keys a message by where it was found. Message-ID is empty for messages that never had one.
+type location struct {
+	pst, folder, messageID string
+}
+
+// logged is a row of a decipher log
+type logged struct {
+	outcome, detail, target string
+}
+
+// Reconcile joins each custodian under headerDir with the same custodian under ptDir
+// and writes outDir/custodian.tsv and outDir/summary.tsv
+func Reconcile(headerDir, ptDir, outDir string) ([]Custodian, error) {
+	entries, err := os.ReadDir(headerDir)
+	if err != nil {
+		return nil, err
+	}
+	custodians := []Custodian{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		c, err := ReconcileCustodian(filepath.Join(headerDir, entry.Name()), filepath.Join(ptDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if err := writeCustodian(filepath.Join(outDir, c.Name+".tsv"), c); err != nil {
+			return nil, err
+		}
+		custodians = append(custodians, c)
+	}
+	return custodians, writeSummary(filepath.Join(outDir, "summary.tsv"), custodians)
+}
+
+// ReconcileCustodian matches the encrypted messages in headerMetaData.tsv under headerDir
+// with the decipher logs under ptDir. A custodian that was never deciphered is all gaps.
+func ReconcileCustodian(headerDir, ptDir string) (Custodian, error) {
+	c := Custodian{Name: filepath.Base(headerDir)}
+	rows, err := export.ReadTSV(filepath.Join(headerDir, "headerMetaData.tsv"))
+	if err != nil {
+		return c, err
+	}
+	// the folders of each store, by lowercase store and folder path
+	stores := map[string]map[string]bool{}
+	for _, row := range rows {
+		pst := strings.ToLower(row["PstFile"])
+		if stores[pst] == nil {
+			stores[pst] = map[string]bool{}
+		}
+		stores[pst][strings.ToLower(row["Folder"])] = true
+		if row["IsEncrypted"] != "true" {
+			continue
+		}
+		// attached messages are deciphered with the message they are attached to
+		if depth := row["Depth"]; depth != "" && depth != "0" {
+			continue
+		}
+		c.Messages = append(c.Messages, Message{
+			ID:        row["ID"],
+			PstFile:   row["PstFile"],
+			Folder:    row["Folder"],
+			From:      row["From"],
+			Subject:   row["Subj"],
+			Date:      row["Date"],
+			MessageID: row["Message-Id"],
+		})
+	}
+
+	logs := filepath.Join(ptDir, "logs")
+	found := map[location][]logged{}
+	for _, logFile := range []struct{ name, outcome string }{
+		{"success.tsv", Deciphered},
+		{"decipherExceptions.tsv", Exception},
+		{"ptExceptions.tsv", Plaintext},
+	} {
+		rows, err := export.ReadTSV(filepath.Join(logs, logFile.name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return c, err
+		}
+		for _, row := range rows {
+			l := logged{outcome: logFile.outcome, detail: row["Status"], target: row["Target"]}
+			if logFile.outcome != Deciphered {
+				l.detail = row["Error"]
+			} else if l.detail == "duplicate" {
+				l.outcome = Duplicate
+				l.detail = "duplicate of " + row["Duplicate Of"]
+			}
+			pst, folder := locate(row["Target"], stores)
+			key := location{pst, folder, row["Message-Id"]}
+			found[key] = append(found[key], l)
+		}
+	}
+	// corrupt input has no header to read a Message-ID from, so it can only be placed by folder
+	corrupt := map[location][]logged{}
+	if rows, err := export.ReadTSV(filepath.Join(logs, "corruptExceptions.tsv")); err == nil {
+		for _, row := range rows {
+			pst, folder := locate(row["Eml File"], stores)
+			key := location{pst: pst, folder: folder}
+			corrupt[key] = append(corrupt[key], logged{outcome: Corrupt, detail: row["Error"], target: row["Eml File"]})
+		}
+	} else if !os.IsNotExist(err) {
+		return c, err
+	}
+	if rows, err := export.ReadTSV(filepath.Join(logs, "filterSummary.tsv")); err == nil {
+		for _, row := range rows {
+			// no-folder messages were kept, they are only counted apart
+			if n, err := strconv.Atoi(row["Count"]); err == nil && row["Filter"] != "kept" && row["Filter"] != filter.NoFolder {
+				c.Filtered += n
+			}
+		}
+	}
+
+	for i := range c.Messages {
+		m := &c.Messages[i]
+		key := location{strings.ToLower(m.PstFile), strings.ToLower(m.Folder), m.MessageID}
+		if l, ok := take(found, key); ok {
+			m.Outcome, m.Detail, m.Target = l.outcome, l.detail, l.target
+		}
+	}
+	for i := range c.Messages {
+		m := &c.Messages[i]
+		if m.Outcome != "" {
+			continue
+		}
+		key := location{pst: strings.ToLower(m.PstFile), folder: strings.ToLower(m.Folder)}
+		if l, ok := take(corrupt, key); ok {
+			m.Outcome, m.Detail, m.Target = l.outcome, l.detail, l.target
+			continue
+		}
+		m.Outcome = Gap
+	}
+	return c, nil
+}
+
+// take removes and returns the first log row at key, so each row explains one message
+func take(logs map[location][]logged, key location) (logged, bool) {
+	rows := logs[key]
+	if len(rows) == 0 {
+		return logged{}, false
+	}
+	logs[key] = rows[1:]
+	return rows[0], true
+}
+
+// locate finds the PST and folder in a decipher log target. Messages unpacked from a PST are logged by their path inside it,
+// ex. ct/alice/mail.pst/Top of Outlook data file/Inbox/Archive/12.eml. readpst unpacks the mailbox into a dir named for
+// its top, so the folder is the path below that, ex. inbox/archive, the path getheaders writes in Folder.
+// mbox messages are logged as path#offset, the same name getheaders gives them, and msg files by path. Neither has a folder.
+func locate(target string, stores map[string]map[string]bool) (string, string) {
+	segments := strings.Split(filepath.ToSlash(target), "/")
+	for i, segment := range segments {
+		segment = strings.ToLower(segment)
+		folders, ok := stores[segment]
+		if !ok {
+			continue
+		}
+		if i == len(segments)-1 {
+			return segment, ""
+		}
+		dirs := segments[i+1 : len(segments)-1]
+		folder := strings.ToLower(strings.Join(dirs, "/"))
+		// the whole path is only a folder when readpst didn't make a dir for the top
+		if len(dirs) > 0 && !folders[folder] {
+			folder = strings.ToLower(strings.Join(dirs[1:], "/"))
+		}
+		return segment, folder
+	}
+	return strings.ToLower(segments[len(segments)-1]), ""
+}
+
+func writeCustodian(path string, c Custodian) error {
+	var b strings.Builder
+	b.WriteString("ID\tPstFile\tFolder\tFrom\tSubj\tDate\tMessage-Id\tOutcome\tDetail\tTarget\n")
+	for _, m := range c.Messages {
+		b.WriteString(strings.Join([]string{
+			m.ID, m.PstFile, m.Folder, m.From, m.Subject, m.Date, m.MessageID, m.Outcome, m.Detail, m.Target,
+		}, "\t"))
+		b.WriteRune('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func writeSummary(path string, custodians []Custodian) error {
+	sort.Slice(custodians, func(i, j int) bool { return custodians[i].Name < custodians[j].Name })
+	var b strings.Builder
+	b.WriteString("Custodian\tEncrypted")
+	for _, outcome := range Outcomes {
+		b.WriteString("\t" + outcome)
+	}
+	b.WriteString("\tFiltered\n")
+	for _, c := range custodians {
+		counts := c.Counts()
+		b.WriteString(fmt.Sprintf("%s\t%d", c.Name, len(c.Messages)))
+		for _, outcome := range Outcomes {
+			b.WriteString(fmt.Sprintf("\t%d", counts[outcome]))
+		}
+		b.WriteString(fmt.Sprintf("\t%d\n", c.Filtered))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
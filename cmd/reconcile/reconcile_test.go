@@ -0,0 +1,127 @@
+package reconcile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	headerDir := t.TempDir()
+	ptDir := t.TempDir()
+	outDir := t.TempDir()
+	header := "PstFile\tFolder\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tHasAttachments\tIsEncrypted\tAttachmentFileNames\tID\tParentID\tDepth\n"
+	row := func(pst, folder, subj, messageID, encrypted, id, depth string) string {
+		return strings.Join([]string{pst, folder, "a", "b", "", "", subj, "", messageID, "true", encrypted, "smime.p7m;", id, "", depth}, "\t") + "\n"
+	}
+	writeFile(t, filepath.Join(headerDir, "alice", "headerMetaData.tsv"), header+
+		row("mail.pst", "Inbox", "one", "<1@local>", "true", "mail.pst#1", "0")+
+		row("mail.pst", "Inbox", "nested", "<1a@local>", "true", "mail.pst#1/0", "1")+
+		row("mail.pst", "Inbox", "two", "<2@local>", "true", "mail.pst#2", "0")+
+		row("mail.pst", "Sent Items", "three", "<3@local>", "true", "mail.pst#3", "0")+
+		row("mail.pst", "Sent Items", "four", "<4@local>", "true", "mail.pst#4", "0")+
+		row("mail.pst", "Sent Items", "plain", "<5@local>", "false", "mail.pst#5", "0")+
+		row("mail.mbox#0", "", "six", "<6@local>", "true", "mail.mbox#0", "0")+
+		row("mail.pst", "Deleted Items", "seven", "<7@local>", "true", "mail.pst#7", "0"))
+	logRow := func(target, messageID, status string) string {
+		return strings.Join([]string{target, "a", "b", "", "", "", "", messageID, "yes", status}, "\t")
+	}
+	logs := filepath.Join(ptDir, "alice", "logs")
+	writeFile(t, filepath.Join(logs, "success.tsv"), "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tStatus\tOutput\tCiphertext\tDuplicate Of\n"+
+		logRow("ct/alice/mail.pst/Top of Outlook data file/Inbox/1.eml", "<1@local>", "success")+"\t1.eml\t\t\n"+
+		logRow("ct/alice/mail.mbox#0", "<6@local>", "duplicate")+"\t\t\tbob/1.eml\n")
+	writeFile(t, filepath.Join(logs, "decipherExceptions.tsv"), "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tError\n"+
+		logRow("ct/alice/mail.pst/Top of Outlook data file/Sent Items/3.eml", "<3@local>", "no key")+"\n")
+	writeFile(t, filepath.Join(logs, "ptExceptions.tsv"), "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tError\n"+
+		logRow("ct/alice/mail.pst/Top of Outlook data file/Inbox/9.eml", "<9@local>", "plaintext input")+"\n")
+	writeFile(t, filepath.Join(logs, "corruptExceptions.tsv"), "Eml File\tError\n"+
+		"ct/alice/mail.pst/Top of Outlook data file/Sent Items/4.eml\tmalformed header\n")
+	writeFile(t, filepath.Join(logs, "filterSummary.tsv"), "Filter\tSetting\tCount\nfolder\tInbox\t2\nno-folder\t\t1\nkept\t\t5\n")
+
+	custodians, err := Reconcile(headerDir, ptDir, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(custodians) != 1 {
+		t.Fatalf("Expected 1 custodian, but got %d", len(custodians))
+	}
+	outcomes := map[string]string{}
+	for _, m := range custodians[0].Messages {
+		outcomes[m.Subject] = m.Outcome
+	}
+	expected := map[string]string{
+		"one":   Deciphered,
+		"two":   Gap,
+		"three": Exception,
+		"four":  Corrupt,
+		"six":   Duplicate,
+		"seven": Gap,
+	}
+	if len(outcomes) != len(expected) {
+		t.Errorf("Expected only top level encrypted messages, but got %v", outcomes)
+	}
+	for subj, outcome := range expected {
+		if outcomes[subj] != outcome {
+			t.Errorf("Expected %s to be %s, but got %s", subj, outcome, outcomes[subj])
+		}
+	}
+
+	summary, err := os.ReadFile(filepath.Join(outDir, "summary.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSummary := "Custodian\tEncrypted\tdeciphered\tduplicate\tdecipher exception\tplaintext\tcorrupt\tgap\tFiltered\n" +
+		"alice\t6\t1\t1\t1\t0\t1\t2\t2\n"
+	if string(summary) != expectedSummary {
+		t.Errorf("Expected\n%s\n but got\n%s", expectedSummary, summary)
+	}
+	report, err := os.ReadFile(filepath.Join(outDir, "alice.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "mail.pst#3\tmail.pst\tSent Items\ta\tthree\t\t<3@local>\tdecipher exception\tno key\t") {
+		t.Errorf("Expected the exception to be explained, but got\n%s", report)
+	}
+}
+
+func TestReconcileNestedFolders(t *testing.T) {
+	headerDir := t.TempDir()
+	ptDir := t.TempDir()
+	outDir := t.TempDir()
+	header := "PstFile\tFolder\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tHasAttachments\tIsEncrypted\tAttachmentFileNames\tID\tParentID\tDepth\n"
+	row := func(folder, subj, id string) string {
+		return strings.Join([]string{"mail.pst", folder, "a", "b", "", "", subj, "", "", "true", "true", "smime.p7m;", id, "", "0"}, "\t") + "\n"
+	}
+	// same leaf folder and no Message-ID, so only the full folder path tells them apart
+	writeFile(t, filepath.Join(headerDir, "alice", "headerMetaData.tsv"), header+
+		row("Inbox/Archive", "inbox", "mail.pst#1")+
+		row("Sent Items/Archive", "sent", "mail.pst#2"))
+	logs := filepath.Join(ptDir, "alice", "logs")
+	writeFile(t, filepath.Join(logs, "success.tsv"), "Target\tFrom\tTo\tCC\tBCC\tSubj\tDate\tMessage-Id\tAttachments\tStatus\tOutput\tCiphertext\tDuplicate Of\n"+
+		"ct/alice/mail.pst/Top of Outlook data file/Sent Items/Archive/2.eml\ta\tb\t\t\t\t\t\tyes\tsuccess\t2.eml\t\t\n")
+	writeFile(t, filepath.Join(logs, "corruptExceptions.tsv"), "Eml File\tError\n"+
+		"ct/alice/mail.pst/Top of Outlook data file/Inbox/Archive/1.eml\tmalformed header\n")
+
+	custodians, err := Reconcile(headerDir, ptDir, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes := map[string]string{}
+	for _, m := range custodians[0].Messages {
+		outcomes[m.Subject] = m.Outcome
+	}
+	if outcomes["inbox"] != Corrupt || outcomes["sent"] != Deciphered {
+		t.Errorf("Expected inbox to be corrupt and sent to be deciphered, but got %v", outcomes)
+	}
+}
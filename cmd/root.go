@@ -52,7 +52,8 @@ var rootCmd = &cobra.Command{
   7. enigma getkeys
   8. cp myCipherText.pst ct/custodianName
   9. enigma decipher
-  10. 7z a results.7z pt # or tar czf results.tar.gz pt`,
+  10. enigma produce # Bates numbered volumes with load files and manifest
+  11. 7z a results.7z production # or tar czf results.tar.gz production`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
@@ -0,0 +1,79 @@
+/*
+Copyright © 2024 McFlip <grady.c.denton@yahoo.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/package cmd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/McFlip/enigma/cmd/export"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var topstPt *string
+
+// topstCmd represents the topst command
+var topstCmd = &cobra.Command{
+	Use:   "topst",
+	Short: "Write deciphered emails back into a PST per custodian",
+	Long: `Write deciphered emails back into a PST per custodian.
+
+  Run after decipher. Writes pt/custodianName/custodianName.pst, a Unicode PST,
+  from the eml or mbox output listed in success.tsv.
+  The PST is checked by reading it back with go-pst, and with readpst and pffinfo
+  where the tests find them installed. It hasn't been checked in Outlook, so open
+  a sample there before handing it to reviewers.
+  Each plaintext message is stored with its headers, bodies, recipients and attachments.
+  Messages from a PST keep their folders under a folder named for that PST, ex. mail.pst/Inbox.
+  Messages from an mbox go in a folder named for the mbox and loose files in one named for their directory.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		viper.SetDefault("decipher.pt", "pt")
+		viper.SetDefault("topst.pt", viper.GetString("decipher.pt"))
+		*topstPt = viper.GetString("topst.pt")
+
+		custodians, err := os.ReadDir(*topstPt)
+		if err != nil {
+			log.Fatal("Failed to read pt dir: ", err)
+		}
+		for _, custodian := range custodians {
+			if !custodian.IsDir() {
+				continue
+			}
+			custodianDir := filepath.Join(*topstPt, custodian.Name())
+			log.Println("Writing PST for ", custodian.Name())
+			count, err := export.WritePST(custodianDir, filepath.Join(custodianDir, custodian.Name()+".pst"))
+			if err != nil {
+				log.Fatal("Failed to write PST for ", custodian.Name(), ": ", err)
+			}
+			log.Println("Wrote ", count, " messages")
+		}
+		log.Println("DONE!")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(topstCmd)
+	topstPt = topstCmd.PersistentFlags().
+		String("pt", "", "Dir of deciphered output from decipher. There is a subfolder for each custodian.")
+	viper.BindPFlag("topst.pt", topstCmd.PersistentFlags().Lookup("pt"))
+}
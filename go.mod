@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/emersion/go-message v0.16.0
 	github.com/mooijtech/go-pst/v6 v6.0.2
+	github.com/richardlehane/mscfb v1.0.6
 	github.com/rotisserie/eris v0.5.4
 	github.com/smallstep/pkcs7 v0.0.0-20231107075624-be1870d87d13
 	github.com/spf13/cobra v1.8.0
@@ -26,6 +27,7 @@ require (
 	github.com/pelletier/go-toml/v2 v2.1.0 // indirect
 	github.com/philhofer/fwd v1.1.2 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/richardlehane/msoleps v1.0.3 // indirect
 	github.com/sagikazarmark/locafero v0.4.0 // indirect
 	github.com/sagikazarmark/slog-shim v0.1.0 // indirect
 	github.com/sourcegraph/conc v0.3.0 // indirect